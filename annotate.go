@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(annotateCmd)
+}
+
+var annotateCmd = &cobra.Command{
+	Use:         "annotate <id-prefix> <note>",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Attach a note to a conversation without editing it",
+	Long: `Attach your own note to a stored conversation, e.g. "superseded by the
+Q3 plan". The note replaces any earlier one, and an empty note removes it.
+It is shown by list and, with prime --context-include-notes, given to
+synthesis alongside the conversation's excerpts.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prefix := strings.TrimSpace(args[0])
+		if prefix == "" {
+			return fmt.Errorf("id prefix must not be empty")
+		}
+		note := strings.TrimSpace(args[1])
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		id, err := resolveID(store, prefix)
+		if err != nil {
+			return err
+		}
+		if err := store.SetNote(id, note); err != nil {
+			return err
+		}
+
+		if note == "" {
+			fmt.Printf("Removed the note on %s.\n", shortID(id))
+		} else {
+			fmt.Printf("Annotated %s.\n", shortID(id))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateStoresShowsAndSynthesizesNote(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	text := strings.Repeat("worker pools drain the queue ", 20)
+	uploadTexts(t, f, db, text)
+	id := hashContent([]byte(normalizeText(text)))
+	const note = "superseded by the Q3 plan"
+
+	if _, _, err := runCmd(t, append(f.args(db), "annotate", id[:8], "  "+note+"  ")...); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.Get(id)
+	store.Close()
+	if err != nil || c.Note != note {
+		t.Fatalf("stored note = %q (%v), want %q", c.Note, err, note)
+	}
+
+	out, _, err := runCmd(t, append(f.args(db), "list")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "[note: "+note+"]") {
+		t.Errorf("list doesn't show the note:\n%s", out)
+	}
+
+	prompt := func(args ...string) string {
+		t.Helper()
+		if _, _, err := runCmd(t, append(append(f.args(db), "prime", "--threshold", "0.99"), args...)...); err != nil {
+			t.Fatal(err)
+		}
+		prompts := f.generatePrompts()
+		return prompts[len(prompts)-1]
+	}
+	if p := prompt("worker pools"); strings.Contains(p, note) {
+		t.Error("the note reached synthesis without --context-include-notes")
+	}
+	if p := prompt("--context-include-notes", "worker pools"); !strings.Contains(p, "[note: "+note+"]") {
+		t.Errorf("synthesis prompt lacks the note:\n%s", p)
+	}
+
+	// An empty note removes it
+	if _, _, err := runCmd(t, append(f.args(db), "annotate", id[:8], "")...); err != nil {
+		t.Fatal(err)
+	}
+	if out, _, _ := runCmd(t, append(f.args(db), "list")...); strings.Contains(out, "[note:") {
+		t.Errorf("list still shows a removed note:\n%s", out)
+	}
+}
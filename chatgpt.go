@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var importChatGPTCmd = &cobra.Command{
+	Use:   "chatgpt <conversations.json>",
+	Short: "Import the conversations.json from a ChatGPT data export",
+	Long: `Import every conversation in a ChatGPT data export as its own stored
+conversation, keeping its title and creation time. Each is flattened to a
+"role: message" transcript of the branch that was last shown; system and
+hidden messages are left out.`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{writesDB: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		records, skipped, err := readChatGPTExport(args[0])
+		if err != nil {
+			return err
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ollama := NewOllama(ollamaURL, embedModel)
+		if err := ensureDimension(cmd.Context(), store, ollama); err != nil {
+			return err
+		}
+
+		if importAtomic {
+			err = importAllOrNothing(cmd.Context(), store, ollama, records)
+		} else {
+			err = importEach(cmd.Context(), store, ollama, records)
+		}
+		if err != nil {
+			return err
+		}
+		if timing != nil {
+			timing.Print()
+		}
+
+		fmt.Printf("Imported %d conversations, skipped %d with no visible messages\n", len(records), skipped)
+		return nil
+	},
+}
+
+// chatGPTConversation is the part of a ChatGPT export conversation that is
+// imported. Messages form a tree in Mapping, since editing a message
+// starts a new branch; CurrentNode is the last message of the branch
+// shown in the UI.
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string          `json:"parent"`
+	Message *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	Content struct {
+		// Parts are strings for text, objects for images and files
+		Parts []json.RawMessage `json:"parts"`
+	} `json:"content"`
+	Metadata struct {
+		Hidden bool `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// readChatGPTExport reads the export one conversation at a time, since
+// exports can be hundreds of megabytes. Conversations with no visible
+// messages are counted as skipped.
+func readChatGPTExport(path string) ([]importRecord, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, 0, fmt.Errorf("%s is not a ChatGPT conversations.json (want a JSON array)", path)
+	}
+
+	var records []importRecord
+	skipped := 0
+	for i := 1; dec.More(); i++ {
+		var c chatGPTConversation
+		if err := dec.Decode(&c); err != nil {
+			return nil, 0, fmt.Errorf("conversation %d: %w", i, err)
+		}
+
+		transcript := chatGPTTranscript(c)
+		if transcript == "" {
+			skipped++
+			continue
+		}
+
+		conv := Conversation{Content: normalizeText(transcript), Title: c.Title, CreatedAt: time.Now()}
+		conv.ID = hashContent([]byte(conv.Content))
+		if c.CreateTime > 0 {
+			conv.CreatedAt = time.Unix(0, int64(c.CreateTime*float64(time.Second)))
+		}
+		records = append(records, importRecord{Where: fmt.Sprintf("conversation %d (%q)", i, c.Title), Conversation: conv})
+	}
+	return records, skipped, nil
+}
+
+// chatGPTTranscript flattens the current branch of a conversation into
+// "role: content" paragraphs, oldest first
+func chatGPTTranscript(c chatGPTConversation) string {
+	var msgs []string
+	seen := make(map[string]bool)
+	for id := c.CurrentNode; id != "" && !seen[id]; id = c.Mapping[id].Parent {
+		seen[id] = true
+		m := c.Mapping[id].Message
+		if m == nil || m.Metadata.Hidden || m.Author.Role == "system" {
+			continue
+		}
+
+		var parts []string
+		for _, raw := range m.Content.Parts {
+			var text string
+			if json.Unmarshal(raw, &text) == nil && strings.TrimSpace(text) != "" {
+				parts = append(parts, strings.TrimSpace(text))
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		msgs = append(msgs, m.Author.Role+": "+strings.Join(parts, "\n"))
+	}
+
+	// Walking up from the current node visits the branch newest first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return strings.Join(msgs, "\n\n")
+}
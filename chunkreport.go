@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// chunkReport describes how an upload was chunked, so results can be
+// mapped back to the source. Offsets are byte offsets into the stored
+// conversation content.
+type chunkReport struct {
+	ConversationID string            `json:"conversation_id"`
+	Bytes          int               `json:"bytes"`
+	Chunks         []chunkReportItem `json:"chunks"`
+}
+
+type chunkReportItem struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"`
+	Chars    int    `json:"chars"`
+	Tokens   int    `json:"tokens"` // rough estimate, chars/4
+	Start    int    `json:"start"`  // -1 if the chunk couldn't be located
+	End      int    `json:"end"`
+	Hash     string `json:"hash"`
+}
+
+func writeChunkReport(path, convID, source string, chunks []string) error {
+	report := chunkReport{ConversationID: convID, Bytes: len(source)}
+
+	cursor := 0
+	for i, c := range chunks {
+		start, end, ok := alignChunk(source, cursor, c)
+		// With --chunk-overlap a chunk starts inside the one before it
+		for from := cursor - 1; !ok && from >= 0 && from >= cursor-len(c); from-- {
+			start, end, ok = alignChunk(source, from, c)
+		}
+		if ok {
+			cursor = end
+		} else {
+			start, end = -1, -1
+		}
+		report.Chunks = append(report.Chunks, chunkReportItem{
+			ID:       chunkID(convID, i),
+			Position: i,
+			Chars:    utf8.RuneCountInString(c),
+			Tokens:   (len(c) + 3) / 4,
+			Start:    start,
+			End:      end,
+			Hash:     hashContent([]byte(c)),
+		})
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write chunk report: %w", err)
+	}
+	return nil
+}
+
+// alignChunk finds the span of source, starting at or after from, that a
+// chunk was built from. Chunking trims paragraphs and rejoins them with
+// different whitespace, so any whitespace run in the chunk matches any
+// whitespace run in the source.
+func alignChunk(source string, from int, chunk string) (start, end int, ok bool) {
+	start = skipSpace(source, from)
+	i, j := start, 0
+	for j < len(chunk) {
+		cr, cn := utf8.DecodeRuneInString(chunk[j:])
+		if unicode.IsSpace(cr) {
+			if i >= len(source) {
+				return 0, 0, false
+			}
+			if sr, _ := utf8.DecodeRuneInString(source[i:]); !unicode.IsSpace(sr) {
+				return 0, 0, false
+			}
+			i = skipSpace(source, i)
+			j = skipSpace(chunk, j)
+			continue
+		}
+		if i >= len(source) {
+			return 0, 0, false
+		}
+		sr, sn := utf8.DecodeRuneInString(source[i:])
+		if sr != cr {
+			return 0, 0, false
+		}
+		i += sn
+		j += cn
+	}
+	return start, i, true
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += n
+	}
+	return i
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkReportMapsBackToSource(t *testing.T) {
+	var paras []string
+	for i, topic := range []string{"worker pools", "night trains", "sourdough starters", "retry budgets"} {
+		paras = append(paras, strings.Repeat(topic+" come up again  and\tagain. ", 12+i))
+	}
+	source := strings.Join(paras, "\n\n\n")
+	words := func(s string) string { return strings.Join(strings.Fields(s), " ") }
+
+	for _, overlap := range []string{"0", "40"} {
+		t.Run("overlap "+overlap, func(t *testing.T) {
+			f := newFakeOllama(t)
+			db := filepath.Join(t.TempDir(), "test.db")
+			reportPath := filepath.Join(t.TempDir(), "report.json")
+			args := append(f.args(db), "upload", writeFile(t, "conv.txt", source), "--chunk-report", reportPath, "--chunk-overlap", overlap)
+			if _, _, err := runCmd(t, args...); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(reportPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report chunkReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := NewStore(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			conv, err := store.Get(report.ConversationID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks, err := store.ChunksForConversation(conv.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) < 2 || len(chunks) != len(report.Chunks) || report.Bytes != len(conv.Content) {
+				t.Fatalf("report has %d chunks for %d bytes, store has %d for %d", len(report.Chunks), report.Bytes, len(chunks), len(conv.Content))
+			}
+
+			var rebuilt []string
+			end, overlapped := 0, false
+			for i, item := range report.Chunks {
+				c := chunks[i]
+				if item.ID != c.ID || item.Position != c.Position || item.Hash != hashContent([]byte(c.Content)) {
+					t.Errorf("report chunk %d = %+v, stored %s at %d", i, item, c.ID, c.Position)
+				}
+				if item.Start < 0 || item.End > len(conv.Content) || item.Start >= item.End {
+					t.Fatalf("chunk %d has span %d:%d", i, item.Start, item.End)
+				}
+				span := conv.Content[item.Start:item.End]
+				if words(span) != words(c.Content) {
+					t.Errorf("chunk %d span %q doesn't match its content %q", i, span, c.Content)
+				}
+				if item.Start < end {
+					// The overlap repeats the end of the last span
+					span, overlapped = conv.Content[end:item.End], true
+				}
+				rebuilt = append(rebuilt, span)
+				end = item.End
+			}
+			if overlapped != (overlap != "0") {
+				t.Errorf("spans overlap: %v, with --chunk-overlap %s", overlapped, overlap)
+			}
+			if got := words(strings.Join(rebuilt, " ")); got != words(conv.Content) {
+				t.Errorf("spans don't reconstruct the source:\n%s\nwant:\n%s", got, words(conv.Content))
+			}
+		})
+	}
+}
@@ -1,20 +1,105 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
-	dbPath    string
-	ollamaURL string
+	dbPath         string
+	dbReadOnly     bool
+	ollamaURL      string
+	embedModel     string
+	genModel       string
+	validateDims   bool
+	vecIndexType   string
+	distanceMetric string
+	normalizeEmbs  bool
+
+	maxParallelOllama int
+	retryBudgetLimit  int
+	embedTimeout      time.Duration
+	generateTimeout   time.Duration
+
+	noUnicodeNormalize bool
+	expandQueries      bool
+	embedRetries       int
+	maxEmbedChars      int
+	timeOps            bool
+	cleanCode          bool
+	stripComments      bool
+	indexTitles        bool
+
+	maxContentBytes int
+	maxContextChars int
+	docLimit        int
+	keepFences      bool
+	multiQuery      int
+	synthSources    int
+
+	adaptiveThreshold    bool
+	interactiveThreshold bool
+	filterIrrelevant     bool
+	scoringModel         string
+	includeMetadata      bool
+	includeNotes         bool
+	synthLang            string
+	contextOnly          bool
+
+	rankQuery string
+	rankDocs  []string
+
+	unusedFor string
+
+	assumeYes   bool
+	autoReindex bool
+
+	limitBytes      int64
+	forceUpload     bool
+	chunkReportPath string
+	onConflict      string
+	uploadImage     bool
+	visionModel     string
+	versionOf       string
+	uploadTags      []string
+
+	previewStrategy string
+	previewLines    int
+	listLimit       int
+	hybridSearch    bool
+	hybridAlpha     float64
+	noEmbedCache    bool
+	diversity       float64
+	storeRaw        bool
+	listOffset      int
+	debugLimit      int
+	precision       int
+
+	distanceThreshold float64
+	topK              int
+	warnSlowQuery     time.Duration
+	tagFilter         string
+	coerceDims        bool
 )
 
 func init() {
@@ -22,165 +107,2140 @@ func init() {
 	defaultDB := filepath.Join(home, ".memctx.db")
 
 	rootCmd.PersistentFlags().StringVar(&dbPath, "db", defaultDB, "database path")
+	rootCmd.PersistentFlags().BoolVar(&dbReadOnly, "db-readonly", false, "open the database read-only; commands that write will fail")
 	rootCmd.PersistentFlags().StringVar(&ollamaURL, "ollama", "http://localhost:11434", "ollama base URL")
+	rootCmd.PersistentFlags().StringVar(&embedModel, "embed-model", "nomic-embed-text", "Ollama model for embeddings; it must match the one the database was indexed with")
+	rootCmd.PersistentFlags().StringVar(&genModel, "gen-model", "llama3.2", "Ollama model for synthesis, query expansion and variants")
+	rootCmd.PersistentFlags().IntVar(&maxParallelOllama, "max-parallel-ollama", 4, "max concurrent Ollama requests across all operations (0 = unlimited)")
+	rootCmd.PersistentFlags().IntVar(&retryBudgetLimit, "retry-budget", 50, "abort once Ollama requests have been retried this many times in total (0 = no cap)")
+	rootCmd.PersistentFlags().DurationVar(&embedTimeout, "embed-timeout", 30*time.Second, "timeout for each embedding request (0 = none)")
+	rootCmd.PersistentFlags().DurationVar(&generateTimeout, "generate-timeout", 5*time.Minute, "timeout for each generation request, including the whole stream (0 = none)")
+	rootCmd.PersistentFlags().IntVar(&maxEmbedChars, "max-embed-chars", 8000, "truncate text sent to the embedding model to this many bytes; the stored text is kept whole (0 = no limit)")
+	rootCmd.PersistentFlags().BoolVar(&noUnicodeNormalize, "no-unicode-normalize", false, "store content as-is instead of normalizing it to Unicode NFC")
+	rootCmd.PersistentFlags().StringVar(&vecIndexType, "vec-index-type", "flat", "vector index for new databases; only flat (exact scan) is supported")
+	rootCmd.PersistentFlags().StringVar(&distanceMetric, "metric", metricCosine, "distance metric for new databases: cosine or l2 (existing ones keep theirs)")
+	rootCmd.PersistentFlags().BoolVar(&normalizeEmbs, "normalize", false, "L2-normalize embeddings and queries in new databases (existing ones keep their setting)")
+	rootCmd.PersistentFlags().BoolVar(&validateDims, "validate-dims", true, "check the query embedding length against a stored embedding before searching")
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(primeCmd)
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(debugCmd)
 	rootCmd.AddCommand(reindexCmd)
+	rootCmd.AddCommand(retryFailedCmd)
+	rootCmd.AddCommand(rankCmd)
+	rootCmd.AddCommand(forgetCmd)
+	rootCmd.AddCommand(verifyHashesCmd)
+
+	primeCmd.Flags().StringVar(&synthLang, "lang", "", "language for the synthesized context, e.g. German (default: the intent's language)")
+	for _, c := range []*cobra.Command{primeCmd, mcpCmd} {
+		c.Flags().BoolVar(&filterIrrelevant, "filter-irrelevant", false, "ask --context-scoring-model whether each retrieved chunk is relevant and drop the ones it rejects")
+		c.Flags().StringVar(&scoringModel, "context-scoring-model", "llama3.2", "fast model used by --filter-irrelevant")
+	}
+	primeCmd.Flags().BoolVar(&contextOnly, "context-only", false, "print the retrieved context without synthesizing it")
+	primeCmd.Flags().BoolVar(&includeMetadata, "context-include-metadata", false, "prefix each context given to synthesis with its source id and date")
+	primeCmd.Flags().BoolVar(&includeNotes, "context-include-notes", false, "give synthesis each source's note (see annotate) along with its context")
+	primeCmd.Flags().BoolVar(&adaptiveThreshold, "adaptive-threshold", false, "use the threshold learned from `memctx feedback`")
+	primeCmd.Flags().BoolVar(&interactiveThreshold, "interactive-threshold", false, "after showing the matches, ask for a threshold to search again with until one is accepted, then synthesize")
+	primeCmd.Flags().IntVar(&synthSources, "synth-sources", 0, "max distinct contexts passed to synthesis, independent of how many were retrieved (0 = all)")
+	primeCmd.Flags().IntVar(&multiQuery, "multi-query", 1, "search with N phrasings of the intent (N-1 generated) and fuse the results")
+	primeCmd.Flags().BoolVar(&keepFences, "keep-fences", false, "don't unwrap output the model put in a code fence")
+	primeCmd.Flags().IntVar(&docLimit, "doc-limit", 5, "max conversations used by the whole-doc fallback")
+	primeCmd.Flags().IntVar(&maxContentBytes, "max-content-bytes", 2000, "max bytes of each context passed to synthesis")
+	primeCmd.Flags().IntVar(&maxContextChars, "max-context-chars", 6000, "max chars of all contexts passed to synthesis together, about 4 per token; the lowest-ranked are dropped first (0 = no limit)")
+
+	uploadCmd.Flags().Int64Var(&limitBytes, "limit-bytes", 10<<20, "refuse input larger than this many bytes")
+	uploadCmd.Flags().BoolVar(&uploadImage, "image", false, "the file is an image: store a description of it from --vision-model")
+	uploadCmd.Flags().StringVar(&visionModel, "vision-model", "llava", "multimodal model that describes --image uploads")
+	uploadCmd.Flags().StringVar(&onConflict, "on-conflict", "skip", "when the content is already stored: skip, replace (re-embed it), or version (store a linked new version)")
+	uploadCmd.Flags().StringVar(&versionOf, "version-of", "", "store the file as a new version of this conversation (ID prefix), e.g. an edited document")
+	uploadCmd.Flags().StringVar(&chunkReportPath, "chunk-report", "", "write a JSON report of chunk IDs, offsets and hashes to this file")
+	uploadCmd.Flags().StringArrayVar(&uploadTags, "tag", nil, "tag the conversation, e.g. a project name (repeatable)")
+	uploadCmd.Flags().BoolVar(&forceUpload, "force", false, "upload even if the input is over --limit-bytes, and re-embed content that is already stored")
+
+	listCmd.Flags().IntVar(&listLimit, "limit", 20, "max conversations to list, newest first (0 = all)")
+	listCmd.Flags().IntVar(&listOffset, "offset", 0, "skip this many of the newest conversations first")
+	listCmd.Flags().IntVar(&previewLines, "preview-lines", 0, "show the first N non-empty lines of each conversation instead of a one-line preview")
+	listCmd.Flags().StringVar(&previewStrategy, "preview-strategy", "title", "preview to show: head (start of content), smart (first substantive line) or title (the stored title, else head)")
+
+	debugCmd.Flags().IntVar(&debugLimit, "limit", 20, "max chunks and conversations to show")
+
+	rankCmd.Flags().StringVar(&rankQuery, "query", "", "query to rank documents against")
+	rankCmd.Flags().StringArrayVar(&rankDocs, "doc", nil, "document file to rank (repeatable)")
+	rankCmd.MarkFlagRequired("query")
+	rankCmd.MarkFlagRequired("doc")
+
+	forgetCmd.Flags().StringVar(&unusedFor, "unused-for", "", "forget conversations not returned by a search for this long (e.g. 180d)")
+	forgetCmd.Flags().BoolVar(&assumeYes, "yes", false, "actually delete instead of listing candidates")
+	forgetCmd.MarkFlagRequired("unused-for")
+
+	for _, c := range []*cobra.Command{primeCmd, searchCmd, listCmd} {
+		c.Flags().StringVar(&tagFilter, "tag", "", "only use conversations with this tag (case-insensitive)")
+	}
+
+	for _, c := range []*cobra.Command{primeCmd, searchCmd} {
+		c.Flags().Float64Var(&diversity, "diversity", 0, "re-rank matches by maximal marginal relevance, from 0 (off, by distance only) to 1 (favour chunks unlike the ones already picked)")
+		c.Flags().BoolVar(&hybridSearch, "hybrid", false, "also find chunks sharing the query's words and rank by a weighted sum of both scores")
+		c.Flags().Float64Var(&hybridAlpha, "alpha", 0.5, "with --hybrid, the weight of the vector score from 0 (keyword only) to 1 (vector only)")
+		c.Flags().Float64Var(&distanceThreshold, "threshold", defaultThreshold, "max distance for a match, lower is stricter (0.45 suits nomic-embed-text under cosine)")
+		c.Flags().IntVar(&topK, "top-k", 10, "max chunks to retrieve")
+	}
+
+	for _, c := range []*cobra.Command{primeCmd, searchCmd, rankCmd, debugCmd} {
+		c.Flags().IntVar(&precision, "precision", -1, "decimal places for similarity and distance, -1 keeps each command's usual format")
+	}
+
+	for _, c := range []*cobra.Command{primeCmd, searchCmd, debugCmd} {
+		c.Flags().BoolVar(&coerceDims, "coerce-dims", false, "on an embedding dimension mismatch, truncate or zero-pad the query to the index's dimension instead of failing (inaccurate, for quick experiments)")
+		c.Flags().DurationVar(&warnSlowQuery, "warn-slow-query", 2*time.Second, "warn on stderr when a single search takes longer than this (0 = never)")
+		c.Flags().BoolVar(&expandQueries, "expand", false, "rewrite the query with the generation model before embedding (costs a generation call)")
+	}
+
+	for _, c := range []*cobra.Command{uploadCmd, primeCmd} {
+		c.Flags().BoolVar(&autoReindex, "auto-reindex", false, "on an embedding dimension mismatch, reindex everything with the current model")
+		c.Flags().BoolVar(&assumeYes, "yes", false, "don't ask before an automatic reindex")
+	}
+
+	for _, c := range []*cobra.Command{uploadCmd, reindexCmd, retryFailedCmd} {
+		c.Flags().IntVar(&embedRetries, "embed-retries-per-chunk", 2, "retries per chunk before it is recorded as failed")
+		c.Flags().BoolVar(&cleanCode, "clean-code", false, "collapse whitespace in code-like chunks before embedding")
+		c.Flags().BoolVar(&stripComments, "strip-comments", false, "with --clean-code, also drop whole-line comments")
+	}
+	for _, c := range []*cobra.Command{reindexCmd, importJSONLCmd, importChatGPTCmd} {
+		c.Flags().BoolVar(&indexTitles, "index-titles", false, "also embed each conversation's title as a chunk of its own, so a query can match the title alone")
+	}
+	for _, c := range []*cobra.Command{uploadCmd, reindexCmd, importJSONLCmd, importChatGPTCmd} {
+		c.Flags().BoolVar(&noEmbedCache, "no-cache", false, "embed every chunk again instead of reusing vectors cached for identical text and model")
+		c.Flags().BoolVar(&storeRaw, "store-raw-embedding", false, "also keep each chunk embedding's exact float32 bytes in the raw_embeddings table, for export and auditing")
+		c.Flags().IntVar(&minWords, "min-words", 0, "don't store or embed chunks with fewer words than this (the conversation text keeps them)")
+		c.Flags().IntVar(&chunkOpts.Overlap, "chunk-overlap", 0, fmt.Sprintf("chars from the end of each chunk repeated at the start of the next (less than the %d-char chunk size)", chunkOpts.Size))
+		c.Flags().BoolVar(&chunkOpts.NoTrim, "no-trim", false, "keep whitespace inside chunks, e.g. code indentation, instead of trimming each paragraph")
+		c.Flags().IntVar(&chunkOpts.SentencesPerUnit, "sentences-per-unit", 1, "sentences kept together when splitting an oversized paragraph")
+		c.Flags().StringSliceVar(&chunkOpts.Abbreviations, "abbreviations", defaultAbbreviations, "words that don't end a sentence when followed by a period")
+		c.Flags().BoolVar(&timeOps, "time", false, "print per-chunk embed and db-write latency stats at the end (on stderr with just --verbose)")
+		c.PreRunE = func(cmd *cobra.Command, args []string) error {
+			if chunkOpts.Overlap < 0 || chunkOpts.Overlap >= chunkOpts.Size {
+				return fmt.Errorf("--chunk-overlap must be from 0 to %d, less than the chunk size", chunkOpts.Size-1)
+			}
+			if timeOps || verboseLog {
+				timing = &ingestTiming{}
+			}
+			return nil
+		}
+	}
 }
 
 var rootCmd = &cobra.Command{
 	Use:   "memctx",
 	Short: "Personal memory context for LLM conversations",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setLogLevel(); err != nil {
+			return err
+		}
+		SetMaxParallelOllama(maxParallelOllama)
+		SetRetryBudget(retryBudgetLimit)
+		SetOllamaTimeouts(embedTimeout, generateTimeout)
+		if vecIndexType != vecIndexFlat {
+			fmt.Fprintf(os.Stderr, "warning: --vec-index-type %s is not supported, vector search is always a flat scan\n", vecIndexType)
+		}
+		if diversity < 0 || diversity > 1 {
+			return fmt.Errorf("--diversity must be between 0 and 1")
+		}
+		if hybridAlpha < 0 || hybridAlpha > 1 {
+			return fmt.Errorf("--alpha must be between 0 and 1")
+		}
+		if distanceFunc(distanceMetric) == nil {
+			return fmt.Errorf("unknown --metric %q (want %s or %s)", distanceMetric, metricCosine, metricL2)
+		}
+		if jsonPretty {
+			jsonOutput = true
+		}
+		commandWritesDB = cmd.Annotations[writesDB] != ""
+		if dbReadOnly && commandWritesDB {
+			return fmt.Errorf("%s modifies the database and can't be used with --db-readonly", cmd.Name())
+		}
+		return nil
+	},
+}
+
+// writesDB annotates commands that modify the database
+const writesDB = "writes-db"
+
+// commandWritesDB is whether the running command has the writesDB
+// annotation
+var commandWritesDB bool
+
+// vecIndexFlat is the only vector index there is: embeddings are compared
+// with the query one by one in Go
+const vecIndexFlat = "flat"
+
+// metaVecIndexType records the vector index a database was created with
+const metaVecIndexType = "vec_index_type"
+
+// openStore opens the --db store, read-only when --db-readonly is set
+func openStore() (*Store, error) {
+	if dbReadOnly {
+		store, err := NewReadOnlyStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := useStoreMetric(store); err != nil {
+			store.Close()
+			return nil, err
+		}
+		if err := checkNormalize(store); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	store, err := NewStore(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordStoreMeta(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	err = useStoreMetric(store)
+	if err == nil {
+		err = checkNormalize(store)
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// recordStoreMeta records the vector index, metric and normalization of a
+// database once, so it keeps the ones it was created with. Only new
+// databases and commands that write get them: a search shouldn't take the
+// write lock to fill in what an older database lacks, and reads fine
+// without.
+func recordStoreMeta(store *Store) error {
+	if !store.Created() && !commandWritesDB {
+		return nil
+	}
+	_, ok, err := store.GetMeta(metaVecIndexType)
+	if err == nil && !ok {
+		err = store.SetMeta(metaVecIndexType, vecIndexFlat)
+	}
+	if err == nil {
+		ok, err = store.HasMetric()
+		if err == nil && !ok {
+			err = store.SetMetric(distanceMetric)
+		}
+	}
+	if err == nil {
+		ok, err = store.HasNormalize()
+		if err == nil && !ok {
+			// Older databases already hold unnormalized embeddings
+			err = store.SetNormalize(normalizeEmbs && store.Dimension() == 0)
+		}
+	}
+	return err
+}
+
+// useStoreMetric makes the database's metric the one results are shown
+// with. Asking for a different one is an error rather than silently
+// mixing thresholds tuned for one metric with another.
+func useStoreMetric(store *Store) error {
+	if rootCmd.PersistentFlags().Changed("metric") && distanceMetric != store.Metric() {
+		return fmt.Errorf("%s uses the %s metric; --metric only applies to new databases (use migrate-db to copy it into one)", dbPath, store.Metric())
+	}
+	distanceMetric = store.Metric()
+	return nil
+}
+
+// checkNormalize refuses --normalize on a database that doesn't normalize,
+// or --normalize=false on one that does, since the stored vectors wouldn't
+// change to match
+func checkNormalize(store *Store) error {
+	if rootCmd.PersistentFlags().Changed("normalize") && normalizeEmbs != store.Normalizes() {
+		if store.Normalizes() {
+			return fmt.Errorf("%s stores normalized embeddings; --normalize only applies to new databases", dbPath)
+		}
+		return fmt.Errorf("%s stores embeddings as the model returns them; --normalize only applies to new databases (use migrate-db --normalize to copy it into one)", dbPath)
+	}
+	return nil
+}
+
+// similarity turns a distance into the percentage shown next to matches:
+// cosine similarity under cosine, and 1/(1+d) under L2, whose distances
+// have no upper bound
+func similarity(dist float64) float64 {
+	if distanceMetric == metricL2 {
+		return 100 / (1 + dist)
+	}
+	return (1.0 - dist) * 100
 }
 
 var uploadCmd = &cobra.Command{
-	Use:   "upload <file>",
-	Short: "Upload a conversation",
-	Args:  cobra.ExactArgs(1),
+	Use:         "upload <file>",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Upload a conversation",
+	Args:        cobra.ExactArgs(1),
+	Long: `Store a conversation and embed its chunks. With - as the file, the
+content is read from stdin, e.g. git log | memctx upload -`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		file := args[0]
+		if onConflict != "skip" && onConflict != "replace" && onConflict != "version" {
+			return fmt.Errorf("unknown --on-conflict %q (want skip, replace or version)", onConflict)
+		}
 
-		content, err := os.ReadFile(file)
+		limit := limitBytes
+		if forceUpload {
+			limit = 0
+		}
+		content, err := readInput(file, limit)
 		if err != nil {
-			return fmt.Errorf("read file: %w", err)
+			return err
 		}
 
 		if len(content) == 0 {
+			if file == "-" {
+				return fmt.Errorf("stdin is empty")
+			}
 			return fmt.Errorf("file is empty")
 		}
 
-		store, err := NewStore(dbPath)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
-		ollama := NewOllama(ollamaURL, "nomic-embed-text")
+		if uploadImage {
+			vision := NewOllama(ollamaURL, visionModel)
+			if err := vision.CheckModel(cmd.Context()); err != nil {
+				return err
+			}
+			progressf("Describing %s with %s\n", file, visionModel)
+			desc, err := describeImage(cmd.Context(), vision, content)
+			if err != nil {
+				return err
+			}
+			content = []byte(desc)
+		}
 
-		id := hashContent(content)
+		text := normalizeText(string(content))
+		id := hashContent([]byte(text))
 		conv := Conversation{
 			ID:        id,
-			Content:   string(content),
+			Content:   text,
 			CreatedAt: time.Now(),
 		}
 
+		exists, err := store.Exists(id)
+		if err != nil {
+			return err
+		}
+		if versionOf != "" {
+			root, err := resolveRoot(store, versionOf)
+			if err != nil {
+				return err
+			}
+			v, err := store.NextVersion(root)
+			if err != nil {
+				return err
+			}
+			conv.ID = versionID(root, v)
+			conv.ParentID = root
+			conv.Version = v
+			id = conv.ID
+		} else if exists {
+			mode := onConflict
+			if forceUpload && !cmd.Flags().Changed("on-conflict") {
+				mode = "replace"
+			}
+			switch mode {
+			case "skip":
+				if err := store.AddTags(id, uploadTags); err != nil {
+					return err
+				}
+				fmt.Printf("%s already uploaded, skipping (use --force to re-embed)\n", id[:8])
+				return nil
+			case "replace":
+				// The chunking may have changed since the last upload
+				if err := store.DeleteChunks(id); err != nil {
+					return err
+				}
+			case "version":
+				v, err := store.NextVersion(id)
+				if err != nil {
+					return err
+				}
+				conv.ID = versionID(id, v)
+				conv.ParentID = id
+				conv.Version = v
+				id = conv.ID
+			}
+		}
+
+		// Nothing is stored until Ollama is known to be able to embed it
+		ollama := NewOllama(ollamaURL, embedModel)
+		if err := ollama.CheckModel(cmd.Context()); err != nil {
+			return err
+		}
+		if err := ensureDimension(cmd.Context(), store, ollama); err != nil {
+			return err
+		}
+
 		if err := store.Save(conv); err != nil {
 			return err
 		}
+		if err := store.AddTags(id, uploadTags); err != nil {
+			return err
+		}
 
 		// Chunk the content and embed each chunk
-		chunks := chunkText(string(content), 800)
-		fmt.Printf("Uploading %s: %d chunks\n", id[:8], len(chunks))
+		chunks, skipped := dropShortChunks(chunkText(text, chunkOpts), minWords)
+		if skipped > 0 {
+			progressf("Skipped %d chunks under %d words\n", skipped, minWords)
+		}
+		if conv.Version > 0 {
+			progressf("Uploading %s as version %d: %d chunks\n", shortID(id), conv.Version, len(chunks))
+		} else {
+			progressf("Uploading %s: %d chunks\n", id[:8], len(chunks))
+		}
+
+		failed, err := embedChunks(cmd.Context(), store, ollama, id, chunks)
+		if err != nil {
+			return err
+		}
+		if chunkReportPath != "" {
+			if err := writeChunkReport(chunkReportPath, id, text, chunks); err != nil {
+				return err
+			}
+		}
+		if timing != nil {
+			timing.Print()
+		}
+
+		if failed > 0 {
+			fmt.Printf("Done: %d chunks embedded, %d failed (run `memctx retry-failed` later)\n", len(chunks)-failed, failed)
+			return nil
+		}
+		fmt.Printf("Done: %d chunks embedded\n", len(chunks))
+		return nil
+	},
+}
+
+// shortID is how conversations are shown: the first 8 characters of the
+// ID, plus the version suffix for later versions
+func shortID(id string) string {
+	base := baseID(id)
+	return base[:min(8, len(base))] + id[len(base):]
+}
+
+// describeImage turns an image into text that can be stored and searched
+// like any other conversation
+func describeImage(ctx context.Context, vision *Ollama, image []byte) (string, error) {
+	prompt := `Describe this image for a searchable notes archive. Transcribe any visible text, code, error messages or commands exactly, then summarize what the image shows in a few sentences. Output only the description.`
+	desc, err := vision.Describe(ctx, prompt, image)
+	if err != nil {
+		return "", fmt.Errorf("describe image: %w", err)
+	}
+	desc = strings.TrimSpace(desc)
+	if desc == "" {
+		return "", fmt.Errorf("describe image: %s returned an empty description", vision.model)
+	}
+	return desc, nil
+}
+
+// resolveID resolves a prefix of a conversation ID, as shown by list, to
+// the full ID. A version suffix picks that version of the matching
+// original. An ambiguous prefix prints the candidates and fails.
+func resolveID(store *Store, prefix string) (string, error) {
+	base := baseID(prefix)
+	ids, err := store.ResolvePrefix(base)
+	if err != nil {
+		return "", err
+	}
+	var roots []string
+	for _, id := range ids {
+		if baseID(id) == id {
+			roots = append(roots, id)
+		}
+	}
+
+	switch {
+	case len(roots) == 0:
+		return "", fmt.Errorf("no conversation matches %q", prefix)
+	case len(roots) > 1:
+		fmt.Printf("%q matches %d conversations:\n", prefix, len(roots))
+		for _, id := range roots {
+			fmt.Printf("  %s\n", id)
+		}
+		return "", fmt.Errorf("ambiguous id prefix %q, give more characters", prefix)
+	}
+
+	id := roots[0] + prefix[len(base):]
+	if id != roots[0] {
+		ok, err := store.Exists(id)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("no conversation matches %q", prefix)
+		}
+	}
+	return id, nil
+}
+
+// resolveRoot resolves an ID prefix to the original conversation of its
+// version history
+func resolveRoot(store *Store, prefix string) (string, error) {
+	id, err := resolveID(store, prefix)
+	if err != nil {
+		return "", err
+	}
+	return baseID(id), nil
+}
+
+// ensureDimension runs checkDimension and, with --auto-reindex, recovers
+// from a mismatch by reindexing every conversation with the current model
+func ensureDimension(ctx context.Context, store *Store, ollama *Ollama) error {
+	err := checkDimension(ctx, store, ollama)
+	if errors.Is(err, errDimensionMismatch) && coerceDims {
+		// The query is fixed up by coerceQueryDim once it's embedded
+		return nil
+	}
+	if !errors.Is(err, errDimensionMismatch) || !autoReindex {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+	if !assumeYes && !confirm("Reindex all conversations with "+ollama.model+"?") {
+		return fmt.Errorf("reindex declined")
+	}
+
+	convs, err := store.List()
+	if err != nil {
+		return err
+	}
+	return reindexAll(ctx, store, ollama, convs)
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
 
-		for i, chunkText := range chunks {
-			chunkID := fmt.Sprintf("%s_%d", id, i)
-			chunk := Chunk{
-				ID:       chunkID,
-				ConvID:   id,
-				Content:  chunkText,
-				Position: i,
+// askThreshold implements --interactive-threshold, asking for a threshold
+// to search again with. An empty answer, or the end of input, accepts the
+// current one.
+func askThreshold(in *bufio.Reader, out io.Writer, current float64) (float64, bool) {
+	for {
+		fmt.Fprintf(out, "Adjust threshold? [current %g, Enter to accept] ", current)
+		line, err := in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			if err != nil {
+				fmt.Fprintln(out)
 			}
+			return current, false
+		}
+		t, perr := strconv.ParseFloat(answer, 64)
+		if perr == nil && t > 0 {
+			return t, true
+		}
+		fmt.Fprintf(out, "%q is not a positive number\n", answer)
+		if err != nil {
+			return current, false
+		}
+	}
+}
+
+var errDimensionMismatch = errors.New("embedding dimension mismatch")
+
+var coerceWarning sync.Once
+
+// coerceQueryDim implements --coerce-dims: a query embedding whose length
+// differs from the index's is truncated or zero-padded to match. The two
+// models' vector spaces are unrelated, so the distances mean little.
+func coerceQueryDim(store *Store, emb []float32) []float32 {
+	dim := store.Dimension()
+	if !coerceDims || dim == 0 || len(emb) == dim {
+		return emb
+	}
+	coerceWarning.Do(func() {
+		how := "zero-padding"
+		if len(emb) > dim {
+			how = "truncating"
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: --coerce-dims: query has %d dims but the index has %d, %s it. Results will be far less accurate than with the original model or a reindex.\n", len(emb), dim, how)
+	})
+	out := make([]float32, dim)
+	copy(out, emb)
+	return out
+}
+
+// warnMixedModels warns when the index holds embeddings from more than one
+// model, or from a model other than the one embedding the query. Models of
+// the same dimension pass the dimension check but their vectors still
+// aren't comparable.
+func warnMixedModels(store *Store, ollama *Ollama) error {
+	models, err := store.EmbedModels()
+	if err != nil {
+		return err
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	if _, ok := models[ollama.model]; ok && len(models) == 1 {
+		return nil
+	}
+
+	names := make([]string, 0, len(models))
+	for m := range models {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, m := range names {
+		parts[i] = fmt.Sprintf("%s (%d)", m, models[m])
+	}
+	fmt.Fprintf(os.Stderr, "warning: stored embeddings come from %s and queries use %s; vectors from different models aren't comparable (run `memctx reindex`)\n", strings.Join(parts, ", "), ollama.model)
+	return nil
+}
+
+// checkDimension fails early when the embedding model's dimension doesn't
+// match the vectors already in the database
+func checkDimension(ctx context.Context, store *Store, ollama *Ollama) error {
+	stored := store.Dimension()
+	if stored == 0 {
+		return nil
+	}
+
+	dim, err := ollama.Dimension(ctx)
+	if err != nil {
+		return err
+	}
+	if dim != stored {
+		return fmt.Errorf("%w: %s produces %d-dim embeddings but the database holds %d-dim ones; pass --embed-model with the model it was indexed with, or reindex", errDimensionMismatch, ollama.model, dim, stored)
+	}
+	return nil
+}
+
+// readInput reads an upload's content from file, or from stdin when file
+// is "-". With a positive limit it never holds more than limit+1 bytes and
+// fails if the input is bigger.
+func readInput(file string, limit int64) ([]byte, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	if limit > 0 && int64(len(content)) > limit {
+		return nil, fmt.Errorf("input is larger than --limit-bytes (%d bytes), use --force to upload it anyway", limit)
+	}
+	return content, nil
+}
 
+// embedBatchSize is how many chunks go to Ollama in one embed request
+const embedBatchSize = 32
+
+// embedChunks saves each chunk of a conversation and embeds them in
+// batches. If a batch fails its chunks are retried one at a time, and a
+// chunk that still fails after embedRetries is recorded in failed_chunks
+// so `retry-failed` can reprocess it while the rest of the ingest carries
+// on. Unless --no-cache is set, an input this model has embedded before
+// reuses the cached vector instead. Returns the number of chunks that
+// failed.
+func embedChunks(ctx context.Context, store *Store, ollama *Ollama, convID string, chunks []string) (int, error) {
+	if err := store.SetEmbedModel(convID, ollama.model); err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for first := 0; first < len(chunks); first += embedBatchSize {
+		batch := chunks[first:min(first+embedBatchSize, len(chunks))]
+
+		writeTimes := make([]time.Duration, len(batch))
+		inputs := make([]string, len(batch))
+		for j, chunkText := range batch {
+			i := first + j
+			start := time.Now()
+			chunk := Chunk{ID: chunkID(convID, i), ConvID: convID, Content: chunkText, Position: i}
 			if err := store.SaveChunk(chunk); err != nil {
-				return fmt.Errorf("save chunk %d: %w", i, err)
+				return failed, fmt.Errorf("save chunk %d: %w", i, err)
+			}
+			writeTimes[j] = time.Since(start)
+			inputs[j] = embedInput(chunkText)
+		}
+
+		embeddings, cached, err := embedCached(ctx, store, ollama, inputs)
+		if ctx.Err() != nil {
+			return failed, fmt.Errorf("interrupted at chunk %d: %w", first, ctx.Err())
+		}
+		if err != nil {
+			return failed, err
+		}
+
+		for j, chunkText := range batch {
+			i := first + j
+			id := chunkID(convID, i)
+
+			embedding := embeddings[j]
+			if embedding == nil {
+				var err error
+				embedding, err = embedWithRetries(ctx, ollama, inputs[j], embedRetries)
+				if ctx.Err() != nil {
+					return failed, fmt.Errorf("interrupted at chunk %d: %w", i, ctx.Err())
+				}
+				if errors.Is(err, errRetryBudget) {
+					return failed, err
+				}
+				if err != nil {
+					f := FailedChunk{
+						ChunkID:  id,
+						ConvID:   convID,
+						Position: i,
+						TextHash: hashContent([]byte(chunkText)),
+						Error:    err.Error(),
+						FailedAt: time.Now(),
+					}
+					if err := store.SaveFailedChunk(f); err != nil {
+						return failed, fmt.Errorf("record failed chunk %d: %w", i, err)
+					}
+					fmt.Printf("  chunk %d: failed after %d attempts: %v\n", i, embedRetries+1, err)
+					failed++
+					continue
+				}
+			}
+
+			start := time.Now()
+			if err := store.SaveChunkEmbedding(id, embedding); err != nil {
+				return failed, fmt.Errorf("save chunk embedding %d: %w", i, err)
+			}
+			if !cached[j] {
+				if err := store.CacheEmbedding(hashContent([]byte(inputs[j])), ollama.model, embedding); err != nil {
+					return failed, err
+				}
+			}
+			if storeRaw {
+				if err := store.SaveRawEmbedding(id, convID, embedding); err != nil {
+					return failed, err
+				}
+			}
+			if err := store.ClearFailedChunk(id); err != nil {
+				return failed, fmt.Errorf("clear failed chunk %d: %w", i, err)
+			}
+			if timing != nil {
+				timing.write.Add(writeTimes[j] + time.Since(start))
 			}
 
-			embedding, err := ollama.Embed(chunkText)
+			if cached[j] {
+				progressf("  chunk %d: %d chars, %d dims (cached)\n", i, len(chunkText), len(embedding))
+			} else {
+				progressf("  chunk %d: %d chars, %d dims\n", i, len(chunkText), len(embedding))
+			}
+		}
+	}
+	return failed, nil
+}
+
+// embedCached embeds inputs in one request, taking the vectors this model
+// made for the same input before from the cache unless --no-cache is set.
+// cached marks the ones that came from the cache. If the request fails,
+// the vectors it should have made are left nil for the caller to retry
+// one at a time.
+func embedCached(ctx context.Context, store *Store, ollama *Ollama, inputs []string) (embeddings [][]float32, cached []bool, err error) {
+	embeddings = make([][]float32, len(inputs))
+	cached = make([]bool, len(inputs))
+	var missing []string
+	for j, in := range inputs {
+		if !noEmbedCache {
+			emb, ok, err := store.CachedEmbedding(hashContent([]byte(in)), ollama.model)
 			if err != nil {
-				return fmt.Errorf("embed chunk %d: %w", i, err)
+				return nil, nil, err
+			}
+			if ok {
+				embeddings[j], cached[j] = emb, true
+				continue
+			}
+		}
+		missing = append(missing, in)
+	}
+	if len(missing) == 0 {
+		return embeddings, cached, nil
+	}
+
+	start := time.Now()
+	fresh, err := ollama.EmbedBatch(ctx, missing)
+	if timing != nil && err == nil {
+		// One sample per chunk, so batched and single embeds compare
+		per := time.Since(start) / time.Duration(len(missing))
+		for range missing {
+			timing.embed.Add(per)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if errors.Is(err, errRetryBudget) {
+		return nil, nil, err
+	}
+	if err == nil {
+		k := 0
+		for j := range embeddings {
+			if !cached[j] {
+				embeddings[j] = fresh[k]
+				k++
 			}
+		}
+	}
+	return embeddings, cached, nil
+}
+
+// embedWithRetries calls Embed up to retries+1 times, backing off a little
+// longer after each failure
+func embedWithRetries(ctx context.Context, o *Ollama, text string, retries int) ([]float32, error) {
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if err := spendRetry(); err != nil {
+				return nil, err
+			}
+			select {
+			case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		start := time.Now()
+		embedding, err := o.Embed(ctx, text)
+		if err == nil {
+			if timing != nil {
+				timing.embed.Add(time.Since(start))
+			}
+			return embedding, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errRetryBudget) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// titleChunk is conv's title as a pseudo-chunk at titlePosition, for
+// --index-titles. ok is false without the flag or a title.
+func titleChunk(conv Conversation) (chunk Chunk, ok bool) {
+	if !indexTitles || strings.TrimSpace(conv.Title) == "" {
+		return Chunk{}, false
+	}
+	return Chunk{ID: chunkID(conv.ID, titlePosition), ConvID: conv.ID, Content: conv.Title, Position: titlePosition}, true
+}
+
+// indexTitle stores and embeds conv's title chunk, if it gets one
+func indexTitle(ctx context.Context, store *Store, ollama *Ollama, conv Conversation) error {
+	chunk, ok := titleChunk(conv)
+	if !ok {
+		return nil
+	}
+	if err := store.SaveChunk(chunk); err != nil {
+		return fmt.Errorf("save title chunk: %w", err)
+	}
+	embedding, err := embedWithRetries(ctx, ollama, chunk.Content, embedRetries)
+	if err != nil {
+		return fmt.Errorf("embed title: %w", err)
+	}
+	return store.SaveChunkEmbedding(chunk.ID, embedding)
+}
+
+// embedInput returns the text that is sent to the embedding model for a
+// chunk. The stored chunk content is never changed.
+func embedInput(text string) string {
+	if cleanCode && looksLikeCode(text) {
+		text = cleanCodeText(text, stripComments)
+	}
+	if maxEmbedChars > 0 && len(text) > maxEmbedChars {
+		fmt.Fprintf(os.Stderr, "warning: chunk of %d bytes truncated to %d for embedding (--max-embed-chars)\n", len(text), maxEmbedChars)
+		text = truncateUTF8(text, maxEmbedChars)
+	}
+	return text
+}
+
+// looksLikeCode guesses whether a chunk is mostly source code: a fenced
+// block, or at least half its lines indented or ending in code punctuation
+func looksLikeCode(text string) bool {
+	if strings.Contains(text, "```") {
+		return true
+	}
+
+	lines, codeLines := 0, 0
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		lines++
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "    ") ||
+			strings.ContainsRune("{};", rune(trimmed[len(trimmed)-1])) {
+			codeLines++
+		}
+	}
+	return lines > 0 && codeLines*2 >= lines
+}
+
+// cleanCodeText collapses indentation and runs of whitespace on each line
+// and drops blank lines. With stripComments it also drops whole-line
+// // and # comments.
+func cleanCodeText(text string, stripComments bool) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if stripComments && (strings.HasPrefix(trimmed, "//") ||
+			(strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(trimmed, "#!"))) {
+			continue
+		}
+		lines = append(lines, strings.Join(strings.Fields(trimmed), " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// chunkOptions controls how chunkText splits content
+type chunkOptions struct {
+	// Size is the target chunk size in chars
+	Size int
+	// SentencesPerUnit is how many sentences stay together when an
+	// oversized paragraph is split into sentences
+	SentencesPerUnit int
+	// Abbreviations don't end a sentence when followed by a period
+	Abbreviations []string
+	// Overlap is how many chars from the end of each chunk are repeated at
+	// the start of the next, so facts on a boundary land whole in one of
+	// them. It must be less than Size.
+	Overlap int
+	// NoTrim keeps each paragraph's whitespace, such as code indentation,
+	// instead of trimming it. Oversized paragraphs are then split between
+	// lines rather than sentences.
+	NoTrim bool
+}
+
+// chunkOpts is the chunking used by every command, set from flags
+var chunkOpts = chunkOptions{Size: 800, SentencesPerUnit: 1, Abbreviations: defaultAbbreviations}
+
+// minWords is the --min-words filter applied by upload, reindex and import
+var minWords int
+
+// dropShortChunks removes chunks with fewer than n words, like a lone
+// "Thanks!", which only add noise to the index. Returns the kept chunks
+// and how many were dropped.
+func dropShortChunks(chunks []string, n int) ([]string, int) {
+	if n <= 0 {
+		return chunks, 0
+	}
+	kept := chunks[:0:0]
+	for _, c := range chunks {
+		if len(strings.Fields(c)) >= n {
+			kept = append(kept, c)
+		}
+	}
+	return kept, len(chunks) - len(kept)
+}
+
+// chunkText splits text into chunks of roughly opts.Size chars
+// splits on paragraph boundaries when possible
+func chunkText(text string, opts chunkOptions) []string {
+	targetSize := opts.Size
+
+	// Trimmed chunks are also stripped of their leading indentation,
+	// untrimmed ones only of blank lines at either end
+	trim := strings.TrimSpace
+	if opts.NoTrim {
+		trim = func(s string) string { return strings.Trim(s, "\r\n") }
+	}
+
+	// Split by double newlines (paragraphs)
+	paragraphs := strings.Split(text, "\n\n")
+
+	var chunks []string
+	var current strings.Builder
+
+	for _, para := range paragraphs {
+		para = trim(para)
+		if strings.TrimSpace(para) == "" {
+			continue
+		}
+
+		// If adding this paragraph exceeds target and we have content, start new chunk
+		if current.Len() > 0 && current.Len()+len(para) > targetSize {
+			chunks = append(chunks, trim(current.String()))
+			current.Reset()
+		}
+
+		// If single paragraph is too big, split it further
+		if len(para) > targetSize*2 {
+			units, sep := groupSentences(splitSentences(para, opts.Abbreviations), opts.SentencesPerUnit), " "
+			if opts.NoTrim {
+				units, sep = untrimmedUnits(para, targetSize, opts.Abbreviations), ""
+			}
+			for _, unit := range units {
+				if current.Len() > 0 && current.Len()+len(unit) > targetSize {
+					chunks = append(chunks, trim(current.String()))
+					current.Reset()
+				}
+				if current.Len() > 0 {
+					current.WriteString(sep)
+				}
+				current.WriteString(unit)
+			}
+		} else {
+			if current.Len() > 0 {
+				current.WriteString("\n\n")
+			}
+			current.WriteString(para)
+		}
+	}
+
+	if current.Len() > 0 {
+		chunks = append(chunks, trim(current.String()))
+	}
+
+	return overlapChunks(chunks, min(opts.Overlap, targetSize))
+}
+
+// overlapChunks prefixes every chunk but the first with up to n chars from
+// the end of the chunk before it, cut at a word boundary
+func overlapChunks(chunks []string, n int) []string {
+	if n <= 0 || len(chunks) < 2 {
+		return chunks
+	}
+
+	out := make([]string, len(chunks))
+	out[0] = chunks[0]
+	for i := 1; i < len(chunks); i++ {
+		prev := chunks[i-1]
+		tail := prev
+		if len(prev) > n {
+			start := len(prev) - n
+			for start < len(prev) && !utf8.RuneStart(prev[start]) {
+				start++
+			}
+			tail = prev[start:]
+			// Don't start mid-word unless the tail is a single word
+			if j := strings.IndexAny(tail, " \n\t"); j >= 0 {
+				tail = tail[j:]
+			}
+		}
+		tail = strings.TrimSpace(tail)
+		if tail == "" {
+			out[i] = chunks[i]
+			continue
+		}
+		out[i] = tail + " " + chunks[i]
+	}
+	return out
+}
+
+// groupSentences joins every n consecutive sentences into one unit so
+// packing never separates them
+func groupSentences(sentences []string, n int) []string {
+	if n <= 1 {
+		return sentences
+	}
+
+	var units []string
+	for i := 0; i < len(sentences); i += n {
+		end := min(i+n, len(sentences))
+		units = append(units, strings.Join(sentences[i:end], " "))
+	}
+	return units
+}
+
+// defaultAbbreviations end in a period without ending a sentence
+var defaultAbbreviations = []string{"Dr", "Mr", "Mrs", "Ms", "Prof", "e.g", "i.e", "etc", "vs", "U.S"}
+
+func splitSentences(text string, abbreviations []string) []string {
+	sentences := cutSentences(text, abbreviations)
+	for i, s := range sentences {
+		sentences[i] = strings.TrimSpace(s)
+	}
+	return sentences
+}
+
+// cutSentences is splitSentences without the trimming: each piece ends
+// at a sentence end, and the whitespace after it starts the next one, so
+// the pieces join back into exactly text
+func cutSentences(text string, abbreviations []string) []string {
+	var sentences []string
+	var current strings.Builder
+
+	for i, r := range text {
+		current.WriteRune(r)
+		// End of sentence
+		if r == '.' || r == '!' || r == '?' {
+			// Only at a word end (followed by space or end), so decimals
+			// like 3.14 never split
+			if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == '\n' {
+				if r == '.' && isAbbreviation(current.String(), abbreviations) {
+					continue
+				}
+				sentences = append(sentences, current.String())
+				current.Reset()
+			}
+		}
+	}
+
+	if current.Len() > 0 {
+		sentences = append(sentences, current.String())
+	}
+
+	return sentences
+}
+
+// untrimmedUnits splits an oversized paragraph for --no-trim: into its
+// lines, whitespace and all, and a line still over size into sentences
+// by cutSentences. The units join back into exactly para.
+func untrimmedUnits(para string, size int, abbreviations []string) []string {
+	var units []string
+	for _, line := range strings.SplitAfter(para, "\n") {
+		if len(line) > size {
+			units = append(units, cutSentences(line, abbreviations)...)
+		} else {
+			units = append(units, line)
+		}
+	}
+	return units
+}
+
+// isAbbreviation reports whether the word before the final period of s is
+// one of the abbreviations, ignoring case and any opening bracket or quote
+func isAbbreviation(s string, abbreviations []string) bool {
+	word := strings.TrimSuffix(s, ".")
+	if i := strings.LastIndexAny(word, " \n\t"); i >= 0 {
+		word = word[i+1:]
+	}
+	word = strings.TrimLeft(word, "(\"'")
+
+	for _, a := range abbreviations {
+		if strings.EqualFold(word, strings.TrimSuffix(a, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultThreshold is the distance cut-off for a match: 0.45 means
+// similarity > 55%, nomic-embed-text tends to give conservative scores
+const defaultThreshold = 0.45
+
+// writePrimeJSON prints a prime result that found nothing, if --json is set
+func writePrimeJSON(result jsonPrime) error {
+	if !jsonOutput {
+		return nil
+	}
+	return writeJSON(result)
+}
+
+// fixed formats a similarity or distance with --precision decimal places,
+// or def places if the flag wasn't given
+func fixed(v float64, def int) string {
+	if precision >= 0 {
+		def = precision
+	}
+	return strconv.FormatFloat(v, 'f', def, 64)
+}
+
+// boilerplateLine matches greetings and assistant pleasantries that make
+// a poor preview, with or without a "User:"/"Assistant:" prefix
+var boilerplateLine = regexp.MustCompile(`(?i)^(\w+:\s*)?(hi|hello|hey|good (morning|afternoon|evening)|thanks|thank you|sure|of course)\b|how (can|may) i (help|assist)`)
+
+// smartPreview returns content starting at its first substantive line,
+// skipping blank lines and boilerplate greetings
+func smartPreview(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || boilerplateLine.MatchString(trimmed) {
+			continue
+		}
+		return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+	}
+	return content
+}
+
+// firstLines returns up to n non-empty lines of content with trailing
+// whitespace removed
+func firstLines(content string, n int) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == n {
+			break
+		}
+	}
+	return lines
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List stored conversations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if previewStrategy != "head" && previewStrategy != "smart" && previewStrategy != "title" {
+			return fmt.Errorf("unknown preview strategy %q (want head, smart or title)", previewStrategy)
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		// Smart previews may skip a few greeting lines, so read further
+		prefix := 61
+		if previewStrategy == "smart" {
+			prefix = 1000
+		}
+		if previewLines > 0 {
+			prefix += previewLines * 200
+		}
+		if listLimit < 0 || listOffset < 0 {
+			return fmt.Errorf("--limit and --offset can't be negative")
+		}
+		convs, err := store.ListPage(prefix, tagFilter, listLimit, listOffset)
+		if err != nil {
+			return err
+		}
+		total, err := store.CountTagged(tagFilter)
+		if err != nil {
+			return err
+		}
+
+		if len(convs) == 0 && !jsonOutput {
+			if total > 0 {
+				fmt.Printf("No conversations past --offset %d (there are %d).\n", listOffset, total)
+				return nil
+			}
+			fmt.Println("No conversations stored.")
+			return nil
+		}
+
+		items := []jsonListItem{}
+		for _, c := range convs {
+			tags, err := store.Tags(c.ID)
+			if err != nil {
+				return err
+			}
+			label := fmt.Sprintf("%s  %s", shortID(c.ID), c.CreatedAt.Format("2006-01-02"))
+			if len(tags) > 0 {
+				label += "  [" + strings.Join(tags, ", ") + "]"
+			}
+
+			preview := c.Content
+			if previewStrategy == "smart" {
+				preview = smartPreview(preview)
+			}
+			if previewLines > 0 && !jsonOutput {
+				if c.Title != "" {
+					label += "  " + c.Title
+				}
+				fmt.Println(label)
+				for _, line := range firstLines(preview, previewLines) {
+					fmt.Printf("    %s\n", line)
+				}
+				if c.Note != "" {
+					fmt.Printf("    %s\n", noteLine(c))
+				}
+				continue
+			}
+			// Imported conversations are best recognized by their title
+			if previewStrategy == "title" && c.Title != "" {
+				preview = c.Title
+			}
+			if len(preview) > 60 {
+				preview = preview[:60] + "..."
+			}
+			preview = strings.ReplaceAll(preview, "\n", " ")
+			if jsonOutput {
+				items = append(items, jsonListItem{ID: c.ID, CreatedAt: c.CreatedAt, Preview: preview, Tags: tags, Note: c.Note})
+				continue
+			}
+			fmt.Printf("%s  %s\n", label, preview)
+			if c.Note != "" {
+				fmt.Printf("    %s\n", noteLine(c))
+			}
+		}
+		if jsonOutput {
+			return writeJSON(items)
+		}
+		if remaining := total - listOffset - len(convs); remaining > 0 {
+			fmt.Printf("\n%d more (--offset %d for the next page, --limit 0 for all)\n", remaining, listOffset+len(convs))
+		}
+		return nil
+	},
+}
+
+var primeCmd = &cobra.Command{
+	Use:   "prime <intent>",
+	Short: "Get synthesized context for a new conversation",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		intent, err := requireQuery(args[0])
+		if err != nil {
+			return err
+		}
+
+		// With --json, progress goes to stderr and stdout holds only the
+		// result
+		var out io.Writer = os.Stdout
+		if jsonOutput {
+			out = os.Stderr
+		}
+		result := jsonPrime{Intent: intent, Matches: []jsonMatch{}}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		embedOllama := NewOllama(ollamaURL, embedModel)
+		if err := embedOllama.CheckModel(cmd.Context()); err != nil {
+			return err
+		}
+		if err := ensureDimension(cmd.Context(), store, embedOllama); err != nil {
+			return err
+		}
+		if err := warnMixedModels(store, embedOllama); err != nil {
+			return err
+		}
+
+		queryEmb, err := embedQuery(cmd.Context(), embedOllama, intent)
+		if err != nil {
+			return fmt.Errorf("embed query: %w", err)
+		}
+		queryEmb = coerceQueryDim(store, queryEmb)
+		if validateDims {
+			if err := store.ValidateQueryDim(queryEmb); err != nil {
+				return err
+			}
+		}
+
+		threshold := distanceThreshold
+		if adaptiveThreshold && !cmd.Flags().Changed("threshold") {
+			threshold, err = learnedThreshold(store, threshold)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Using adaptive threshold %.3f\n", threshold)
+		}
+		var contexts []string
+		var accessed []string
+
+		// retrieve searches with a threshold, printing a summary of the
+		// matches. --interactive-threshold reruns it, reusing queryEmb.
+		retrieve := func(threshold float64) (int, error) {
+			contexts, accessed, result.Matches = nil, nil, []jsonMatch{}
+
+			// Prefer chunk-based search if we have chunks
+			if store.HasChunks() {
+				results, err := searchChunks(store, queryEmb, intent, topK, threshold)
+				if err != nil {
+					return 0, fmt.Errorf("search chunks: %w", err)
+				}
+				if multiQuery > 1 {
+					results, err = multiQuerySearch(cmd.Context(), store, embedOllama, intent, results, topK, threshold)
+					if err != nil {
+						return 0, err
+					}
+				}
+				if len(results) == 0 {
+					fmt.Fprintln(out, "No relevant context found (nothing matched threshold).")
+					return 0, nil
+				}
+
+				fmt.Fprintf(out, "Found %d relevant chunks:\n", len(results))
+				for _, r := range results {
+					similarity := similarity(r.Distance)
+					preview := r.Content
+					if len(preview) > 60 {
+						preview = preview[:60] + "..."
+					}
+					preview = strings.ReplaceAll(preview, "\n", " ")
+					fmt.Fprintf(out, "  %s%% | %s%s\n", fixed(similarity, 0), preview, titleMark(r))
+
+					content := r.Content
+					if includeMetadata || includeNotes {
+						conv, err := store.GetPreview(r.ConvID, 0)
+						if err != nil {
+							return 0, err
+						}
+						content = contextHeader(conv) + content
+					}
+					contexts = append(contexts, content)
+					accessed = append(accessed, r.ConvID)
+					result.Matches = append(result.Matches, newJSONMatch(r))
+				}
+				return len(results), nil
+			}
+
+			// Fallback to whole-doc search
+			results, err := searchDocs(store, queryEmb, docLimit, threshold)
+			if err != nil {
+				return 0, fmt.Errorf("search: %w", err)
+			}
+			if len(results) == 0 {
+				fmt.Fprintln(out, "No relevant context found (nothing matched threshold).")
+				return 0, nil
+			}
+
+			fmt.Fprintf(out, "Found %d relevant conversations:\n", len(results))
+			for _, r := range results {
+				conv, err := store.Get(r.ID)
+				if err != nil {
+					continue
+				}
+				similarity := similarity(r.Distance)
+				preview := conv.Content
+				if len(preview) > 50 {
+					preview = preview[:50] + "..."
+				}
+				preview = strings.ReplaceAll(preview, "\n", " ")
+				fmt.Fprintf(out, "  %s (%s%% match) %s\n", r.ID[:8], fixed(similarity, 0), preview)
+
+				content := conv.Content
+				if len(content) > maxContentBytes {
+					content, err = fitToBudget(cmd.Context(), embedOllama, queryEmb, content, maxContentBytes)
+					if err != nil {
+						return 0, fmt.Errorf("trim %s: %w", r.ID[:8], err)
+					}
+				}
+				content = contextHeader(conv) + content
+				contexts = append(contexts, content)
+				accessed = append(accessed, r.ID)
+				result.Matches = append(result.Matches, jsonMatch{Distance: r.Distance, Similarity: similarity, ConvID: r.ID, Content: content})
+			}
+			return len(results), nil
+		}
+
+		found, err := retrieve(threshold)
+		if err != nil {
+			return err
+		}
+		if interactiveThreshold {
+			in := bufio.NewReader(os.Stdin)
+			for {
+				next, ok := askThreshold(in, out, threshold)
+				if !ok {
+					break
+				}
+				threshold = next
+				if found, err = retrieve(threshold); err != nil {
+					return err
+				}
+			}
+		}
+
+		result.Threshold = threshold
+		if err := recordPrime(store, intent, threshold, found); err != nil {
+			return err
+		}
+		if found == 0 {
+			return writePrimeJSON(result)
+		}
+		if !dbReadOnly {
+			if err := store.MarkAccessed(accessed); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(out)
+
+		if len(contexts) == 0 {
+			fmt.Fprintln(out, "No relevant context found.")
+			return writePrimeJSON(result)
+		}
+
+		if filterIrrelevant {
+			contexts = filterRelevant(cmd.Context(), NewOllama(ollamaURL, scoringModel), intent, contexts, out)
+			if len(contexts) == 0 {
+				fmt.Fprintln(out, "No relevant context found (--filter-irrelevant rejected every match).")
+				return writePrimeJSON(result)
+			}
+		}
+
+		contexts = limitContexts(contexts, synthSources)
+
+		genOllama := NewOllama(ollamaURL, genModel)
+
+		// Embed-only setups still get the retrieved context
+		if !contextOnly {
+			if ok, err := genOllama.HasModel(cmd.Context()); err == nil && !ok {
+				fmt.Fprintf(os.Stderr, "warning: generation model %s not found (run `ollama pull %s`), showing retrieved context only\n", genOllama.model, genOllama.model)
+				contextOnly = true
+			}
+		}
+		if contextOnly {
+			if jsonOutput {
+				result.Context = strings.Join(contexts, "\n\n")
+				return writeJSON(result)
+			}
+			fmt.Fprintln(out, "[Paste this at the start of your conversation]")
+			fmt.Fprintln(out, "────────────────────────────────────────────────────────")
+			fmt.Fprintln(out, strings.Join(contexts, "\n\n"))
+			fmt.Fprintln(out, "────────────────────────────────────────────────────────")
+			return nil
+		}
+
+		// Ctrl-C stops the generation but keeps what was produced so far
+		ctx := cmd.Context()
+		opts := synthOptions{MaxContentBytes: maxContentBytes, MaxTotalChars: maxContextChars, Metadata: includeMetadata, Notes: includeNotes, Lang: synthLang}
+		if kept := len(budgetContexts(contexts, opts)); kept < len(contexts) {
+			fmt.Fprintf(os.Stderr, "--max-context-chars %d: synthesizing the top %d of %d contexts\n", maxContextChars, kept, len(contexts))
+		}
+
+		// On a terminal the context is written as it is generated, with
+		// the token count on stderr just after it; otherwise it is printed
+		// once complete, the count having had a line of its own
+		live := !jsonOutput && isTerminal(os.Stdout)
+		var fw *fenceWriter
+		var counter *tokenCounter
+		if live {
+			fmt.Fprintln(out, "[Paste this at the start of your conversation]")
+			fmt.Fprintln(out, "────────────────────────────────────────────────────────")
+			fw = &fenceWriter{w: out}
+			if keepFences {
+				fw.state = fenceNone
+			}
+			counter = newTokenCounter(os.Stderr, fw)
+		} else {
+			counter = newTokenCounter(os.Stderr, nil)
+		}
+		synthesized, err := synthesize(ctx, genOllama, intent, contexts, opts, counter)
+		interrupted := ctx.Err() != nil
+		counter.Done()
+		if live {
+			if err := fw.Close(); err != nil {
+				return err
+			}
+			if !fw.newline {
+				fmt.Fprintln(out)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("synthesize: %w", err)
+		}
+
+		if !live && !keepFences {
+			synthesized = stripWrappingFence(synthesized)
+		}
+		if jsonOutput {
+			result.Context = synthesized
+			result.Synthesized = true
+			result.Interrupted = interrupted
+			return writeJSON(result)
+		}
+		if !live {
+			fmt.Fprintln(out, "[Paste this at the start of your conversation]")
+			fmt.Fprintln(out, "────────────────────────────────────────────────────────")
+			fmt.Fprintln(out, synthesized)
+		}
+		if interrupted {
+			fmt.Fprintln(out, "[interrupted: partial output]")
+		}
+		fmt.Fprintln(out, "────────────────────────────────────────────────────────")
+		return nil
+	},
+}
+
+// requireQuery trims a query and rejects it if nothing is left, since an
+// empty string still embeds to a vector and matches arbitrary content
+func requireQuery(q string) (string, error) {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return "", fmt.Errorf("query is empty")
+	}
+	return q, nil
+}
+
+// searchChunks is store.SearchChunks with a --warn-slow-query check,
+// limited to --tag. With --hybrid and a non-empty text it is
+// store.SearchHybrid instead. With --diversity it retrieves more
+// candidates and keeps limit of them by MMR.
+func searchChunks(store *Store, query []float32, text string, limit int, threshold float64) ([]SearchResult, error) {
+	start := time.Now()
+	pool := limit
+	if diversity > 0 {
+		pool = limit * mmrPoolFactor
+	}
+	var results []SearchResult
+	var err error
+	if hybridSearch && text != "" {
+		results, err = store.SearchHybrid(query, text, pool, threshold, hybridAlpha, tagFilter)
+	} else {
+		results, err = store.SearchChunks(query, pool, threshold, tagFilter)
+	}
+	if err == nil && diversity > 0 {
+		results, err = diversify(store, results, limit)
+	}
+	elapsed := time.Since(start)
+	verbosef("chunk search: %d matches in %s\n", len(results), elapsed.Round(time.Millisecond))
+	warnIfSlow(store, elapsed)
+	return results, err
+}
+
+// diversify implements --diversity on retrieved chunks
+func diversify(store *Store, results []SearchResult, limit int) ([]SearchResult, error) {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	embs, err := store.GetChunkEmbeddings(ids)
+	if err != nil {
+		return nil, err
+	}
+	return rerankMMR(results, embs, store.distance, limit, diversity), nil
+}
+
+// searchDocs is store.Search with a --warn-slow-query check, limited to
+// --tag
+func searchDocs(store *Store, query []float32, limit int, threshold float64) ([]SearchResult, error) {
+	start := time.Now()
+	results, err := store.Search(query, limit, threshold, tagFilter)
+	elapsed := time.Since(start)
+	verbosef("whole-doc search: %d matches in %s\n", len(results), elapsed.Round(time.Millisecond))
+	warnIfSlow(store, elapsed)
+	return results, err
+}
+
+// warnIfSlow tells the user when a search took longer than
+// --warn-slow-query. Search scans every embedding, so it grows with the
+// index.
+func warnIfSlow(store *Store, elapsed time.Duration) {
+	if warnSlowQuery <= 0 || elapsed <= warnSlowQuery {
+		return
+	}
+	n, err := store.CountChunkEmbeddings()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "warning: search took %s over %d embedded chunks; every search scans them all, so consider `memctx forget` to shrink the index\n", elapsed.Round(time.Millisecond), n)
+}
+
+// embedQuery embeds a search query. With --expand, the generation model
+// first rewrites it into a richer paraphrase, which is what gets embedded.
+func embedQuery(ctx context.Context, o *Ollama, query string) ([]float32, error) {
+	if expandQueries {
+		expanded, err := expandQuery(ctx, NewOllama(ollamaURL, genModel), query)
+		if err != nil {
+			return nil, fmt.Errorf("expand query: %w", err)
+		}
+		verbosef("expanded query: %s\n", expanded)
+		query = expanded
+	}
+	return o.Embed(ctx, query)
+}
+
+// multiQuerySearch asks the generation model for alternative phrasings of
+// the query, searches with each, and fuses them with the original results
+func multiQuerySearch(ctx context.Context, store *Store, embed *Ollama, query string, results []SearchResult, limit int, threshold float64) ([]SearchResult, error) {
+	variants, err := queryVariants(ctx, NewOllama(ollamaURL, genModel), query, multiQuery-1)
+	if err != nil {
+		return nil, fmt.Errorf("query variants: %w", err)
+	}
+
+	lists := [][]SearchResult{results}
+	for _, v := range variants {
+		verbosef("query variant: %s\n", v)
+		emb, err := embed.Embed(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("embed variant: %w", err)
+		}
+		r, err := searchChunks(store, coerceQueryDim(store, emb), v, limit, threshold)
+		if err != nil {
+			return nil, fmt.Errorf("search chunks: %w", err)
+		}
+		lists = append(lists, r)
+	}
+
+	fused := fuseRRF(lists...)
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	return fused, nil
+}
+
+// queryVariants asks for n alternative phrasings of a query, one per line
+func queryVariants(ctx context.Context, o *Ollama, query string, n int) ([]string, error) {
+	prompt := fmt.Sprintf(`Write %d different search queries that would find information relevant to the query below. Vary the wording and angle, one query per line, no numbering or commentary.
+
+Query: %s`, n, query)
+
+	out, err := o.Generate(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(line, "-*0123456789.) "))
+		if line == "" || strings.EqualFold(line, query) {
+			continue
+		}
+		variants = append(variants, line)
+		if len(variants) == n {
+			break
+		}
+	}
+	return variants, nil
+}
+
+// filterRelevant drops contexts the model judges irrelevant to the intent.
+// A context the model can't judge is kept, the filter only ever removes
+// what it is sure about. Each drop is reported on out.
+func filterRelevant(ctx context.Context, o *Ollama, intent string, contexts []string, out io.Writer) []string {
+	var kept []string
+	for i, c := range contexts {
+		prompt := fmt.Sprintf(`Is the excerpt below relevant to the intent? Answer yes or no only.
+
+Intent: %s
+
+Excerpt:
+%s`, intent, c)
+		answer, err := o.Generate(ctx, prompt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: relevance check for context %d failed, keeping it: %v\n", i+1, err)
+			kept = append(kept, c)
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "no") {
+			fmt.Fprintf(out, "Dropped context %d as irrelevant\n", i+1)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+func expandQuery(ctx context.Context, o *Ollama, query string) (string, error) {
+	prompt := fmt.Sprintf(`Rewrite this search query as a richer paraphrase that spells out what the user is likely looking for. Keep it to one or two sentences and add related terms, but don't invent specifics.
+
+Query: %s
+
+Output only the rewritten query.`, query)
+
+	expanded, err := o.Generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	expanded = strings.TrimSpace(expanded)
+	if expanded == "" {
+		return query, nil
+	}
+	return expanded, nil
+}
+
+// limitContexts drops duplicate contexts and keeps at most n of the rest,
+// in ranked order. n <= 0 means no limit.
+func limitContexts(contexts []string, n int) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, c := range contexts {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		out = append(out, c)
+		if len(out) == n {
+			break
+		}
+	}
+	return out
+}
+
+// fitToBudget shrinks an oversized document to at most budget bytes by
+// chunking it and keeping the chunks closest to the query, in their
+// original order
+func fitToBudget(ctx context.Context, o *Ollama, query []float32, content string, budget int) (string, error) {
+	chunks := chunkText(content, chunkOpts)
+	if len(chunks) == 0 {
+		return "", nil
+	}
+
+	type scored struct {
+		pos  int
+		dist float64
+	}
+	ranked := make([]scored, len(chunks))
+	for i, c := range chunks {
+		emb, err := o.Embed(ctx, c)
+		if err != nil {
+			return "", fmt.Errorf("embed chunk %d: %w", i, err)
+		}
+		ranked[i] = scored{pos: i, dist: distanceFunc(distanceMetric)(query, emb)}
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].dist < ranked[j].dist })
+
+	keep := make([]bool, len(chunks))
+	used := 0
+	for _, r := range ranked {
+		if used+len(chunks[r.pos]) > budget {
+			continue
+		}
+		keep[r.pos] = true
+		used += len(chunks[r.pos]) + 2
+	}
+
+	var parts []string
+	for i, c := range chunks {
+		if keep[i] {
+			parts = append(parts, c)
+		}
+	}
+	if len(parts) == 0 {
+		// Even the best chunk is over budget, joinContexts will cut it
+		return chunks[ranked[0].pos], nil
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// synthOptions tunes the synthesis prompt
+type synthOptions struct {
+	// MaxContentBytes caps each context
+	MaxContentBytes int
+	// MaxTotalChars caps all contexts together, see budgetContexts
+	MaxTotalChars int
+	// Metadata means each context starts with a sourceHeader line
+	Metadata bool
+	// Notes means a context may start with a noteLine
+	Notes bool
+	// Lang is the language to write in, empty for the intent's language
+	Lang string
+}
+
+func synthesize(ctx context.Context, o *Ollama, intent string, contexts []string, opts synthOptions, w io.Writer) (string, error) {
+	return o.GenerateStream(ctx, synthesisPrompt(intent, contexts, opts), w)
+}
+
+func synthesisPrompt(intent string, contexts []string, opts synthOptions) string {
+	rules := []string{
+		"Output 3-7 bullet points maximum",
+		"Each bullet should be a concrete fact, decision, or preference",
+		"No fluff, no explanations",
+		`If nothing relevant, say "No relevant prior context"`,
+	}
+	if opts.Metadata {
+		rules = append(rules, "Each excerpt starts with a [source: id, date] line; when excerpts conflict, prefer the more recent one")
+	}
+	if opts.Notes {
+		rules = append(rules, "A [note: ...] line before an excerpt is the user's own comment on it, e.g. that it is outdated; let it decide how the excerpt is used, but don't quote it")
+	}
+	if opts.Lang != "" {
+		rules = append(rules, fmt.Sprintf("Write the bullet points in %s, whatever language the excerpts are in; keep code, commands and names as they are", opts.Lang))
+	} else {
+		rules = append(rules, "Write in the language of the user's intent")
+	}
+
+	return fmt.Sprintf(`You are a context synthesizer. Given past conversation excerpts and a user's current intent, extract ONLY the relevant facts.
+
+Rules:
+- %s
+
+User's intent: %s
+
+Past conversations:
+---
+%s
+---
+
+Relevant context (bullet points only):`, strings.Join(rules, "\n- "), intent, joinContexts(budgetContexts(contexts, opts), opts.MaxContentBytes))
+}
+
+// budgetContexts returns the ranked contexts that fit in
+// opts.MaxTotalChars once each is cut to opts.MaxContentBytes, counting
+// joinContexts' labels too. Whole contexts are dropped from the end, so
+// the lowest-ranked go first; only a first context that alone is over
+// budget is cut, so there is always something to synthesize.
+func budgetContexts(contexts []string, opts synthOptions) []string {
+	if opts.MaxTotalChars <= 0 {
+		return contexts
+	}
+	var kept []string
+	used := 0
+	for i, c := range contexts {
+		cut := c
+		if len(cut) > opts.MaxContentBytes {
+			cut = truncateUTF8(cut, opts.MaxContentBytes) + "...[truncated]"
+		}
+		label := len(fmt.Sprintf("[Conversation %d]\n\n\n", i+1))
+		if used+label+len(cut) > opts.MaxTotalChars {
+			if i == 0 {
+				kept = append(kept, truncateUTF8(c, min(max(opts.MaxTotalChars-label, 0), opts.MaxContentBytes)))
+			}
+			break
+		}
+		kept = append(kept, c)
+		used += label + len(cut)
+	}
+	return kept
+}
+
+// contextHeader is what --context-include-metadata and
+// --context-include-notes put before a conversation's context
+func contextHeader(c Conversation) string {
+	var header string
+	if includeMetadata {
+		header += sourceHeader(c) + "\n"
+	}
+	if includeNotes && c.Note != "" {
+		header += noteLine(c) + "\n"
+	}
+	return header
+}
+
+func noteLine(c Conversation) string {
+	return "[note: " + c.Note + "]"
+}
+
+// sourceHeader describes where a context came from, for --context-include-metadata
+func sourceHeader(c Conversation) string {
+	if c.Title != "" {
+		return fmt.Sprintf("[source: %s, %s, %q]", c.ID[:8], c.CreatedAt.Format("2006-01-02"), c.Title)
+	}
+	return fmt.Sprintf("[source: %s, %s]", c.ID[:8], c.CreatedAt.Format("2006-01-02"))
+}
+
+// stripWrappingFence removes a markdown code fence that wraps the whole
+// output. Fences that only cover part of it are left alone.
+func stripWrappingFence(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) < 2 {
+		return s
+	}
+
+	first := strings.TrimSpace(lines[0])
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(first, "```") || last != "```" {
+		return s
+	}
+	// Any fence in between means the first and last lines belong to
+	// different blocks
+	for _, line := range lines[1 : len(lines)-1] {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			return s
+		}
+	}
+	return strings.Join(lines[1:len(lines)-1], "\n")
+}
+
+// fenceWriter is stripWrappingFence for a stream: an opening fence line is
+// dropped, and inside a fence the last line is held back until more
+// arrives, so a closing fence can be dropped by Close. Unlike
+// stripWrappingFence it can't wait to see the closing fence, so the opening
+// one is dropped even if the block is never closed.
+type fenceWriter struct {
+	w       io.Writer
+	state   fenceState
+	pending string // received but not yet written
+	// newline is whether the last byte written was a newline
+	newline bool
+}
+
+type fenceState int
+
+const (
+	fenceUnknown fenceState = iota // nothing but whitespace seen yet
+	fenceNone                      // not fenced, pass everything through
+	fenceOpening                   // inside the opening fence line
+	fenceBody                      // inside the fenced block
+)
 
-			if err := store.SaveChunkEmbedding(chunkID, embedding); err != nil {
-				return fmt.Errorf("save chunk embedding %d: %w", i, err)
-			}
+func (f *fenceWriter) Write(p []byte) (int, error) {
+	f.pending += string(p)
+	if f.state == fenceUnknown {
+		head := strings.TrimLeft(f.pending, " \t\r\n")
+		if len(head) < 3 && strings.HasPrefix("```", head) {
+			return len(p), nil
+		}
+		f.state = fenceNone
+		if strings.HasPrefix(head, "```") {
+			f.state = fenceOpening
+			f.pending = head
+		}
+	}
+	if f.state == fenceOpening {
+		i := strings.IndexByte(f.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		f.pending = f.pending[i+1:]
+		f.state = fenceBody
+	}
+
+	n := len(f.pending)
+	if f.state == fenceBody {
+		// Keep the last non-blank line and anything after it
+		n = strings.LastIndexByte(strings.TrimRight(f.pending, " \t\r\n"), '\n') + 1
+	}
+	return len(p), f.flush(n)
+}
 
-			fmt.Printf("  chunk %d: %d chars, %d dims\n", i, len(chunkText), len(embedding))
+// Close writes what was held back, minus a closing fence
+func (f *fenceWriter) Close() error {
+	switch f.state {
+	case fenceOpening:
+		f.pending = ""
+	case fenceBody:
+		rest := strings.TrimRight(f.pending, " \t\r\n")
+		i := strings.LastIndexByte(rest, '\n')
+		if strings.TrimSpace(rest[i+1:]) == "```" {
+			f.pending = rest[:i+1]
 		}
+	}
+	return f.flush(len(f.pending))
+}
 
-		fmt.Printf("Done: %d chunks embedded\n", len(chunks))
+// flush writes the first n bytes of pending
+func (f *fenceWriter) flush(n int) error {
+	if n == 0 {
 		return nil
-	},
+	}
+	out := f.pending[:n]
+	f.pending = f.pending[n:]
+	f.newline = out[len(out)-1] == '\n'
+	_, err := io.WriteString(f.w, out)
+	return err
 }
 
-// chunkText splits text into chunks of roughly targetSize chars
-// splits on paragraph boundaries when possible
-func chunkText(text string, targetSize int) []string {
-	// Split by double newlines (paragraphs)
-	paragraphs := strings.Split(text, "\n\n")
-
-	var chunks []string
-	var current strings.Builder
+// isTerminal reports whether f is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-	for _, para := range paragraphs {
-		para = strings.TrimSpace(para)
-		if para == "" {
-			continue
-		}
+// tokenCounter shows a live count of streamed tokens on a terminal.
+// Ollama sends roughly one token per stream chunk. With next set the
+// stream goes on to next, which prints to the same terminal, so the count
+// is shown just after the text and wiped before each chunk is written;
+// without, the count has its line to itself.
+type tokenCounter struct {
+	w     io.Writer
+	tty   bool
+	next  io.Writer
+	count int
+	// shown is the length of the count printed after next's text
+	shown int
+}
 
-		// If adding this paragraph exceeds target and we have content, start new chunk
-		if current.Len() > 0 && current.Len()+len(para) > targetSize {
-			chunks = append(chunks, strings.TrimSpace(current.String()))
-			current.Reset()
-		}
+func newTokenCounter(w *os.File, next io.Writer) *tokenCounter {
+	return &tokenCounter{w: w, tty: isTerminal(w), next: next}
+}
 
-		// If single paragraph is too big, split it further
-		if len(para) > targetSize*2 {
-			sentences := splitSentences(para)
-			for _, sent := range sentences {
-				if current.Len() > 0 && current.Len()+len(sent) > targetSize {
-					chunks = append(chunks, strings.TrimSpace(current.String()))
-					current.Reset()
-				}
-				if current.Len() > 0 {
-					current.WriteString(" ")
-				}
-				current.WriteString(sent)
-			}
-		} else {
-			if current.Len() > 0 {
-				current.WriteString("\n\n")
-			}
-			current.WriteString(para)
+func (t *tokenCounter) Write(p []byte) (int, error) {
+	t.count++
+	if t.next == nil {
+		if t.tty {
+			fmt.Fprintf(t.w, "\rSynthesizing... %d tokens", t.count)
 		}
+		return len(p), nil
 	}
 
-	if current.Len() > 0 {
-		chunks = append(chunks, strings.TrimSpace(current.String()))
+	t.wipe()
+	n, err := t.next.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if t.tty {
+		status := fmt.Sprintf(" [%d tokens]", t.count)
+		fmt.Fprint(t.w, status)
+		t.shown = len(status)
 	}
+	return n, nil
+}
 
-	return chunks
+// wipe moves back over the count shown after the text and clears it
+func (t *tokenCounter) wipe() {
+	if t.shown > 0 {
+		fmt.Fprintf(t.w, "\x1b[%dD\x1b[K", t.shown)
+		t.shown = 0
+	}
 }
 
-func splitSentences(text string) []string {
-	var sentences []string
-	var current strings.Builder
+// Done clears the live counter
+func (t *tokenCounter) Done() {
+	if t.next != nil {
+		t.wipe()
+		return
+	}
+	if t.tty && t.count > 0 {
+		fmt.Fprintf(t.w, "\r%s\r", strings.Repeat(" ", 40))
+	}
+}
 
-	for i, r := range text {
-		current.WriteRune(r)
-		// End of sentence
-		if r == '.' || r == '!' || r == '?' {
-			// Check not abbreviation (followed by space or end)
-			if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == '\n' {
-				sentences = append(sentences, strings.TrimSpace(current.String()))
-				current.Reset()
-			}
+// joinContexts formats contexts for the synthesis prompt, cutting each one
+// to at most maxBytes without splitting a multibyte rune
+func joinContexts(contexts []string, maxBytes int) string {
+	result := ""
+	for i, c := range contexts {
+		if len(c) > maxBytes {
+			c = truncateUTF8(c, maxBytes) + "...[truncated]"
 		}
+		result += fmt.Sprintf("[Conversation %d]\n%s\n\n", i+1, c)
 	}
+	return result
+}
 
-	if current.Len() > 0 {
-		sentences = append(sentences, strings.TrimSpace(current.String()))
+// truncateUTF8 returns the longest prefix of s that is at most n bytes
+// and ends on a rune boundary
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
 	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
 
-	return sentences
+// normalizeText puts content in Unicode NFC, so text that only differs in
+// how characters are composed hashes and embeds the same
+func normalizeText(s string) string {
+	if noUnicodeNormalize {
+		return s
+	}
+	return norm.NFC.String(s)
 }
 
-var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List stored conversations",
+func hashContent(content []byte) string {
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
+
+var reindexCmd = &cobra.Command{
+	Use:         "reindex",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Re-chunk and re-embed all conversations",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := NewStore(dbPath)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
@@ -192,160 +2252,263 @@ var listCmd = &cobra.Command{
 		}
 
 		if len(convs) == 0 {
-			fmt.Println("No conversations stored.")
+			fmt.Println("No conversations to reindex.")
 			return nil
 		}
 
-		for _, c := range convs {
-			preview := c.Content
-			if len(preview) > 60 {
-				preview = preview[:60] + "..."
-			}
-			preview = strings.ReplaceAll(preview, "\n", " ")
-			fmt.Printf("%s  %s  %s\n", c.ID[:8], c.CreatedAt.Format("2006-01-02"), preview)
+		ollama := NewOllama(ollamaURL, embedModel)
+		if err := ollama.CheckModel(cmd.Context()); err != nil {
+			return err
 		}
-		return nil
+		return reindexAll(cmd.Context(), store, ollama, convs)
 	},
 }
 
-var primeCmd = &cobra.Command{
-	Use:   "prime <intent>",
-	Short: "Get synthesized context for a new conversation",
-	Args:  cobra.ExactArgs(1),
-	RunE: func(cmd *cobra.Command, args []string) error {
-		intent := args[0]
+// reindexAll re-chunks and re-embeds the given conversations, dropping
+// any whole-conversation embeddings left from before chunking
+func reindexAll(ctx context.Context, store *Store, ollama *Ollama, convs []Conversation) error {
+	// Every embedding is about to be replaced, possibly with a different
+	// dimension
+	if err := store.ResetDimension(); err != nil {
+		return err
+	}
+	if err := store.ClearConversationEmbeddings(); err != nil {
+		return err
+	}
+
+	totalFailed := 0
+	for _, conv := range convs {
+		if err := store.DeleteChunks(conv.ID); err != nil {
+			return err
+		}
+		chunks, skipped := dropShortChunks(chunkText(conv.Content, chunkOpts), minWords)
+		progressf("Reindexing %s: %d chunks\n", conv.ID[:8], len(chunks))
+		if skipped > 0 {
+			progressf("  skipped %d chunks under %d words\n", skipped, minWords)
+		}
+
+		failed, err := embedChunks(ctx, store, ollama, conv.ID, chunks)
+		if err != nil {
+			return err
+		}
+		if err := indexTitle(ctx, store, ollama, conv); err != nil {
+			return fmt.Errorf("%s: %w", conv.ID[:8], err)
+		}
+		totalFailed += failed
+	}
+	if timing != nil {
+		timing.Print()
+	}
+
+	if totalFailed > 0 {
+		fmt.Printf("Done reindexing, %d chunks failed (run `memctx retry-failed` later).\n", totalFailed)
+		return nil
+	}
+	fmt.Println("Done reindexing.")
+	return nil
+}
 
-		store, err := NewStore(dbPath)
+var retryFailedCmd = &cobra.Command{
+	Use:         "retry-failed",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Re-embed chunks that failed during upload or reindex",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
-		embedOllama := NewOllama(ollamaURL, "nomic-embed-text")
-		queryEmb, err := embedOllama.Embed(intent)
+		failed, err := store.ListFailedChunks()
 		if err != nil {
-			return fmt.Errorf("embed query: %w", err)
+			return err
 		}
 
-		// Distance threshold: 0.45 means similarity > 55%
-		// nomic-embed-text tends to give conservative scores
-		threshold := 0.45
-		var contexts []string
+		if len(failed) == 0 {
+			fmt.Println("No failed chunks.")
+			return nil
+		}
 
-		// Prefer chunk-based search if we have chunks
-		if store.HasChunks() {
-			results, err := store.SearchChunks(queryEmb, 10, threshold)
+		ollama := NewOllama(ollamaURL, embedModel)
+
+		fixed := 0
+		for _, f := range failed {
+			chunk, err := store.GetChunk(f.ChunkID)
+			if errors.Is(err, sql.ErrNoRows) {
+				// Chunk was replaced by a later reindex, nothing left to retry
+				if err := store.ClearFailedChunk(f.ChunkID); err != nil {
+					return err
+				}
+				progressf("  %s chunk %d: gone, cleared\n", f.ConvID[:8], f.Position)
+				continue
+			}
 			if err != nil {
-				return fmt.Errorf("search chunks: %w", err)
+				return err
 			}
 
-			if len(results) == 0 {
-				fmt.Println("No relevant context found (nothing matched threshold).")
-				return nil
+			embedding, err := embedWithRetries(cmd.Context(), ollama, embedInput(chunk.Content), embedRetries)
+			if cmd.Context().Err() != nil {
+				return cmd.Context().Err()
 			}
-
-			fmt.Printf("Found %d relevant chunks:\n", len(results))
-			for _, r := range results {
-				similarity := (1.0 - r.Distance) * 100
-				preview := r.Content
-				if len(preview) > 60 {
-					preview = preview[:60] + "..."
-				}
-				preview = strings.ReplaceAll(preview, "\n", " ")
-				fmt.Printf("  %.0f%% | %s\n", similarity, preview)
-				contexts = append(contexts, r.Content)
+			if errors.Is(err, errRetryBudget) {
+				return err
 			}
-		} else {
-			// Fallback to whole-doc search
-			results, err := store.Search(queryEmb, 5, threshold)
 			if err != nil {
-				return fmt.Errorf("search: %w", err)
+				f.Error = err.Error()
+				f.TextHash = hashContent([]byte(chunk.Content))
+				f.FailedAt = time.Now()
+				if err := store.SaveFailedChunk(f); err != nil {
+					return err
+				}
+				fmt.Printf("  %s chunk %d: still failing: %v\n", f.ConvID[:8], f.Position, err)
+				continue
 			}
 
-			if len(results) == 0 {
-				fmt.Println("No relevant context found (nothing matched threshold).")
-				return nil
+			if err := store.SaveChunkEmbedding(chunk.ID, embedding); err != nil {
+				return fmt.Errorf("save chunk embedding: %w", err)
+			}
+			if err := store.ClearFailedChunk(chunk.ID); err != nil {
+				return err
 			}
+			progressf("  %s chunk %d: embedded\n", f.ConvID[:8], f.Position)
+			fixed++
+		}
 
-			fmt.Printf("Found %d relevant conversations:\n", len(results))
-			for _, r := range results {
-				conv, err := store.Get(r.ID)
+		fmt.Printf("Done: %d of %d failed chunks embedded\n", fixed, len(failed))
+		return nil
+	},
+}
+
+var rankCmd = &cobra.Command{
+	Use:   "rank --query <text> --doc <file>...",
+	Short: "Rank ad-hoc documents against a query without storing them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		query, err := requireQuery(rankQuery)
+		if err != nil {
+			return err
+		}
+
+		ollama := NewOllama(ollamaURL, embedModel)
+		queryEmb, err := ollama.Embed(cmd.Context(), query)
+		if err != nil {
+			return fmt.Errorf("embed query: %w", err)
+		}
+
+		type ranked struct {
+			file     string
+			best     string
+			distance float64
+		}
+
+		// A document scores as its best-matching chunk, same as prime
+		var results []ranked
+		for _, file := range rankDocs {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("read file: %w", err)
+			}
+
+			r := ranked{file: file, distance: math.Inf(1)}
+			for i, chunk := range chunkText(string(content), chunkOpts) {
+				emb, err := ollama.Embed(cmd.Context(), chunk)
 				if err != nil {
-					continue
+					return fmt.Errorf("embed %s chunk %d: %w", file, i, err)
 				}
-				similarity := (1.0 - r.Distance) * 100
-				preview := conv.Content
-				if len(preview) > 50 {
-					preview = preview[:50] + "..."
+				if dist := distanceFunc(distanceMetric)(queryEmb, emb); dist < r.distance {
+					r.distance = dist
+					r.best = chunk
 				}
-				preview = strings.ReplaceAll(preview, "\n", " ")
-				fmt.Printf("  %s (%.0f%% match) %s\n", r.ID[:8], similarity, preview)
-				contexts = append(contexts, conv.Content)
 			}
+			results = append(results, r)
 		}
-		fmt.Println()
 
-		if len(contexts) == 0 {
-			fmt.Println("No relevant context found.")
-			return nil
-		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].distance < results[j].distance })
 
-		genOllama := NewOllama(ollamaURL, "llama3.2")
-		synthesized, err := synthesize(genOllama, intent, contexts)
-		if err != nil {
-			return fmt.Errorf("synthesize: %w", err)
+		for _, r := range results {
+			similarity := similarity(r.distance)
+			preview := r.best
+			if len(preview) > 50 {
+				preview = preview[:50] + "..."
+			}
+			preview = strings.ReplaceAll(preview, "\n", " ")
+			fmt.Printf("  %s%% | %s | %s\n", fixed(similarity, 0), r.file, preview)
 		}
-
-		fmt.Println("[Paste this at the start of your conversation]")
-		fmt.Println("────────────────────────────────────────────────────────")
-		fmt.Println(synthesized)
-		fmt.Println("────────────────────────────────────────────────────────")
 		return nil
 	},
 }
 
-func synthesize(o *Ollama, intent string, contexts []string) (string, error) {
-	prompt := fmt.Sprintf(`You are a context synthesizer. Given past conversation excerpts and a user's current intent, extract ONLY the relevant facts.
+var forgetCmd = &cobra.Command{
+	Use:         "forget --unused-for <age>",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Remove conversations no search has returned recently",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		age, err := parseAge(unusedFor)
+		if err != nil {
+			return err
+		}
 
-Rules:
-- Output 3-7 bullet points maximum
-- Each bullet should be a concrete fact, decision, or preference
-- No fluff, no explanations
-- If nothing relevant, say "No relevant prior context"
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
 
-User's intent: %s
+		stale, err := store.ListUnusedSince(time.Now().Add(-age))
+		if err != nil {
+			return err
+		}
 
-Past conversations:
----
-%s
----
+		if len(stale) == 0 {
+			fmt.Println("Nothing to forget.")
+			return nil
+		}
 
-Relevant context (bullet points only):`, intent, joinContexts(contexts))
+		for _, c := range stale {
+			preview := c.Content
+			if len(preview) > 60 {
+				preview = preview[:60] + "..."
+			}
+			preview = strings.ReplaceAll(preview, "\n", " ")
+			fmt.Printf("%s  %s  %s\n", c.ID[:8], c.CreatedAt.Format("2006-01-02"), preview)
+		}
 
-	return o.Generate(prompt)
+		if !assumeYes {
+			fmt.Printf("%d conversations would be forgotten, rerun with --yes to delete them.\n", len(stale))
+			return nil
+		}
+		ids := make([]string, len(stale))
+		for i, c := range stale {
+			ids[i] = c.ID
+		}
+		if err := store.DeleteConversations(ids); err != nil {
+			return err
+		}
+		fmt.Printf("Forgot %d conversations.\n", len(stale))
+		return nil
+	},
 }
 
-func joinContexts(contexts []string) string {
-	result := ""
-	for i, c := range contexts {
-		if len(c) > 2000 {
-			c = c[:2000] + "..."
+// parseAge parses a duration that may also be given in days, like "180d"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
 		}
-		result += fmt.Sprintf("[Conversation %d]\n%s\n\n", i+1, c)
+		return time.Duration(n) * 24 * time.Hour, nil
 	}
-	return result
-}
-
-func hashContent(content []byte) string {
-	h := sha256.Sum256(content)
-	return hex.EncodeToString(h[:])
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
 }
 
-var reindexCmd = &cobra.Command{
-	Use:   "reindex",
-	Short: "Re-chunk and re-embed all conversations",
+var verifyHashesCmd = &cobra.Command{
+	Use:   "verify-hashes",
+	Short: "Check every conversation ID still matches its content hash",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := NewStore(dbPath)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
@@ -356,44 +2519,24 @@ var reindexCmd = &cobra.Command{
 			return err
 		}
 
-		if len(convs) == 0 {
-			fmt.Println("No conversations to reindex.")
-			return nil
-		}
-
-		ollama := NewOllama(ollamaURL, "nomic-embed-text")
-
-		for _, conv := range convs {
-			chunks := chunkText(conv.Content, 800)
-			fmt.Printf("Reindexing %s: %d chunks\n", conv.ID[:8], len(chunks))
-
-			for i, chunkText := range chunks {
-				chunkID := fmt.Sprintf("%s_%d", conv.ID, i)
-				chunk := Chunk{
-					ID:       chunkID,
-					ConvID:   conv.ID,
-					Content:  chunkText,
-					Position: i,
-				}
-
-				if err := store.SaveChunk(chunk); err != nil {
-					return fmt.Errorf("save chunk %d: %w", i, err)
-				}
-
-				embedding, err := ollama.Embed(chunkText)
-				if err != nil {
-					return fmt.Errorf("embed chunk %d: %w", i, err)
-				}
-
-				if err := store.SaveChunkEmbedding(chunkID, embedding); err != nil {
-					return fmt.Errorf("save chunk embedding %d: %w", i, err)
-				}
-
-				fmt.Printf("  chunk %d: %d chars\n", i, len(chunkText))
+		mismatched := 0
+		for _, c := range convs {
+			// Versions are named after their original, not their content
+			if baseID(c.ID) != c.ID {
+				continue
+			}
+			if hash := hashContent([]byte(c.Content)); hash != c.ID {
+				fmt.Printf("%s  content hashes to %s\n", c.ID[:8], hash[:8])
+				mismatched++
 			}
 		}
 
-		fmt.Println("Done reindexing.")
+		if mismatched > 0 {
+			fmt.Println("Content no longer matches its ID, so re-uploading it won't dedupe.")
+			fmt.Println("Re-upload the affected files and run `memctx reindex`.")
+			return fmt.Errorf("%d of %d conversations have mismatched hashes", mismatched, len(convs))
+		}
+		fmt.Printf("All %d conversation hashes match.\n", len(convs))
 		return nil
 	},
 }
@@ -403,46 +2546,63 @@ var debugCmd = &cobra.Command{
 	Short: "Show all distances for debugging",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		query := args[0]
+		query, err := requireQuery(args[0])
+		if err != nil {
+			return err
+		}
 
-		store, err := NewStore(dbPath)
+		store, err := openStore()
 		if err != nil {
 			return err
 		}
 		defer store.Close()
 
-		embedOllama := NewOllama(ollamaURL, "nomic-embed-text")
-		queryEmb, err := embedOllama.Embed(query)
+		embedOllama := NewOllama(ollamaURL, embedModel)
+		queryEmb, err := embedQuery(cmd.Context(), embedOllama, query)
 		if err != nil {
 			return fmt.Errorf("embed query: %w", err)
 		}
+		queryEmb = coerceQueryDim(store, queryEmb)
+		if validateDims {
+			if err := store.ValidateQueryDim(queryEmb); err != nil {
+				return err
+			}
+		}
+
+		if jsonOutput {
+			return debugJSON(store, query, queryEmb)
+		}
 
 		fmt.Printf("Query: %s\n\n", query)
 
 		// Show chunk results if available
 		if store.HasChunks() {
-			results, err := store.SearchChunks(queryEmb, 20, 2.0)
+			results, err := searchChunks(store, queryEmb, "", debugLimit, 2.0)
 			if err != nil {
 				return fmt.Errorf("search chunks: %w", err)
 			}
 
 			fmt.Println("CHUNK distances (lower = more similar):")
-			fmt.Println("Distance | Similarity | Preview")
-			fmt.Println("---------|------------|--------")
+			fmt.Println("Distance | Similarity | Written          | Preview")
+			fmt.Println("---------|------------|------------------|--------")
 			for _, r := range results {
-				similarity := (1.0 - r.Distance) * 100
+				similarity := similarity(r.Distance)
 				preview := r.Content
 				if len(preview) > 50 {
 					preview = preview[:50] + "..."
 				}
 				preview = strings.ReplaceAll(preview, "\n", " ")
-				fmt.Printf("%.4f   | %5.1f%%     | %s\n", r.Distance, similarity, preview)
+				written := "-"
+				if !r.CreatedAt.IsZero() {
+					written = r.CreatedAt.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Printf("%-8s | %5s%%     | %-16s | %s\n", fixed(r.Distance, 4), fixed(similarity, 1), written, preview)
 			}
 			fmt.Println()
 		}
 
 		// Also show whole-doc results
-		results, err := store.Search(queryEmb, 100, 2.0)
+		results, err := searchDocs(store, queryEmb, debugLimit, 2.0)
 		if err != nil {
 			return fmt.Errorf("search: %w", err)
 		}
@@ -451,23 +2611,67 @@ var debugCmd = &cobra.Command{
 		fmt.Println("Distance | Similarity | ID       | Preview")
 		fmt.Println("---------|------------|----------|--------")
 		for _, r := range results {
-			conv, err := store.Get(r.ID)
+			// Only the preview is needed, don't load whole conversations
+			conv, err := store.GetPreview(r.ID, 41)
 			if err != nil {
 				continue
 			}
-			similarity := (1.0 - r.Distance) * 100
+			similarity := similarity(r.Distance)
 			preview := conv.Content
 			if len(preview) > 40 {
 				preview = preview[:40] + "..."
 			}
 			preview = strings.ReplaceAll(preview, "\n", " ")
-			fmt.Printf("%.4f   | %5.1f%%     | %s | %s\n", r.Distance, similarity, r.ID[:8], preview)
+			fmt.Printf("%-8s | %5s%%     | %s | %s\n", fixed(r.Distance, 4), fixed(similarity, 1), r.ID[:8], preview)
 		}
 		return nil
 	},
 }
 
+// debugJSONPreview is how much of each whole-doc match debug --json
+// carries; the distance is what's being debugged, not the conversation
+const debugJSONPreview = 200
+
+// debugJSON is debug's --json output. Whole-doc matches carry the first
+// debugJSONPreview characters of the conversation, fetched without
+// loading the rest.
+func debugJSON(store *Store, query string, queryEmb []float32) error {
+	out := jsonDebug{Query: query, Chunks: []jsonMatch{}, Conversations: []jsonMatch{}}
+	if store.HasChunks() {
+		results, err := searchChunks(store, queryEmb, "", debugLimit, 2.0)
+		if err != nil {
+			return fmt.Errorf("search chunks: %w", err)
+		}
+		for _, r := range results {
+			out.Chunks = append(out.Chunks, newJSONMatch(r))
+		}
+	}
+
+	results, err := searchDocs(store, queryEmb, debugLimit, 2.0)
+	if err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	for _, r := range results {
+		conv, err := store.GetPreview(r.ID, debugJSONPreview)
+		if err != nil {
+			continue
+		}
+		r.ConvID = conv.ID
+		r.Content = conv.Content
+		out.Conversations = append(out.Conversations, newJSONMatch(r))
+	}
+	return writeJSON(out)
+}
+
+// Execute runs the CLI. The first Ctrl-C cancels the command's context so
+// in-flight Ollama requests stop cleanly, a second one exits immediately.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return rootCmd.ExecuteContext(ctx)
 }
 
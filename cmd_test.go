@@ -0,0 +1,1605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// setVar sets a package variable, such as a flag, for the rest of the test
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// runCmd runs memctx with args and returns what it printed on stdout and
+// stderr. Flags are put back to their defaults afterwards, since cobra
+// keeps them between runs.
+func runCmd(t *testing.T, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	defer resetFlags(rootCmd)
+	defer func() { timing = nil }()
+
+	outR, outW, perr := os.Pipe()
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	errR, errW, perr := os.Pipe()
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	oldOut, oldErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outW, errW
+	var outBuf, errBuf bytes.Buffer
+	done := make(chan struct{})
+	go func() { io.Copy(&outBuf, outR); done <- struct{}{} }()
+	go func() { io.Copy(&errBuf, errR); done <- struct{}{} }()
+
+	rootCmd.SetArgs(args)
+	err = rootCmd.ExecuteContext(context.Background())
+
+	os.Stdout, os.Stderr = oldOut, oldErr
+	outW.Close()
+	errW.Close()
+	<-done
+	<-done
+	return outBuf.String(), errBuf.String(), err
+}
+
+// resetFlags puts every flag of cmd and its subcommands back to its
+// default
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			var def []string
+			if s := strings.Trim(f.DefValue, "[]"); s != "" {
+				def = strings.Split(s, ",")
+			}
+			sv.Replace(def)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// writeFile writes content to name in a temporary directory and returns
+// its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFailedChunkIsRecordedAndRetried(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) { f.failing = "unembeddable" })
+	db := filepath.Join(t.TempDir(), "test.db")
+	good := strings.Repeat("alpha beta gamma ", 40)
+	bad := strings.Repeat("unembeddable delta ", 40)
+	file := writeFile(t, "conv.txt", good+"\n\n"+bad)
+
+	args := append(f.args(db), "upload", file, "--embed-retries-per-chunk", "0")
+	out, _, err := runCmd(t, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 failed") {
+		t.Errorf("upload output doesn't report the failed chunk:\n%s", out)
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := store.ListFailedChunks()
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Position != 1 || !strings.Contains(failed[0].Error, "cannot embed") {
+		t.Fatalf("failed chunks = %+v, want chunk 1 with the embed error", failed)
+	}
+
+	f.set(func(f *fakeOllama) { f.failing = "" })
+	out, _, err = runCmd(t, append(f.args(db), "retry-failed", "--embed-retries-per-chunk", "0")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 of 1 failed chunks embedded") {
+		t.Errorf("retry-failed output:\n%s", out)
+	}
+
+	store, err = NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if failed, err := store.ListFailedChunks(); err != nil || len(failed) != 0 {
+		t.Errorf("failed chunks after retry = %v, %v; want none", failed, err)
+	}
+	if n, err := store.CountChunkEmbeddings(); err != nil || n != 2 {
+		t.Errorf("embedded chunks = %d, %v; want 2", n, err)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	s := "añ€😀" // 1, 2, 3 and 4 byte runes
+	for n := 0; n <= len(s)+1; n++ {
+		got := truncateUTF8(s, n)
+		if !utf8.ValidString(got) || len(got) > n || !strings.HasPrefix(s, got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q", s, n, got)
+		}
+	}
+	if got := truncateUTF8(s, 5); got != "añ" {
+		t.Errorf("truncateUTF8 inside € = %q, want %q", got, "añ")
+	}
+}
+
+func TestJoinContextsTruncatesOnRuneBoundary(t *testing.T) {
+	long := strings.Repeat("日本語", 10)
+	got := joinContexts([]string{long, "short"}, 10)
+	if !utf8.ValidString(got) {
+		t.Fatalf("joinContexts produced invalid UTF-8: %q", got)
+	}
+	if want := "[Conversation 1]\n日本語...[truncated]\n\n[Conversation 2]\nshort\n\n"; got != want {
+		t.Errorf("joinContexts = %q, want %q", got, want)
+	}
+}
+
+func TestSearchDocsRespectsLimit(t *testing.T) {
+	store := newTestStore(t)
+	for _, id := range []string{"conv1", "conv2", "conv3", "conv4"} {
+		if err := store.Save(Conversation{ID: id, Content: "worker pools " + id, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveEmbedding(id, fakeEmbedding("worker pools "+id, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := searchDocs(store, fakeEmbedding("worker pools", 16), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("searchDocs with limit 2 returned %d conversations", len(results))
+	}
+}
+
+func TestFitToBudget(t *testing.T) {
+	f := newFakeOllama(t)
+	paras := []string{
+		strings.Repeat("cooking pasta recipes ", 22),
+		strings.Repeat("worker pools drain queues ", 22),
+		strings.Repeat("gardening tomato plants ", 22),
+		strings.Repeat("travel train tickets ", 22),
+	}
+	content := strings.Join(paras, "\n\n")
+	// Each paragraph is a chunk of its own and two fit
+	budget := 2*len(paras[1]) + 10
+
+	got, err := fitToBudget(context.Background(), f.client(testEmbedModel), fakeEmbedding("worker pools queues", 16), content, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > budget {
+		t.Errorf("fitToBudget returned %d bytes, over the %d budget", len(got), budget)
+	}
+	if !strings.Contains(got, "worker pools") {
+		t.Errorf("fitToBudget dropped the relevant paragraph: %q", got)
+	}
+}
+
+func TestCleanCodeEmbedsCleanedText(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	code := "func main() {\n\t// say hello\n\tfmt.Println(\"hello\",    \"world\")\n\treturn\n}"
+	file := writeFile(t, "code.txt", code)
+
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file, "--clean-code", "--strip-comments")...); err != nil {
+		t.Fatal(err)
+	}
+	_, embedded := f.embedCalls()
+	want := "func main() {\nfmt.Println(\"hello\", \"world\")\nreturn\n}"
+	if !slices.Contains(embedded, want) {
+		t.Errorf("embedded %q, want the cleaned %q", embedded, want)
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	convs, err := store.List()
+	if err != nil || len(convs) != 1 {
+		t.Fatalf("List = %v, %v", convs, err)
+	}
+	chunks, err := store.ChunksForConversation(convs[0].ID)
+	if err != nil || len(chunks) != 1 {
+		t.Fatalf("chunks = %v, %v", chunks, err)
+	}
+	if chunks[0].Content != code {
+		t.Errorf("stored chunk %q, want the original %q", chunks[0].Content, code)
+	}
+}
+
+func TestLooksLikeCode(t *testing.T) {
+	for text, want := range map[string]bool{
+		"```go\nx := 1\n```":                 true,
+		"if x {\n\treturn y;\n}":             true,
+		"We talked about worker pools.\nOK.": false,
+	} {
+		if got := looksLikeCode(text); got != want {
+			t.Errorf("looksLikeCode(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestRankOrdersDocsBySimilarity(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	far := writeFile(t, "far.txt", "baking sourdough bread at home")
+	near := writeFile(t, "near.txt", "sizing worker pools for the job queue")
+
+	out, _, err := runCmd(t, append(f.args(db), "rank", "--query", "worker pools queue", "--doc", far, "--doc", near)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], near) || !strings.Contains(lines[1], far) {
+		t.Errorf("rank output isn't near then far:\n%s", out)
+	}
+	if _, err := os.Stat(db); !os.IsNotExist(err) {
+		t.Errorf("rank created the database (stat err %v)", err)
+	}
+}
+
+func TestAutoReindexAfterDimensionChange(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	// A whole-conversation embedding, as databases from before chunking have
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convs, err := store.List()
+	if err == nil {
+		err = store.SaveEmbedding(convs[0].ID, fakeEmbedding("worker pools", f.dim))
+	}
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.set(func(f *fakeOllama) {
+		f.dim = 8
+		f.models = append(f.models, "small-embed:latest")
+	})
+	file := writeFile(t, "new.txt", strings.Repeat("sourdough needs a starter ", 20))
+	if _, _, err := runCmd(t, append(f.args(db), "--embed-model", "small-embed", "upload", file)...); err == nil {
+		t.Fatal("upload with a different dimension succeeded without --auto-reindex")
+	}
+	out, stderr, err := runCmd(t, append(f.args(db), "--embed-model", "small-embed", "upload", file, "--auto-reindex", "--yes")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mismatch is reported on stderr, out of the way of --json
+	if strings.Contains(out, errDimensionMismatch.Error()) || !strings.Contains(stderr, errDimensionMismatch.Error()) {
+		t.Errorf("dimension mismatch isn't reported on stderr:\nstdout:\n%s\nstderr:\n%s", out, stderr)
+	}
+
+	out, _, err = runCmd(t, append(f.args(db), "--embed-model", "small-embed", "search", "--json", "--threshold", "0.99", "worker pools")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matches []jsonMatch
+	if err := json.Unmarshal([]byte(out), &matches); err != nil || len(matches) == 0 {
+		t.Fatalf("search after reindex = %s (%v), want matches", out, err)
+	}
+
+	store, err = NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if dim := store.Dimension(); dim != 8 {
+		t.Errorf("recorded dimension %d, want 8", dim)
+	}
+	var stale int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM conversations WHERE embedding IS NOT NULL`).Scan(&stale); err != nil || stale != 0 {
+		t.Errorf("%d conversation embeddings left from the old model (%v)", stale, err)
+	}
+	var wrong int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM chunks WHERE embedding IS NULL OR json_array_length(embedding) != 8`).Scan(&wrong); err != nil || wrong != 0 {
+		t.Errorf("%d chunks without an 8-dim embedding (%v)", wrong, err)
+	}
+	if convs, err := store.List(); err != nil || len(convs) != 2 {
+		t.Errorf("store has %d conversations (%v), want both kept", len(convs), err)
+	}
+}
+
+func TestStripWrappingFence(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"```markdown\n- a fact\n- another\n```", "- a fact\n- another"},
+		{"\n```\n- a fact\n```\n", "- a fact"},
+		{"- run:\n```\ngo test\n```", "- run:\n```\ngo test\n```"},
+		{"```\nfirst\n```\ntext\n```\nsecond\n```", "```\nfirst\n```\ntext\n```\nsecond\n```"},
+		{"- no fences at all", "- no fences at all"},
+	} {
+		if got := stripWrappingFence(tc.in); got != tc.want {
+			t.Errorf("stripWrappingFence(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFenceWriterMatchesStripWrappingFence(t *testing.T) {
+	for _, in := range []string{
+		"```markdown\n- a fact\n- another\n```",
+		"- run:\n```\ngo test\n```\n- done",
+		"- no fences at all",
+	} {
+		// Byte by byte, the worst case for a stream
+		var got strings.Builder
+		fw := &fenceWriter{w: &got}
+		for i := range in {
+			fw.Write([]byte(in[i : i+1]))
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if want := stripWrappingFence(in); strings.TrimSpace(got.String()) != strings.TrimSpace(want) {
+			t.Errorf("fenceWriter(%q) = %q, want %q", in, got.String(), want)
+		}
+	}
+}
+
+func TestPrimeUnwrapsFencedSynthesis(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+	f.set(func(f *fakeOllama) { f.response = []string{"```\n", "- pools drain ", "the queue\n", "```"} })
+
+	prime := append(f.args(db), "prime", "--json", "--threshold", "0.99", "worker pools")
+	out, _, err := runCmd(t, prime...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result jsonPrime
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if result.Context != "- pools drain the queue" {
+		t.Errorf("context = %q, want the fence stripped", result.Context)
+	}
+
+	out, _, err = runCmd(t, append(prime, "--keep-fences")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if !strings.HasPrefix(result.Context, "```") {
+		t.Errorf("context with --keep-fences = %q, want the fence kept", result.Context)
+	}
+}
+
+func TestReadCommandsLeaveExistingMetaAlone(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	metaKeys := func() []string {
+		t.Helper()
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		var keys []string
+		for _, k := range []string{metaVecIndexType, metaDistanceMetric, metaNormalize} {
+			if _, ok, err := store.GetMeta(k); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+
+	// A new database gets them from whichever command creates it
+	if _, _, err := runCmd(t, append(f.args(db), "list")...); err != nil {
+		t.Fatal(err)
+	}
+	if got := metaKeys(); len(got) != 3 {
+		t.Fatalf("new database has meta %v, want all three", got)
+	}
+
+	// An older database without them, locked by another writer
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(`DELETE FROM meta WHERE key IN (?, ?, ?)`, metaVecIndexType, metaDistanceMetric, metaNormalize); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	lock, err := sql.Open("sqlite3", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	lock.SetMaxOpenConns(1)
+	if _, err := lock.Exec(`BEGIN IMMEDIATE`); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, args := range [][]string{{"list"}, {"search", "--keyword", "anything"}} {
+		if _, _, err := runCmd(t, append(f.args(db), args...)...); err != nil {
+			t.Errorf("%s while another process writes: %v", args[0], err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("read commands took %s, waiting on the write lock", elapsed)
+	}
+	if _, err := lock.Exec(`ROLLBACK`); err != nil {
+		t.Fatal(err)
+	}
+	if got := metaKeys(); len(got) != 0 {
+		t.Errorf("read commands recorded meta %v", got)
+	}
+
+	// A command that writes fills them in
+	file := writeFile(t, "conv.txt", strings.Repeat("worker pools drain the queue ", 20))
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file)...); err != nil {
+		t.Fatal(err)
+	}
+	if got := metaKeys(); len(got) != 3 {
+		t.Errorf("after upload the database has meta %v, want all three", got)
+	}
+}
+
+func TestSmartPreviewSkipsGreetings(t *testing.T) {
+	content := "\nUser: Hi, how can I help?\nAssistant: Hello!\nThe worker pool deadlocks when the queue is full.\nMore detail."
+	if got, want := smartPreview(content), "The worker pool deadlocks when the queue is full.\nMore detail."; got != want {
+		t.Errorf("smartPreview = %q, want %q", got, want)
+	}
+	if got := smartPreview("Hi there"); got != "Hi there" {
+		t.Errorf("smartPreview of only boilerplate = %q, want it unchanged", got)
+	}
+}
+
+func TestListPreviewStrategies(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(Conversation{ID: "titled", Title: "Deadlock hunt", Content: "Hi, how can I help?\nThe pool deadlocks.", CreatedAt: time.Now()})
+	if err == nil {
+		err = store.Save(Conversation{ID: "untitled", Content: "Hello!\nRetries need jitter.", CreatedAt: time.Now().Add(-time.Hour)})
+	}
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for strategy, want := range map[string][]string{
+		"title": {"Deadlock hunt", "Hello! Retries need jitter."},
+		"head":  {"Hi, how can I help? The pool deadlocks.", "Hello! Retries need jitter."},
+		"smart": {"The pool deadlocks.", "Retries need jitter."},
+	} {
+		out, _, err := runCmd(t, "--db", db, "list", "--json", "--preview-strategy", strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []jsonListItem
+		if err := json.Unmarshal([]byte(out), &items); err != nil {
+			t.Fatalf("%v in %s", err, out)
+		}
+		var got []string
+		for _, it := range items {
+			got = append(got, it.Preview)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("--preview-strategy %s previews %q, want %q", strategy, got, want)
+		}
+	}
+	if _, _, err := runCmd(t, "--db", db, "list", "--preview-strategy", "middle"); err == nil {
+		t.Error("an unknown strategy was accepted")
+	}
+}
+
+func TestPrimeWithoutGenModelFallsBackToContext(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+	f.set(func(f *fakeOllama) { f.models = []string{testEmbedModel + ":latest"} })
+
+	out, stderr, err := runCmd(t, append(f.args(db), "prime", "--json", "--threshold", "0.99", "worker pools")...)
+	if err != nil {
+		t.Fatalf("prime without the generation model failed: %v", err)
+	}
+	if !strings.Contains(stderr, "generation model "+testGenModel+" not found") {
+		t.Errorf("stderr has no warning about the missing model:\n%s", stderr)
+	}
+	var result jsonPrime
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if result.Synthesized || !strings.Contains(result.Context, "worker pools drain the queue") {
+		t.Errorf("result = %+v, want the retrieved context unsynthesized", result)
+	}
+	if prompts := f.generatePrompts(); len(prompts) != 0 {
+		t.Errorf("prime called generate %d times", len(prompts))
+	}
+}
+
+func TestVerifyHashesFlagsMismatch(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := "worker pools"
+	err = store.Save(Conversation{ID: hashContent([]byte(good)), Content: good, CreatedAt: time.Now()})
+	if err == nil {
+		// Stored under the hash of a differently normalized text
+		err = store.Save(Conversation{ID: hashContent([]byte("sourdough  ")), Content: "sourdough", CreatedAt: time.Now()})
+	}
+	if err == nil {
+		err = store.Save(Conversation{ID: hashContent([]byte(good)) + "-v2", Content: "a later version", CreatedAt: time.Now()})
+	}
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := runCmd(t, "--db", db, "verify-hashes")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 conversations") {
+		t.Errorf("verify-hashes error = %v, want 1 of 3 mismatched", err)
+	}
+	bad := hashContent([]byte("sourdough  "))[:8]
+	if !strings.Contains(out, bad+"  content hashes to "+hashContent([]byte("sourdough"))[:8]) {
+		t.Errorf("output doesn't flag %s:\n%s", bad, out)
+	}
+	if strings.Contains(out, hashContent([]byte(good))[:8]+"  ") {
+		t.Errorf("output flags a matching conversation:\n%s", out)
+	}
+}
+
+func TestDBReadOnly(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	store, err := NewReadOnlyStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Save(Conversation{ID: "sneaky", Content: "sneaky", CreatedAt: time.Now()}); err == nil {
+		t.Error("Save on a read-only store succeeded")
+	}
+
+	file := writeFile(t, "more.txt", strings.Repeat("night trains run late ", 20))
+	_, _, err = runCmd(t, append(f.args(db), "--db-readonly", "upload", file)...)
+	if err == nil || !strings.Contains(err.Error(), "can't be used with --db-readonly") {
+		t.Errorf("upload --db-readonly = %v, want it refused", err)
+	}
+
+	out, _, err := runCmd(t, append(f.args(db), "--db-readonly", "search", "--threshold", "0.99", "worker pools")...)
+	if err != nil {
+		t.Fatalf("search --db-readonly: %v", err)
+	}
+	if !strings.Contains(out, "worker pools") {
+		t.Errorf("search --db-readonly found nothing:\n%s", out)
+	}
+	convs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 {
+		t.Errorf("db has %d conversations after read-only commands, want 1", len(convs))
+	}
+}
+
+func TestSentencesPerUnitKeepsGroupsTogether(t *testing.T) {
+	if got, want := groupSentences([]string{"a.", "b.", "c.", "d."}, 3), []string{"a. b. c.", "d."}; !slices.Equal(got, want) {
+		t.Errorf("groupSentences = %q, want %q", got, want)
+	}
+
+	var sentences []string
+	for i := range 40 {
+		sentences = append(sentences, fmt.Sprintf("S%d is a sentence of some length.", i))
+	}
+	chunks := chunkText(strings.Join(sentences, " "), chunkOptions{Size: 200, SentencesPerUnit: 3})
+	if len(chunks) < 3 {
+		t.Fatalf("want several chunks, got %d", len(chunks))
+	}
+	next := 0
+	for i, c := range chunks {
+		var got []int
+		for _, s := range splitSentences(c, nil) {
+			var n int
+			if _, err := fmt.Sscanf(s, "S%d ", &n); err != nil {
+				t.Fatalf("chunk %d has an unexpected sentence %q", i, s)
+			}
+			got = append(got, n)
+		}
+		if got[0] != next || got[0]%3 != 0 {
+			t.Errorf("chunk %d starts at sentence %d, want %d on a group boundary", i, got[0], next)
+		}
+		if len(got) < 3 && i < len(chunks)-1 {
+			t.Errorf("chunk %d has %d sentences, want at least 3", i, len(got))
+		}
+		next = got[len(got)-1] + 1
+	}
+	if next != len(sentences) {
+		t.Errorf("chunks end at sentence %d, want %d", next, len(sentences))
+	}
+}
+
+func TestSplitSentencesAbbreviations(t *testing.T) {
+	for _, abbr := range defaultAbbreviations {
+		text := "See " + abbr + ". Smith about it. Then stop."
+		want := []string{"See " + abbr + ". Smith about it.", "Then stop."}
+		if got := splitSentences(text, defaultAbbreviations); !slices.Equal(got, want) {
+			t.Errorf("splitSentences(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	// Case and an opening bracket don't matter
+	text := "It failed (E.g. on retry). It passed."
+	if got := splitSentences(text, defaultAbbreviations); len(got) != 2 {
+		t.Errorf("splitSentences(%q) = %q, want 2 sentences", text, got)
+	}
+
+	text = "Pi is 3.14 or so. The rate was 0.5."
+	want := []string{"Pi is 3.14 or so.", "The rate was 0.5."}
+	if got := splitSentences(text, defaultAbbreviations); !slices.Equal(got, want) {
+		t.Errorf("splitSentences(%q) = %q, want %q", text, got, want)
+	}
+
+	// Without the list every period followed by a space ends a sentence
+	if got := splitSentences("Dr. Smith. Done.", nil); len(got) != 3 {
+		t.Errorf("splitSentences without abbreviations = %q, want 3 sentences", got)
+	}
+}
+
+func TestSynthSourcesCapsSynthesisContexts(t *testing.T) {
+	if got, want := limitContexts([]string{"a", "b", "a", "c", "d"}, 3), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("limitContexts = %q, want %q", got, want)
+	}
+
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	topics := []string{"alpha", "bravo", "charlie", "delta"}
+	var texts []string
+	for _, topic := range topics {
+		texts = append(texts, strings.Repeat("worker pools drain the "+topic+" queue ", 20))
+	}
+	uploadTexts(t, f, db, texts...)
+
+	inPrompt := func(args ...string) int {
+		t.Helper()
+		if _, _, err := runCmd(t, append(append(f.args(db), "prime", "--threshold", "0.99"), args...)...); err != nil {
+			t.Fatal(err)
+		}
+		prompts := f.generatePrompts()
+		n := 0
+		for _, topic := range topics {
+			if strings.Contains(prompts[len(prompts)-1], "the "+topic+" queue") {
+				n++
+			}
+		}
+		return n
+	}
+	if n := inPrompt("worker pools"); n != len(topics) {
+		t.Fatalf("synthesis saw %d conversations without a cap, want all %d to pass the threshold", n, len(topics))
+	}
+	if n := inPrompt("--synth-sources", "2", "worker pools"); n != 2 {
+		t.Errorf("synthesis saw %d conversations with --synth-sources 2, want 2", n)
+	}
+}
+
+func TestUnicodeNormalizationDedupes(t *testing.T) {
+	nfc, nfd := "café résumé notes", "café résumé notes"
+	if nfc == nfd {
+		t.Fatal("test strings are already identical")
+	}
+	if hashContent([]byte(normalizeText(nfc))) != hashContent([]byte(normalizeText(nfd))) {
+		t.Error("NFC and NFD forms hash differently after normalization")
+	}
+
+	f := newFakeOllama(t)
+	for _, tc := range []struct {
+		flags []string
+		want  int
+	}{
+		{nil, 1},
+		{[]string{"--no-unicode-normalize"}, 2},
+	} {
+		db := filepath.Join(t.TempDir(), "test.db")
+		for _, text := range []string{nfc, nfd} {
+			args := append(append(f.args(db), tc.flags...), "upload", writeFile(t, "conv.txt", strings.Repeat(text+" ", 10)))
+			if _, _, err := runCmd(t, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		convs, err := store.List()
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(convs) != tc.want {
+			t.Errorf("flags %v: %d conversations stored, want %d", tc.flags, len(convs), tc.want)
+		}
+	}
+}
+
+func TestEmptyQueryIsRejectedBeforeOllama(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+	n, _ := f.embedCalls()
+	doc := writeFile(t, "doc.txt", "worker pools")
+
+	for _, args := range [][]string{
+		{"prime", ""},
+		{"prime", " \t\n"},
+		{"search", "   "},
+		{"debug", "\t"},
+		{"rank", "--query", " ", "--doc", doc},
+	} {
+		_, _, err := runCmd(t, append(f.args(db), args...)...)
+		if err == nil || !strings.Contains(err.Error(), "query is empty") {
+			t.Errorf("%s %q = %v, want the empty query error", args[0], args[1], err)
+		}
+	}
+	if after, _ := f.embedCalls(); after != n {
+		t.Errorf("empty queries made %d embed calls, want none", after-n)
+	}
+	if prompts := f.generatePrompts(); len(prompts) != 0 {
+		t.Errorf("empty queries made %d generate calls, want none", len(prompts))
+	}
+}
+
+func TestDebugCapsResultsAndFetchesOnlyPreviews(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("worker pools drain the queue ", 40000)
+	var ids []string
+	for i := range 5 {
+		c := Conversation{ID: hashContent([]byte(fmt.Sprint(i, body))), Content: fmt.Sprint(i, body), CreatedAt: time.Now()}
+		if err := store.Save(c); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveEmbedding(c.ID, fakeEmbedding(c.Content[:100], 16)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, c.ID)
+	}
+	store.Close()
+
+	for _, args := range [][]string{
+		{"debug", "--limit", "3", "worker pools"},
+		{"debug", "--json", "--limit", "3", "worker pools"},
+	} {
+		fetchedContent.Store(0)
+		out, _, err := runCmd(t, append(f.args(db), args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := fetchedContent.Load(); n > 3*debugJSONPreview {
+			t.Errorf("%v read %d bytes of 1MB conversations, want previews only", args, n)
+		}
+
+		var shown []string
+		if slices.Contains(args, "--json") {
+			var v jsonDebug
+			if err := json.Unmarshal([]byte(out), &v); err != nil {
+				t.Fatalf("debug --json output doesn't parse: %v", err)
+			}
+			for _, m := range v.Conversations {
+				shown = append(shown, m.ConvID)
+				if !strings.HasPrefix(body, m.Content[1:]) || len(m.Content) != debugJSONPreview {
+					t.Errorf("debug --json conversation content is %d bytes, want a %d-byte preview", len(m.Content), debugJSONPreview)
+				}
+			}
+		} else {
+			for _, id := range ids {
+				if strings.Contains(out, id[:8]) {
+					shown = append(shown, id)
+				}
+			}
+		}
+		if len(shown) != 3 {
+			t.Errorf("%v showed %d conversations:\n%s", args, len(shown), out)
+		}
+	}
+}
+
+func TestListFetchesOnlyPreviewPrefix(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("the worker pool deadlocks when the queue is full ", 20000)
+	accents := strings.Repeat("café ", 20000)
+	err = store.Save(Conversation{ID: "big", Content: body, CreatedAt: time.Now()})
+	if err == nil {
+		err = store.Save(Conversation{ID: "accents", Content: accents, CreatedAt: time.Now().Add(-time.Hour)})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	convs, err := store.ListPage(61, "", 0, 0)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 2 || len(convs[0].Content) != 61 || utf8.RuneCountInString(convs[1].Content) != 61 {
+		t.Fatalf("ListPage(61) fetched %d conversations with %d and %d chars, want 61 each", len(convs), len(convs[0].Content), utf8.RuneCountInString(convs[1].Content))
+	}
+	if !strings.HasPrefix(accents, convs[1].Content) {
+		t.Errorf("preview %q isn't the start of the content", convs[1].Content)
+	}
+
+	out, _, err := runCmd(t, "--db", db, "list", "--json", "--preview-strategy", "head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []jsonListItem
+	if err := json.Unmarshal([]byte(out), &items); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(items) != 2 || items[0].Preview != body[:60]+"..." {
+		t.Errorf("list previews = %+v, want the first 60 chars of big", items)
+	}
+}
+
+// withStdin runs fn with os.Stdin reading content
+func withStdin(t *testing.T, content string, fn func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write([]byte(content))
+		w.Close()
+	}()
+	old := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = old
+		r.Close()
+	}()
+	fn()
+}
+
+func TestUploadLimitBytes(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	big := strings.Repeat("worker pools drain the queue ", 100)
+
+	withStdin(t, big, func() {
+		_, _, err := runCmd(t, append(f.args(db), "upload", "-", "--limit-bytes", "1000")...)
+		if err == nil || !strings.Contains(err.Error(), "larger than --limit-bytes (1000 bytes)") {
+			t.Errorf("oversized upload = %v, want the --limit-bytes error", err)
+		}
+	})
+	if n, _ := f.embedCalls(); n != 0 {
+		t.Errorf("oversized upload made %d embed calls, want none", n)
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convs, err := store.List()
+	store.Close()
+	if err != nil || len(convs) != 0 {
+		t.Errorf("oversized upload stored %d conversations (%v), want none", len(convs), err)
+	}
+
+	// readInput itself gives up before handing anything on to chunk
+	withStdin(t, big, func() {
+		content, err := readInput("-", 1000)
+		if err == nil || len(content) != 0 {
+			t.Errorf("readInput over the cap = %d bytes, %v", len(content), err)
+		}
+	})
+	withStdin(t, big, func() {
+		if _, _, err := runCmd(t, append(f.args(db), "upload", "-", "--limit-bytes", "1000", "--force")...); err != nil {
+			t.Errorf("upload --force over the cap: %v", err)
+		}
+	})
+}
+
+func TestListPreviewLines(t *testing.T) {
+	content := "\n  first line  \n\n\t\nsecond line\t\n\nthird line\nfourth"
+	if got, want := firstLines(content, 3), []string{"  first line", "second line", "third line"}; !slices.Equal(got, want) {
+		t.Errorf("firstLines = %q, want %q", got, want)
+	}
+	if got := firstLines("only\n\n", 5); !slices.Equal(got, []string{"only"}) {
+		t.Errorf("firstLines of a short text = %q", got)
+	}
+
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(Conversation{ID: "3f2a1b4c9d", Content: content, CreatedAt: time.Now()})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := runCmd(t, "--db", db, "list", "--preview-lines", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "3f2a1b4c") || lines[1] != "      first line" || lines[2] != "    second line" {
+		t.Errorf("list --preview-lines 2 printed:\n%s", out)
+	}
+}
+
+func TestUploadOnConflict(t *testing.T) {
+	text := strings.Repeat("worker pools drain the queue ", 20)
+	id := hashContent([]byte(normalizeText(text)))
+
+	for _, tc := range []struct {
+		policy string
+		// uploads of the same content after the first
+		again    int
+		convs    int
+		reembeds bool
+	}{
+		{"skip", 1, 1, false},
+		{"replace", 1, 1, true},
+		{"version", 2, 3, true},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			f := newFakeOllama(t)
+			db := filepath.Join(t.TempDir(), "test.db")
+			file := writeFile(t, "conv.txt", text)
+			upload := append(f.args(db), "upload", file, "--no-cache")
+			if _, _, err := runCmd(t, upload...); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := f.embedCalls()
+			for range tc.again {
+				if _, _, err := runCmd(t, append(upload, "--on-conflict", tc.policy)...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if after, _ := f.embedCalls(); (after > before) != tc.reembeds {
+				t.Errorf("%d embed calls on re-upload, want re-embedding %v", after-before, tc.reembeds)
+			}
+
+			store, err := NewStore(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			convs, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(convs) != tc.convs {
+				t.Fatalf("%d conversations stored, want %d", len(convs), tc.convs)
+			}
+			for v := 2; v <= tc.convs; v++ {
+				c, err := store.Get(versionID(id, v))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.ParentID != id || c.Version != v || c.Content != text {
+					t.Errorf("version %d = parent %q, version %d; want linked to %s", v, c.ParentID, c.Version, id[:8])
+				}
+				if chunks, err := store.ChunksForConversation(c.ID); err != nil || len(chunks) == 0 {
+					t.Errorf("version %d has no chunks (%v)", v, err)
+				}
+			}
+			if chunks, err := store.ChunksForConversation(id); err != nil || len(chunks) == 0 {
+				t.Errorf("the original has no chunks after %s (%v)", tc.policy, err)
+			}
+		})
+	}
+}
+
+func TestUploadImageStoresDescription(t *testing.T) {
+	f := newFakeOllama(t)
+	desc := strings.Repeat("a terminal showing dialContext returned ERR_CONN_RESET. ", 10)
+	f.set(func(f *fakeOllama) {
+		f.models = append(f.models, "llava:latest")
+		f.response = []string{desc}
+	})
+	desc = strings.TrimSpace(desc)
+	db := filepath.Join(t.TempDir(), "test.db")
+	image := "\x89PNG\r\n\x1a\nnot really pixels"
+	file := writeFile(t, "screenshot.png", image)
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file, "--image", "--vision-model", "llava")...); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	images := f.images
+	f.mu.Unlock()
+	if len(images) != 1 || string(images[0]) != image {
+		t.Fatalf("vision model got images %q, want the file's bytes", images)
+	}
+	_, embedded := f.embedCalls()
+	if !slices.ContainsFunc(embedded, func(in string) bool { return strings.Contains(in, "ERR_CONN_RESET") }) {
+		t.Errorf("embedded %q, want the description", embedded)
+	}
+	for _, in := range embedded {
+		if strings.Contains(in, "PNG") {
+			t.Errorf("the raw image was embedded: %q", in)
+		}
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	c, err := store.Get(hashContent([]byte(normalizeText(desc))))
+	if err != nil {
+		t.Fatalf("description not stored under its hash: %v", err)
+	}
+	if c.Content != normalizeText(desc) {
+		t.Errorf("stored %q, want the description", c.Content)
+	}
+}
+
+func TestFilterIrrelevantDropsRejectedContexts(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) {
+		f.reply = func(prompt string) string {
+			if !strings.HasPrefix(prompt, "Is the excerpt below relevant") {
+				return "- a fact"
+			}
+			if strings.Contains(prompt, "sourdough") {
+				return "No."
+			}
+			return "Yes"
+		}
+	})
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db,
+		strings.Repeat("worker pools drain the queue ", 20),
+		strings.Repeat("worker pools and sourdough starters ", 20),
+	)
+
+	synthesis := func(args ...string) string {
+		t.Helper()
+		if _, _, err := runCmd(t, append(append(f.args(db), "prime", "--threshold", "0.99"), args...)...); err != nil {
+			t.Fatal(err)
+		}
+		prompts := f.generatePrompts()
+		return prompts[len(prompts)-1]
+	}
+	if p := synthesis("worker pools"); !strings.Contains(p, "sourdough") {
+		t.Fatal("the off-topic conversation wasn't retrieved without the filter")
+	}
+	p := synthesis("--filter-irrelevant", "--context-scoring-model", testGenModel, "worker pools")
+	if strings.Contains(p, "sourdough") {
+		t.Error("synthesis saw a context the scoring model rejected")
+	}
+	if !strings.Contains(p, "drain the queue") {
+		t.Error("synthesis lost the relevant context")
+	}
+
+	// With --json the drops are reported on stderr, not in the JSON
+	out, stderr, err := runCmd(t, append(f.args(db), "prime", "--json", "--threshold", "0.99", "--filter-irrelevant", "--context-scoring-model", testGenModel, "worker pools")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v jsonPrime
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		t.Errorf("prime --json --filter-irrelevant output doesn't parse: %v\n%s", err, out)
+	}
+	if !strings.Contains(stderr, "Dropped context") {
+		t.Errorf("stderr doesn't report the dropped context:\n%s", stderr)
+	}
+
+	// and so does mcp, whose stdout is the protocol stream
+	requests := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-06-18"}}
+{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"prime_context","arguments":{"intent":"worker pools","threshold":0.99}}}
+`
+	withStdin(t, requests, func() {
+		out, stderr, err = runCmd(t, append(f.args(db), "mcp", "--filter-irrelevant", "--context-scoring-model", testGenModel)...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for _, line := range lines {
+		var resp rpcResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil || resp.Error != nil {
+			t.Errorf("mcp wrote %q to stdout, want JSON-RPC responses only (%v)", line, err)
+		}
+	}
+	if len(lines) != 2 || !strings.Contains(stderr, "Dropped context") {
+		t.Errorf("mcp stdout:\n%s\nstderr:\n%s", out, stderr)
+	}
+	if p := f.generatePrompts(); strings.Contains(p[len(p)-1], "sourdough") || !strings.Contains(p[len(p)-1], "drain the queue") {
+		t.Error("mcp synthesis didn't get just the relevant context")
+	}
+}
+
+func TestMaxEmbedCharsTruncatesEmbeddedInput(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	text := strings.Repeat("wörker pöols drain the queue ", 20)
+	file := writeFile(t, "conv.txt", text)
+	_, stderr, err := runCmd(t, append(f.args(db), "upload", file, "--no-cache", "--max-embed-chars", "101")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "truncated to 101 for embedding") {
+		t.Errorf("no truncation warning:\n%s", stderr)
+	}
+	_, embedded := f.embedCalls()
+	for _, in := range embedded {
+		if len(in) > 101 || !utf8.ValidString(in) {
+			t.Errorf("embedded %d bytes (valid UTF-8 %v), want at most 101", len(in), utf8.ValidString(in))
+		}
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	chunks, err := store.ChunksForConversation(hashContent([]byte(normalizeText(text))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	for _, c := range chunks {
+		stored += len(c.Content)
+	}
+	if stored < len(strings.TrimSpace(text)) {
+		t.Errorf("chunks hold %d bytes, want the whole %d-byte text kept", stored, len(text))
+	}
+}
+
+func TestRetryBudgetAbortsUpload(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) { f.failing = "unembeddable" })
+	t.Cleanup(func() { SetRetryBudget(0) })
+	db := filepath.Join(t.TempDir(), "test.db")
+	paras := []string{strings.Repeat("alpha beta gamma ", 40)}
+	for _, word := range []string{"delta", "epsilon", "zeta", "eta"} {
+		paras = append(paras, strings.Repeat("unembeddable "+word+" ", 40))
+	}
+	file := writeFile(t, "conv.txt", strings.Join(paras, "\n\n"))
+
+	_, _, err := runCmd(t, append(f.args(db), "upload", file, "--embed-retries-per-chunk", "2", "--retry-budget", "1")...)
+	if err == nil || !errors.Is(err, errRetryBudget) || !strings.Contains(err.Error(), "--retry-budget") {
+		t.Fatalf("upload = %v, want the retry budget error", err)
+	}
+	// The batch, the good chunk, then the first bad chunk's try and its
+	// one budgeted retry
+	if n, _ := f.embedCalls(); n != 4 {
+		t.Errorf("%d embed requests, want 4 before giving up", n)
+	}
+}
+
+func TestLangInstructsSynthesis(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	prompt := func(args ...string) string {
+		t.Helper()
+		if _, _, err := runCmd(t, append(append(f.args(db), "prime", "--threshold", "0.99"), args...)...); err != nil {
+			t.Fatal(err)
+		}
+		prompts := f.generatePrompts()
+		return prompts[len(prompts)-1]
+	}
+	if p := prompt("worker pools"); !strings.Contains(p, "Write in the language of the user's intent") || strings.Contains(p, "German") {
+		t.Errorf("default prompt doesn't follow the intent's language:\n%s", p)
+	}
+	if p := prompt("--lang", "German", "worker pools"); !strings.Contains(p, "Write the bullet points in German") || strings.Contains(p, "language of the user's intent") {
+		t.Errorf("--lang German prompt:\n%s", p)
+	}
+}
+
+func TestMinWordsKeepsShortChunksOutOfIndex(t *testing.T) {
+	// Paragraphs just under the chunk size, so "Thanks!" isn't merged in
+	text := strings.Repeat("alpha beta gamma ", 47) + "\n\nThanks!\n\n" + strings.Repeat("delta epsilon zeta ", 42)
+	for _, tc := range []struct {
+		minWords string
+		chunks   int
+	}{
+		{"0", 3},
+		{"3", 2},
+	} {
+		f := newFakeOllama(t)
+		db := filepath.Join(t.TempDir(), "test.db")
+		file := writeFile(t, "conv.txt", text)
+		out, _, err := runCmd(t, append(f.args(db), "upload", file, "--no-cache", "--min-words", tc.minWords)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, embedded := f.embedCalls()
+		thanked := slices.ContainsFunc(embedded, func(in string) bool { return strings.Contains(in, "Thanks") })
+		if thanked != (tc.minWords == "0") {
+			t.Errorf("--min-words %s: \"Thanks!\" embedded %v, inputs %q", tc.minWords, thanked, embedded)
+		}
+		if tc.minWords != "0" && !strings.Contains(out, "Skipped 1 chunks under 3 words") {
+			t.Errorf("--min-words %s output:\n%s", tc.minWords, out)
+		}
+
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := store.CountChunkEmbeddings()
+		store.Close()
+		if err != nil || n != tc.chunks {
+			t.Errorf("--min-words %s: %d embedded chunks (%v), want %d", tc.minWords, n, err, tc.chunks)
+		}
+	}
+}
+
+func TestNoTrimPreservesIndentation(t *testing.T) {
+	var code strings.Builder
+	code.WriteString("func drain(q chan job) {\n")
+	for i := range 20 {
+		fmt.Fprintf(&code, "\tfor j := range q {\n\t\tif j.id == %d {\n\t\t\tj.run()\n\t\t}\n\t}\n", i)
+	}
+	code.WriteString("}")
+	// One line four times the chunk size, with no newline to split at
+	var long []string
+	for i := range 16 {
+		long = append(long, fmt.Sprintf("Sentence %d says something.", i))
+	}
+	text := "Some prose first.\n\n" + code.String() + "\n\n" + strings.Join(long, "  ")
+
+	indented := func(chunks []string) bool {
+		return slices.ContainsFunc(chunks, func(c string) bool { return strings.HasPrefix(c, "\t") })
+	}
+	opts := chunkOptions{Size: 100, SentencesPerUnit: 1}
+	if indented(chunkText(text, opts)) {
+		t.Fatal("trimmed chunks kept their indentation")
+	}
+	opts.NoTrim = true
+	chunks := chunkText(text, opts)
+	if !indented(chunks) {
+		t.Errorf("--no-trim chunks lost their leading tabs: %q", chunks)
+	}
+	for i, c := range chunks {
+		if !strings.Contains(text, c) {
+			t.Errorf("chunk %d isn't a verbatim span of the text: %q", i, c)
+		}
+		if len(c) > 2*opts.Size {
+			t.Errorf("chunk %d is %d bytes, want the long line split between sentences", i, len(c))
+		}
+	}
+	if !slices.ContainsFunc(chunks, func(c string) bool { return strings.Contains(c, ".  Sentence") }) {
+		t.Errorf("the double spaces between sentences weren't kept: %q", chunks)
+	}
+
+	// And through upload into the stored chunks
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	file := writeFile(t, "conv.go.txt", text)
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file, "--no-trim")...); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	stored, err := store.ChunksForConversation(hashContent([]byte(normalizeText(text))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, c := range stored {
+		contents = append(contents, c.Content)
+	}
+	if !strings.Contains(strings.Join(contents, ""), "\n\t\t\tj.run()\n") {
+		t.Errorf("stored chunks lost the code's indentation: %q", contents)
+	}
+}
+
+func TestVecIndexTypeRecordsFlat(t *testing.T) {
+	for _, typ := range []string{"flat", "hnsw"} {
+		f := newFakeOllama(t)
+		db := filepath.Join(t.TempDir(), "test.db")
+		file := writeFile(t, "conv.txt", strings.Repeat("worker pools drain the queue ", 20))
+		_, stderr, err := runCmd(t, append(f.args(db), "upload", file, "--vec-index-type", typ)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(stderr, "--vec-index-type "+typ+" is not supported"); warned != (typ != "flat") {
+			t.Errorf("--vec-index-type %s warned %v:\n%s", typ, warned, stderr)
+		}
+
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded, ok, err := store.GetMeta(metaVecIndexType)
+		if err != nil || !ok || recorded != vecIndexFlat {
+			t.Errorf("--vec-index-type %s recorded %q, %v, %v; want %q", typ, recorded, ok, err, vecIndexFlat)
+		}
+		// The only index is the flat scan over chunks.embedding, no vec0
+		// table exists to configure
+		var n int
+		if err := store.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE sql LIKE '%vec0%'`).Scan(&n); err != nil || n != 0 {
+			t.Errorf("%d vec0 tables (%v), want none", n, err)
+		}
+		store.Close()
+	}
+}
+
+func TestInteractiveThresholdRetrievesWithoutReembedding(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db,
+		strings.Repeat("worker pools drain the queue ", 20),
+		strings.Repeat("worker pools and sourdough starters ", 20),
+	)
+	_, before := f.embedCalls()
+	prompts := len(f.generatePrompts())
+
+	var out string
+	withStdin(t, "0.01\nabc\n0.99\n\n", func() {
+		var err error
+		out, _, err = runCmd(t, append(f.args(db), "prime", "--interactive-threshold", "--threshold", "0.3", "worker pools")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n := strings.Count(out, "Adjust threshold?"); n != 4 {
+		t.Errorf("asked %d times, want 4 (three answers and the accepting Enter):\n%s", n, out)
+	}
+	if !strings.Contains(out, `"abc" is not a positive number`) {
+		t.Errorf("a bad answer wasn't reported:\n%s", out)
+	}
+	_, after := f.embedCalls()
+	if queries := slices.DeleteFunc(after[len(before):], func(in string) bool { return in == "dimension probe" }); len(queries) != 1 {
+		t.Errorf("embedded %q for three retrievals, want the query once", queries)
+	}
+	all := f.generatePrompts()
+	if len(all) != prompts+1 {
+		t.Fatalf("%d generate calls, want one synthesis at the end", len(all)-prompts)
+	}
+	if p := all[len(all)-1]; !strings.Contains(p, "sourdough") || !strings.Contains(p, "drain the queue") {
+		t.Errorf("synthesis didn't use the accepted 0.99 threshold's matches:\n%s", p)
+	}
+}
+
+func TestStoreRawEmbeddingMatchesIndexedVector(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	text := strings.Repeat("alpha beta gamma ", 60) + "\n\n" + strings.Repeat("delta epsilon zeta ", 60)
+	file := writeFile(t, "conv.txt", text)
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file, "--store-raw-embedding")...); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	id := hashContent([]byte(normalizeText(text)))
+	chunks, err := store.ChunksForConversation(id)
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("%d chunks (%v), want several", len(chunks), err)
+	}
+	indexed, err := store.ChunkEmbeddings(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		raw, ok, err := store.RawEmbedding(c.ID)
+		if err != nil || !ok {
+			t.Fatalf("chunk %d has no raw embedding (%v)", c.Position, err)
+		}
+		if !slices.Equal(raw, indexed[c.ID]) || !slices.Equal(raw, fakeEmbedding(c.Content, 16)) {
+			t.Errorf("chunk %d: raw %v, indexed %v, want both the model's vector", c.Position, raw, indexed[c.ID])
+		}
+	}
+
+	// Without the flag nothing is kept
+	other := filepath.Join(t.TempDir(), "other.db")
+	if _, _, err := runCmd(t, append(f.args(other), "upload", file)...); err != nil {
+		t.Fatal(err)
+	}
+	store2, err := NewStore(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+	if _, ok, err := store2.RawEmbedding(chunks[0].ID); err != nil || ok {
+		t.Errorf("raw embedding kept without --store-raw-embedding (%v)", err)
+	}
+}
+
+func TestNormalizeStoresUnitEmbeddings(t *testing.T) {
+	text := strings.Repeat("alpha beta gamma alpha ", 40) + "\n\n" + strings.Repeat("delta delta epsilon ", 50)
+	norms := func(args ...string) []float64 {
+		t.Helper()
+		f := newFakeOllama(t)
+		db := filepath.Join(t.TempDir(), "test.db")
+		file := writeFile(t, "conv.txt", text)
+		if _, _, err := runCmd(t, append(append(f.args(db), args...), "upload", file)...); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := runCmd(t, append(f.args(db), "search", "--threshold", "0.5", "alpha beta")...); err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		embs, err := store.ChunkEmbeddings(hashContent([]byte(normalizeText(text))))
+		if err != nil || len(embs) < 2 {
+			t.Fatalf("%d chunk embeddings (%v), want several", len(embs), err)
+		}
+		var out []float64
+		for _, e := range embs {
+			var sum float64
+			for _, x := range e {
+				sum += float64(x) * float64(x)
+			}
+			out = append(out, math.Sqrt(sum))
+		}
+		return out
+	}
+
+	for _, n := range norms("--normalize") {
+		if math.Abs(n-1) > 1e-6 {
+			t.Errorf("--normalize stored a vector of magnitude %v, want 1", n)
+		}
+	}
+	for _, n := range norms("--normalize", "--metric", "l2") {
+		if math.Abs(n-1) > 1e-6 {
+			t.Errorf("--normalize --metric l2 stored a vector of magnitude %v, want 1", n)
+		}
+	}
+	for _, n := range norms() {
+		if n <= 1 {
+			t.Errorf("without --normalize a vector has magnitude %v, want the model's raw counts", n)
+		}
+	}
+}
+
+func TestTokenCounterFollowsLiveStream(t *testing.T) {
+	var term, text bytes.Buffer
+	tc := &tokenCounter{w: &term, tty: true, next: &text}
+	for _, piece := range []string{"- worker", " pools\n", "- queues"} {
+		if _, err := tc.Write([]byte(piece)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.Done()
+	if text.String() != "- worker pools\n- queues" {
+		t.Errorf("streamed %q, want the pieces passed through", text.String())
+	}
+	want := " [1 tokens]\x1b[11D\x1b[K [2 tokens]\x1b[11D\x1b[K [3 tokens]\x1b[11D\x1b[K"
+	if term.String() != want {
+		t.Errorf("counter wrote %q, want %q", term.String(), want)
+	}
+
+	// Off a terminal nothing is drawn, and the text still goes through
+	term.Reset()
+	text.Reset()
+	tc = &tokenCounter{w: &term, next: &text}
+	tc.Write([]byte("- a fact"))
+	tc.Done()
+	if term.Len() != 0 || text.String() != "- a fact" {
+		t.Errorf("without a terminal: counter %q, text %q", term.String(), text.String())
+	}
+}
+
+func TestSearchedConversationsSurviveForget(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	texts := map[string]string{
+		"cli":    strings.Repeat("worker pools drain the queue ", 20),
+		"serve":  strings.Repeat("night trains across the alps ", 20),
+		"unused": strings.Repeat("sourdough needs a starter ", 20),
+	}
+	for _, name := range []string{"cli", "serve", "unused"} {
+		uploadTexts(t, f, db, texts[name])
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	long := time.Now().Add(-400 * 24 * time.Hour).Format(time.RFC3339)
+	if _, err := store.db.Exec(`UPDATE conversations SET created_at = ?`, long); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := runCmd(t, append(f.args(db), "search", "--threshold", "0.5", "worker pools")...); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{store: store, embed: f.client(testEmbedModel), gen: f.client(testGenModel)}
+	query := "/search?threshold=0.5&q=" + url.QueryEscape("night trains")
+	var matches []jsonMatch
+	get(t, s.handleSearch, query, &matches)
+	// The second search is answered from the result cache and counts too
+	serveID := hashContent([]byte(normalizeText(texts["serve"])))
+	if _, err := store.db.Exec(`UPDATE conversations SET last_accessed_at = NULL WHERE id = ?`, serveID); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := f.embedCalls()
+	get(t, s.handleSearch, query, &matches)
+	if after, _ := f.embedCalls(); after != before || len(matches) != 1 {
+		t.Fatalf("second /search made %d embed calls and %d matches, want a cache hit", after-before, len(matches))
+	}
+
+	if _, _, err := runCmd(t, append(f.args(db), "--db-readonly", "forget", "--unused-for", "30d", "--yes")...); err == nil || !strings.Contains(err.Error(), "can't be used with --db-readonly") {
+		t.Errorf("forget --db-readonly = %v, want the write-command refusal", err)
+	}
+	out, _, err := runCmd(t, append(f.args(db), "forget", "--unused-for", "30d", "--yes")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Forgot 1 conversations.") {
+		t.Errorf("forget output:\n%s", out)
+	}
+	convs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, c := range convs {
+		left = append(left, c.Content)
+	}
+	if len(left) != 2 || slices.Contains(left, normalizeText(texts["unused"])) {
+		t.Errorf("after forget %d conversations are left, want the two searched ones", len(left))
+	}
+}
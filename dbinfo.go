@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(dbInfoCmd)
+}
+
+var dbInfoCmd = &cobra.Command{
+	Use:   "db-info",
+	Short: "Print SQLite version, pragmas, schema, row counts and stored settings",
+	Long: `Print everything needed to diagnose a database: the SQLite version,
+journal mode and page size, every table and index definition with row
+counts, and the settings stored in the meta table. Include it in bug
+reports.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		info, err := store.Info()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Database:       %s\n", dbPath)
+		fmt.Printf("SQLite version: %s\n", info.SQLiteVersion)
+		fmt.Printf("Journal mode:   %s\n", info.JournalMode)
+		fmt.Printf("Page size:      %d (%d pages, %d bytes)\n", info.PageSize, info.PageCount, info.PageSize*info.PageCount)
+		// Embeddings are JSON columns compared in Go, no extension is loaded
+		fmt.Printf("Vector search:  in-process %s distance, no SQLite extensions\n", store.Metric())
+
+		fmt.Println("\nMeta:")
+		if len(info.Meta) == 0 {
+			fmt.Println("  (empty)")
+		}
+		keys := make([]string, 0, len(info.Meta))
+		for k := range info.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("  %s = %s\n", k, info.Meta[k])
+		}
+
+		models, err := store.EmbedModels()
+		if err != nil {
+			return err
+		}
+		fmt.Println("\nEmbedding models:")
+		if len(models) == 0 {
+			fmt.Println("  (none recorded)")
+		}
+		names := make([]string, 0, len(models))
+		for m := range models {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		for _, m := range names {
+			fmt.Printf("  %s (%d conversations)\n", m, models[m])
+		}
+
+		fmt.Println("\nTables:")
+		for _, t := range info.Tables {
+			if t.Type == "table" {
+				fmt.Printf("  %s (%d rows)\n", t.Name, t.Rows)
+			}
+		}
+
+		fmt.Println("\nSchema:")
+		for _, t := range info.Tables {
+			if t.SQL == "" {
+				continue
+			}
+			fmt.Printf("%s;\n", strings.TrimSpace(t.SQL))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDBInfoPrintsSchemaAndDimension(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	out, _, err := runCmd(t, append(f.args(db), "db-info")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"SQLite version: 3.",
+		"Journal mode:   wal",
+		"  " + metaEmbeddingDim + " = 16\n",
+		"  " + metaSchemaVersion + " = ",
+		"  conversations (1 rows)\n",
+		"CREATE TABLE conversations (",
+		"CREATE TABLE chunks (",
+		"CREATE INDEX idx_chunks_conv_position",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("db-info output lacks %q:\n%s", want, out)
+		}
+	}
+}
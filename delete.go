@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+	deleteCmd.Flags().BoolVar(&assumeYes, "yes", false, "don't ask before deleting")
+}
+
+var deleteCmd = &cobra.Command{
+	Use:         "delete <id-prefix>",
+	Annotations: map[string]string{writesDB: "true"},
+	Short:       "Delete a conversation and its chunks",
+	Args:        cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prefix := strings.TrimSpace(args[0])
+		if prefix == "" {
+			return fmt.Errorf("id prefix must not be empty")
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		id, err := resolveID(store, prefix)
+		if err != nil {
+			return err
+		}
+
+		conv, err := store.GetPreview(id, 61)
+		if err != nil {
+			return err
+		}
+		preview := strings.ReplaceAll(conv.Content, "\n", " ")
+		if len(preview) > 60 {
+			preview = preview[:60] + "..."
+		}
+		fmt.Printf("%s  %s  %s\n", shortID(conv.ID), conv.CreatedAt.Format("2006-01-02"), preview)
+
+		if !assumeYes && !confirm("Delete this conversation?") {
+			fmt.Println("Nothing deleted.")
+			return nil
+		}
+
+		if err := store.Delete(conv.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s.\n", shortID(conv.ID))
+		return nil
+	},
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <id-prefix>",
+	Short: "Show what changed between a conversation and its previous version",
+	Long: `Show a line diff between a version and the one before it. Given the
+original conversation, compares its latest version with the one before.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		id, err := resolveID(store, args[0])
+		if err != nil {
+			return err
+		}
+
+		conv, err := store.Get(id)
+		if err != nil {
+			return err
+		}
+		root := conv.ID
+		if conv.ParentID != "" {
+			root = conv.ParentID
+		}
+		versions, err := store.Versions(root)
+		if err != nil {
+			return err
+		}
+		if len(versions) < 2 {
+			return fmt.Errorf("%s has no other versions (upload with --on-conflict version or --version-of)", shortID(conv.ID))
+		}
+
+		// Compare the requested version with its predecessor, or the two
+		// newest when given the original
+		cur := len(versions) - 1
+		if conv.ParentID != "" {
+			for i, v := range versions {
+				if v.ID == conv.ID {
+					cur = i
+				}
+			}
+		}
+		prev, next := versions[cur-1], versions[cur]
+
+		fmt.Printf("--- version %d (%s)\n", prev.Version, prev.CreatedAt.Format("2006-01-02 15:04"))
+		fmt.Printf("+++ version %d (%s)\n", next.Version, next.CreatedAt.Format("2006-01-02 15:04"))
+		changed := false
+		for _, l := range lineDiff(lines(prev.Content), lines(next.Content)) {
+			fmt.Printf("%c %s\n", l.Op, l.Text)
+			changed = changed || l.Op != ' '
+		}
+		if !changed {
+			fmt.Println("No changes.")
+		}
+		return nil
+	},
+}
+
+func lines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLine is one line of a diff: Op is ' ' for unchanged, '-' for removed
+// and '+' for added
+type diffLine struct {
+	Op   byte
+	Text string
+}
+
+// lineDiff turns a into b using a longest common subsequence of lines.
+// It is quadratic in the line counts, which is fine for conversations.
+func lineDiff(a, b []string) []diffLine {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	return out
+}
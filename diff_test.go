@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	var got []string
+	for _, l := range lineDiff([]string{"a", "b", "c", "d"}, []string{"a", "c", "x", "d"}) {
+		got = append(got, string(l.Op)+l.Text)
+	}
+	if want := " a -b  c +x  d"; strings.Join(got, " ") != want {
+		t.Errorf("lineDiff = %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestDiffShowsInsertedParagraph(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	first := "Pool sizing\n\nThe queue drains at 50 jobs a second.\n"
+	second := "Pool sizing\n\nWorkers now retry with jitter.\nBackoff caps at 30s.\n\nThe queue drains at 50 jobs a second.\n"
+	if _, _, err := runCmd(t, append(f.args(db), "upload", writeFile(t, "v1.txt", first))...); err != nil {
+		t.Fatal(err)
+	}
+	id := hashContent([]byte(normalizeText(first)))
+	if _, _, err := runCmd(t, append(f.args(db), "upload", writeFile(t, "v2.txt", second), "--version-of", id[:8])...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{id[:8], shortID(versionID(id, 2))} {
+		out, _, err := runCmd(t, "--db", db, "diff", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"  Pool sizing",
+			"  ",
+			"+ Workers now retry with jitter.",
+			"+ Backoff caps at 30s.",
+			"+ ",
+			"  The queue drains at 50 jobs a second.",
+		}
+		if !strings.Contains(out, "--- version 1") || !strings.Contains(out, "+++ version 2") || !strings.Contains(out, strings.Join(want, "\n")) {
+			t.Errorf("diff %s:\n%s\nwant the inserted paragraph:\n%s", target, out, strings.Join(want, "\n"))
+		}
+		if strings.Contains(out, "\n- ") {
+			t.Errorf("diff %s removes lines that are still there:\n%s", target, out)
+		}
+	}
+}
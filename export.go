@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	dumpOut      string
+	dumpManifest string
+
+	markdownDir string
+
+	exportEmbeddings bool
+)
+
+func init() {
+	exportMarkdownCmd.Flags().StringVar(&markdownDir, "dir", "memctx-export", "directory to write the archive to")
+	rootCmd.AddCommand(exportMarkdownCmd)
+
+	exportCmd.Flags().BoolVar(&exportEmbeddings, "with-embeddings", false, "also write each conversation's embeddings to <id>.embeddings.json")
+	rootCmd.AddCommand(exportCmd)
+
+	dumpEmbeddingsCmd.Flags().StringVar(&dumpOut, "out", "vectors.npy", "output .npy file (float32, one row per chunk)")
+	dumpEmbeddingsCmd.Flags().StringVar(&dumpManifest, "manifest", "", "manifest file mapping rows to chunks (default <out>.manifest.jsonl)")
+	rootCmd.AddCommand(dumpEmbeddingsCmd)
+}
+
+// manifestEntry maps a row of the dumped matrix back to its chunk
+type manifestEntry struct {
+	Row      int    `json:"row"`
+	ID       string `json:"id"`
+	ConvID   string `json:"conv_id"`
+	Position int    `json:"position"`
+}
+
+var dumpEmbeddingsCmd = &cobra.Command{
+	Use:   "dump-embeddings",
+	Short: "Write every chunk vector to a .npy file for external indexing",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		count, err := store.CountChunkEmbeddings()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			fmt.Println("No embeddings to dump.")
+			return nil
+		}
+
+		manifestPath := dumpManifest
+		if manifestPath == "" {
+			manifestPath = strings.TrimSuffix(dumpOut, filepath.Ext(dumpOut)) + ".manifest.jsonl"
+		}
+
+		out, err := os.Create(dumpOut)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		defer out.Close()
+		vectors := bufio.NewWriter(out)
+
+		mf, err := os.Create(manifestPath)
+		if err != nil {
+			return fmt.Errorf("create manifest: %w", err)
+		}
+		defer mf.Close()
+		manifest := bufio.NewWriter(mf)
+		enc := json.NewEncoder(manifest)
+
+		// The header needs the dimension, so it's written with the first row
+		dim, row := 0, 0
+		err = store.EachChunkEmbedding(func(v ChunkVector) error {
+			if row == 0 {
+				dim = len(v.Embedding)
+				if err := writeNpyHeader(vectors, count, dim); err != nil {
+					return err
+				}
+			}
+			if len(v.Embedding) != dim {
+				return fmt.Errorf("chunk %s has %d dims, expected %d", v.ID, len(v.Embedding), dim)
+			}
+			if err := binary.Write(vectors, binary.LittleEndian, v.Embedding); err != nil {
+				return err
+			}
+			if err := enc.Encode(manifestEntry{Row: row, ID: v.ID, ConvID: v.ConvID, Position: v.Position}); err != nil {
+				return err
+			}
+			row++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("dump: %w", err)
+		}
+		if row != count {
+			return fmt.Errorf("dump: wrote %d rows, expected %d", row, count)
+		}
+
+		if err := vectors.Flush(); err != nil {
+			return err
+		}
+		if err := manifest.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Wrote %d vectors (%d dims) to %s, manifest %s\n", row, dim, dumpOut, manifestPath)
+		return nil
+	},
+}
+
+// writeNpyHeader writes a NumPy v1.0 header for a little-endian float32
+// matrix of the given shape. The header is padded so the data starts on a
+// 64-byte boundary.
+func writeNpyHeader(w *bufio.Writer, rows, cols int) error {
+	header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", rows, cols)
+	// magic(6) + version(2) + header len(2) + header + newline
+	pad := 64 - (10+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	if _, err := w.WriteString("\x93NUMPY\x01\x00"); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(header))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(header)
+	return err
+}
+
+var exportMarkdownCmd = &cobra.Command{
+	Use:   "export-markdown",
+	Short: "Write a browsable markdown archive, one file per conversation",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		convs, err := store.List()
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(markdownDir, 0o755); err != nil {
+			return fmt.Errorf("create dir: %w", err)
+		}
+
+		var index strings.Builder
+		index.WriteString("# memctx archive\n\n")
+
+		for _, c := range convs {
+			tags, err := store.Tags(c.ID)
+			if err != nil {
+				return err
+			}
+			name := markdownFileName(c)
+			if err := os.WriteFile(filepath.Join(markdownDir, name), []byte(exportDocument(c, tags)), 0o644); err != nil {
+				return fmt.Errorf("write %s: %w", name, err)
+			}
+
+			preview := c.Title
+			if preview == "" {
+				preview = c.Content
+			}
+			if len(preview) > 60 {
+				preview = preview[:60] + "..."
+			}
+			preview = strings.ReplaceAll(preview, "\n", " ")
+			// Brackets would end the link text early
+			preview = strings.NewReplacer("[", "(", "]", ")").Replace(preview)
+			fmt.Fprintf(&index, "- %s [%s](%s)\n", c.CreatedAt.Format("2006-01-02"), preview, name)
+		}
+
+		if err := os.WriteFile(filepath.Join(markdownDir, "index.md"), []byte(index.String()), 0o644); err != nil {
+			return fmt.Errorf("write index: %w", err)
+		}
+
+		fmt.Printf("Exported %d conversations to %s\n", len(convs), markdownDir)
+		return nil
+	},
+}
+
+// markdownFileName names a conversation's archive file so a directory
+// listing sorts by date
+func markdownFileName(c Conversation) string {
+	return fmt.Sprintf("%s-%s.md", c.CreatedAt.Format("2006-01-02"), c.ID[:8])
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export <dir>",
+	Short: "Write every conversation to <dir>/<id>.txt as a plain-file backup",
+	Long: `Write each conversation to <dir>/<id>.txt: a front-matter header with
+its id, created_at and any title, tags and note, then its content exactly
+as stored. With --with-embeddings, <id>.embeddings.json next to it holds
+the conversation's chunks with their embeddings.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := args[0]
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		convs, err := store.List()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create dir: %w", err)
+		}
+
+		vectors := 0
+		for _, c := range convs {
+			tags, err := store.Tags(c.ID)
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(dir, c.ID+".txt")
+			if err := os.WriteFile(name, []byte(exportDocument(c, tags)), 0o644); err != nil {
+				return fmt.Errorf("write %s: %w", name, err)
+			}
+
+			if exportEmbeddings {
+				n, err := writeExportEmbeddings(store, filepath.Join(dir, c.ID+".embeddings.json"), c.ID)
+				if err != nil {
+					return err
+				}
+				vectors += n
+			}
+		}
+
+		fmt.Printf("Exported %d conversations to %s\n", len(convs), dir)
+		if exportEmbeddings {
+			fmt.Printf("Wrote %d embeddings (%d dims)\n", vectors, store.Dimension())
+		}
+		return nil
+	},
+}
+
+// exportDocument is a conversation's export or export-markdown file. Title,
+// note and tags are JSON strings, which YAML reads as quoted ones, so
+// newlines, commas, brackets or colons in them can't break the header.
+func exportDocument(c Conversation, tags []string) string {
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "---\nid: %s\ncreated_at: %s\n", c.ID, c.CreatedAt.Format(time.RFC3339))
+	if c.Title != "" {
+		fmt.Fprintf(&doc, "title: %s\n", jsonString(c.Title))
+	}
+	if len(tags) > 0 {
+		quoted := make([]string, len(tags))
+		for i, t := range tags {
+			quoted[i] = jsonString(t)
+		}
+		fmt.Fprintf(&doc, "tags: [%s]\n", strings.Join(quoted, ", "))
+	}
+	if c.Note != "" {
+		fmt.Fprintf(&doc, "note: %s\n", jsonString(c.Note))
+	}
+	doc.WriteString("---\n\n")
+	doc.WriteString(c.Content)
+	doc.WriteString("\n")
+	return doc.String()
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// exportChunk is one chunk in an .embeddings.json file; Embedding is
+// missing for chunks that failed to embed
+type exportChunk struct {
+	ID        string    `json:"id"`
+	Position  int       `json:"position"`
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+type exportEmbeddingFile struct {
+	ID string `json:"id"`
+	// Embedding is the whole-conversation embedding of databases from
+	// before chunking
+	Embedding []float32     `json:"embedding,omitempty"`
+	Chunks    []exportChunk `json:"chunks"`
+}
+
+// writeExportEmbeddings writes a conversation's embeddings to path and
+// returns how many there were
+func writeExportEmbeddings(store *Store, path, convID string) (int, error) {
+	f := exportEmbeddingFile{ID: convID, Chunks: []exportChunk{}}
+	emb, ok, err := store.GetEmbedding(convID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if ok {
+		f.Embedding = emb
+		n++
+	}
+
+	chunks, err := store.ChunksForConversation(convID)
+	if err != nil {
+		return 0, err
+	}
+	embs, err := store.ChunkEmbeddings(convID)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range chunks {
+		f.Chunks = append(f.Chunks, exportChunk{ID: c.ID, Position: c.Position, Embedding: embs[c.ID]})
+	}
+	n += len(embs)
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return 0, fmt.Errorf("write %s: %w", path, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpEmbeddings(t *testing.T) {
+	f := newFakeOllama(t)
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	uploadTexts(t, f, db,
+		strings.Repeat("worker pools drain the queue ", 40)+"\n\n"+strings.Repeat("retries back off ", 40),
+		strings.Repeat("sourdough needs a starter ", 20),
+	)
+
+	out := filepath.Join(dir, "vectors.npy")
+	if _, _, err := runCmd(t, append(f.args(db), "dump-embeddings", "--out", out)...); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	count, err := store.CountChunkEmbeddings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "\x93NUMPY\x01\x00") {
+		t.Fatalf("not an npy file: %q", data[:min(10, len(data))])
+	}
+	start := 10 + int(binary.LittleEndian.Uint16(data[8:10]))
+	if start%64 != 0 {
+		t.Errorf("data starts at %d, not on a 64-byte boundary", start)
+	}
+	if rows := (len(data) - start) / (4 * f.dim); rows != count {
+		t.Errorf("dumped %d vectors, store has %d chunk embeddings", rows, count)
+	}
+
+	mf, err := os.Open(strings.TrimSuffix(out, ".npy") + ".manifest.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	var manifest []manifestEntry
+	for sc := bufio.NewScanner(mf); sc.Scan(); {
+		var e manifestEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		manifest = append(manifest, e)
+	}
+	if len(manifest) != count {
+		t.Fatalf("manifest has %d rows, want %d", len(manifest), count)
+	}
+
+	// The last row decodes to the embedding of the chunk the manifest names
+	e := manifest[len(manifest)-1]
+	chunks, err := store.ChunksForConversation(e.ConvID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(chunks, func(c Chunk) bool { return c.ID == e.ID })
+	if i < 0 || chunks[i].Position != e.Position {
+		t.Fatalf("manifest entry %+v doesn't match a stored chunk", e)
+	}
+	got := make([]float32, f.dim)
+	row := data[start+4*f.dim*e.Row:]
+	for d := range got {
+		got[d] = math.Float32frombits(binary.LittleEndian.Uint32(row[4*d:]))
+	}
+	if want := fakeEmbedding(chunks[i].Content, f.dim); !slices.Equal(got, want) {
+		t.Errorf("row %d = %v, want %v", e.Row, got, want)
+	}
+}
+
+// frontMatter returns the key: value lines of a document's header
+func frontMatter(t *testing.T, doc string) map[string]string {
+	t.Helper()
+	header, _, ok := strings.Cut(strings.TrimPrefix(doc, "---\n"), "\n---\n")
+	if !ok || !strings.HasPrefix(doc, "---\n") {
+		t.Fatalf("no front matter in %q", doc)
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(header, "\n") {
+		k, v, _ := strings.Cut(line, ": ")
+		fields[k] = v
+	}
+	return fields
+}
+
+func TestExportMarkdown(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	convs := []Conversation{
+		{ID: "aaaaaaaa1111", Content: "worker pools [and] queues", Title: "Pools: a story", CreatedAt: day},
+		{ID: "bbbbbbbb2222", Content: "sourdough notes", CreatedAt: day.Add(24 * time.Hour)},
+	}
+	for _, c := range convs {
+		if err := store.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags := []string{"go, concurrency", "list]", "key: value"}
+	if err := store.AddTags(convs[0].ID, tags); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	out := filepath.Join(dir, "archive")
+	if _, _, err := runCmd(t, "--db", db, "export-markdown", "--dir", out); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(convs)+1 {
+		t.Errorf("archive has %d files, want one per conversation and index.md", len(entries))
+	}
+
+	index, err := os.ReadFile(filepath.Join(out, "index.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := regexp.MustCompile(`\]\(([^)]+)\)`).FindAllStringSubmatch(string(index), -1)
+	if len(links) != len(convs) {
+		t.Fatalf("index links %d files, want %d:\n%s", len(links), len(convs), index)
+	}
+	ids := map[string]map[string]string{}
+	for _, l := range links {
+		doc, err := os.ReadFile(filepath.Join(out, l[1]))
+		if err != nil {
+			t.Errorf("index links a missing file: %v", err)
+			continue
+		}
+		fm := frontMatter(t, string(doc))
+		ids[fm["id"]] = fm
+	}
+	if !strings.Contains(string(index), "[Pools: a story](2026-03-04-aaaaaaaa.md)") {
+		t.Errorf("index doesn't link the titled conversation by its title:\n%s", index)
+	}
+
+	fm, ok := ids[convs[0].ID]
+	if !ok || ids[convs[1].ID] == nil {
+		t.Fatalf("index doesn't reach both conversations: %v", ids)
+	}
+	var gotTags []string
+	if err := json.Unmarshal([]byte(fm["tags"]), &gotTags); err != nil {
+		t.Fatalf("tags %s don't parse as a quoted list: %v", fm["tags"], err)
+	}
+	slices.Sort(gotTags)
+	wantTags := []string{"go, concurrency", "key: value", "list]"}
+	if !slices.Equal(gotTags, wantTags) {
+		t.Errorf("tags = %q, want %q", gotTags, wantTags)
+	}
+	if fm["title"] != `"Pools: a story"` {
+		t.Errorf("title = %s, want it quoted", fm["title"])
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// feedbackAlpha is the EMA weight given to each new feedback signal
+	feedbackAlpha = 0.3
+	// feedbackStep is how far a bad result pushes the threshold target
+	feedbackStep = 0.05
+
+	metaLastPrime         = "last_prime"
+	metaAdaptiveThreshold = "adaptive_threshold"
+)
+
+func init() {
+	rootCmd.AddCommand(feedbackCmd)
+}
+
+// lastPrime is what feedback applies to, saved by every prime
+type lastPrime struct {
+	Query     string  `json:"query"`
+	Threshold float64 `json:"threshold"`
+	Results   int     `json:"results"`
+}
+
+func recordPrime(store *Store, query string, threshold float64, results int) error {
+	if dbReadOnly {
+		return nil
+	}
+	data, err := json.Marshal(lastPrime{Query: query, Threshold: threshold, Results: results})
+	if err != nil {
+		return err
+	}
+	return store.SetMeta(metaLastPrime, string(data))
+}
+
+// learnedThreshold returns the adaptive threshold, or def if no feedback
+// has been given yet
+func learnedThreshold(store *Store, def float64) (float64, error) {
+	v, ok, err := store.GetMeta(metaAdaptiveThreshold)
+	if err != nil || !ok {
+		return def, err
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("stored adaptive threshold %q: %w", v, err)
+	}
+	return t, nil
+}
+
+// nextThreshold moves the current threshold towards a target derived from
+// one feedback signal. Good results confirm the threshold that was used;
+// bad ones mean it was too loose if things matched, or too strict if
+// nothing did.
+func nextThreshold(current float64, p lastPrime, good bool) float64 {
+	target := p.Threshold
+	if !good {
+		if p.Results > 0 {
+			target -= feedbackStep
+		} else {
+			target += feedbackStep
+		}
+	}
+	next := (1-feedbackAlpha)*current + feedbackAlpha*target
+	return max(0.05, min(next, 1.5))
+}
+
+var feedbackCmd = &cobra.Command{
+	Use:         "feedback <good|bad>",
+	Short:       "Rate the last prime's results to tune --adaptive-threshold",
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{writesDB: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		signal := args[0]
+		if signal != "good" && signal != "bad" {
+			return fmt.Errorf("feedback must be good or bad, got %q", signal)
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		v, ok, err := store.GetMeta(metaLastPrime)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("no prime to give feedback on yet")
+		}
+		var p lastPrime
+		if err := json.Unmarshal([]byte(v), &p); err != nil {
+			return fmt.Errorf("decode last prime: %w", err)
+		}
+
+		if err := store.SaveFeedback(Feedback{
+			Query:     p.Query,
+			Threshold: p.Threshold,
+			Results:   p.Results,
+			Signal:    signal,
+			CreatedAt: time.Now(),
+		}); err != nil {
+			return err
+		}
+
+		current, err := learnedThreshold(store, p.Threshold)
+		if err != nil {
+			return err
+		}
+		next := nextThreshold(current, p, signal == "good")
+		if err := store.SetMeta(metaAdaptiveThreshold, strconv.FormatFloat(next, 'f', -1, 64)); err != nil {
+			return err
+		}
+
+		fmt.Printf("Recorded %s for %q. Adaptive threshold %.3f -> %.3f\n", signal, p.Query, current, next)
+		return nil
+	},
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNextThresholdMovesWithFeedback(t *testing.T) {
+	matched := lastPrime{Query: "q", Threshold: 0.45, Results: 3}
+	if next := nextThreshold(0.45, matched, false); next >= 0.45 {
+		t.Errorf("bad feedback on matches moved 0.45 to %v, want it stricter", next)
+	}
+	empty := lastPrime{Query: "q", Threshold: 0.45, Results: 0}
+	if next := nextThreshold(0.45, empty, false); next <= 0.45 {
+		t.Errorf("bad feedback on no matches moved 0.45 to %v, want it looser", next)
+	}
+	if next := nextThreshold(0.6, matched, true); next >= 0.6 || next <= 0.45 {
+		t.Errorf("good feedback moved 0.6 to %v, want it part way to the 0.45 used", next)
+	}
+	if next := nextThreshold(0.06, lastPrime{Threshold: 0.05, Results: 1}, false); next < 0.05 {
+		t.Errorf("threshold went below the floor: %v", next)
+	}
+}
+
+func TestFeedbackLearnsThreshold(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	learned := func() float64 {
+		t.Helper()
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		threshold, err := learnedThreshold(store, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return threshold
+	}
+	feedback := func(signal string, prime ...string) {
+		t.Helper()
+		if _, _, err := runCmd(t, append(append(f.args(db), "prime", "--adaptive-threshold"), prime...)...); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := runCmd(t, append(f.args(db), "feedback", signal)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := runCmd(t, append(f.args(db), "feedback", "good")...); err == nil {
+		t.Error("feedback before any prime succeeded")
+	}
+
+	// Matches that weren't wanted make it stricter, every time, starting
+	// from the threshold the first rated prime used
+	last := 0.99
+	for range 3 {
+		feedback("bad", "--threshold", "0.99", "worker pools")
+		got := learned()
+		if got >= last {
+			t.Fatalf("bad feedback on matches moved the threshold from %v to %v", last, got)
+		}
+		last = got
+	}
+
+	// Without --threshold, prime uses the learned one; nothing matching it
+	// and a bad rating loosen it again
+	doc := fakeEmbedding("worker pools drain the queue", f.dim)
+	unrelated := ""
+	for _, w := range strings.Fields("sourdough kayak violin tundra glacier ferment") {
+		overlap := false
+		for i, x := range fakeEmbedding(w, f.dim) {
+			overlap = overlap || x*doc[i] != 0
+		}
+		if !overlap {
+			unrelated = w
+			break
+		}
+	}
+	if unrelated == "" {
+		t.Fatal("no candidate query is orthogonal to the stored text")
+	}
+	feedback("bad", unrelated)
+	if got := learned(); got <= last {
+		t.Errorf("bad feedback on no matches moved the threshold from %v to %v", last, got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// rrfK damps the weight of top ranks in reciprocal rank fusion; 60 is the
+// value from the original RRF paper and works well without tuning
+const rrfK = 60
+
+// fuseRRF merges ranked result lists with reciprocal rank fusion: each
+// result scores the sum of 1/(rrfK+rank) over the lists it appears in.
+// Results are deduplicated by ID and keep their best distance.
+func fuseRRF(lists ...[]SearchResult) []SearchResult {
+	scores := make(map[string]float64)
+	best := make(map[string]SearchResult)
+
+	for _, list := range lists {
+		for rank, r := range list {
+			scores[r.ID] += 1.0 / float64(rrfK+rank+1)
+			if prev, ok := best[r.ID]; !ok || r.Distance < prev.Distance {
+				best[r.ID] = r
+			}
+		}
+	}
+
+	fused := make([]SearchResult, 0, len(best))
+	for _, r := range best {
+		fused = append(fused, r)
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		si, sj := scores[fused[i].ID], scores[fused[j].ID]
+		if si != sj {
+			return si > sj
+		}
+		return fused[i].Distance < fused[j].Distance
+	})
+	return fused
+}
+
+// mmrPoolFactor is how many more candidates than wanted are retrieved for
+// MMR to choose from
+const mmrPoolFactor = 3
+
+// rerankMMR picks up to limit results by maximal marginal relevance:
+// repeatedly the candidate that is closest to the query while farthest
+// from everything already picked. diversity (0 to 1) weighs the second
+// against the first, 0 being plain ranking by distance. embs holds the
+// candidates' embeddings; ones without an embedding are only picked by
+// their distance.
+func rerankMMR(results []SearchResult, embs map[string][]float32, dist func(a, b []float32) float64, limit int, diversity float64) []SearchResult {
+	remaining := append([]SearchResult(nil), results...)
+	var picked []SearchResult
+	for len(picked) < limit && len(remaining) > 0 {
+		best, bestScore := 0, math.Inf(-1)
+		for i, r := range remaining {
+			// The nearest picked chunk decides how redundant r is
+			nearest := 0.0
+			if emb, ok := embs[r.ID]; ok && len(picked) > 0 {
+				nearest = math.Inf(1)
+				for _, p := range picked {
+					if pemb, ok := embs[p.ID]; ok {
+						nearest = min(nearest, dist(emb, pemb))
+					}
+				}
+				if math.IsInf(nearest, 1) {
+					nearest = 0
+				}
+			}
+			score := diversity*nearest - (1-diversity)*r.Distance
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked = append(picked, remaining[best])
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return picked
+}
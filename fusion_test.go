@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func resultIDs(results []SearchResult) []string {
+	var ids []string
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestFuseRRFOrdering(t *testing.T) {
+	first := []SearchResult{{ID: "a", Distance: 0.1}, {ID: "b", Distance: 0.3}, {ID: "c", Distance: 0.4}}
+	second := []SearchResult{{ID: "c", Distance: 0.2}, {ID: "d", Distance: 0.25}}
+
+	fused := fuseRRF(first, second)
+	// c is in both lists; b and d tie on rank 2 and d is closer
+	if got, want := resultIDs(fused), []string{"c", "a", "d", "b"}; !slices.Equal(got, want) {
+		t.Errorf("fuseRRF order = %v, want %v", got, want)
+	}
+	for _, r := range fused {
+		if r.ID == "c" && r.Distance != 0.2 {
+			t.Errorf("c kept distance %v, want its best 0.2", r.Distance)
+		}
+	}
+}
+
+func TestMultiQuerySearchFusesVariantResults(t *testing.T) {
+	f := newFakeOllama(t)
+	setVar(t, &ollamaURL, f.URL)
+	setVar(t, &genModel, testGenModel)
+	setVar(t, &multiQuery, 3)
+	f.set(func(f *fakeOllama) { f.response = []string{"1. sourdough starter\n2. night trains"} })
+
+	store := newTestStore(t)
+	seed(t, store, "pools", "worker pools")
+	seed(t, store, "bread", "sourdough starter")
+	seed(t, store, "trains", "night trains")
+
+	embed := f.client(testEmbedModel)
+	query := "worker pools"
+	results, err := searchChunks(store, fakeEmbedding(query, f.dim), query, 10, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resultIDs(results); !slices.Equal(got, []string{chunkID("pools", 0)}) {
+		t.Fatalf("the query alone finds %v, want only pools", got)
+	}
+
+	fused, err := multiQuerySearch(context.Background(), store, embed, query, results, 10, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := resultIDs(fused)
+	for _, conv := range []string{"pools", "bread", "trains"} {
+		if !slices.Contains(got, chunkID(conv, 0)) {
+			t.Errorf("fused results %v miss %s, found only by a variant", got, conv)
+		}
+	}
+}
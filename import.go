@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	importStrict bool
+	importAtomic bool
+)
+
+func init() {
+	importJSONLCmd.Flags().BoolVar(&importStrict, "strict", false, "abort without importing anything if any line is invalid")
+	importJSONLCmd.Flags().BoolVar(&importAtomic, "atomic", false, "embed everything first, then write all conversations in one transaction")
+	importChatGPTCmd.Flags().BoolVar(&importAtomic, "atomic", false, "embed everything first, then write all conversations in one transaction")
+	importCmd.AddCommand(importJSONLCmd)
+	importCmd.AddCommand(importChatGPTCmd)
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import conversations from other formats",
+}
+
+// importRecord is one conversation to import. For JSONL each line is
+//
+//	{"content": "...", "id": "<sha256 of content>", "created_at": "<RFC3339>"}
+//
+// and only content is required.
+type importRecord struct {
+	// Where locates the record in the input for errors, e.g. "line 3"
+	Where        string
+	Conversation Conversation
+}
+
+// lineError is a validation failure for one input line
+type lineError struct {
+	Line int
+	Err  error
+}
+
+var importJSONLCmd = &cobra.Command{
+	Use:         "jsonl <file>",
+	Short:       "Import conversations from a JSONL file, one object per line",
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{writesDB: "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		records, invalid, err := readJSONL(args[0])
+		if err != nil {
+			return err
+		}
+
+		for _, e := range invalid {
+			fmt.Printf("line %d: %v\n", e.Line, e.Err)
+		}
+		if len(invalid) > 0 && importStrict {
+			return fmt.Errorf("%d invalid lines, nothing imported", len(invalid))
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ollama := NewOllama(ollamaURL, embedModel)
+		if err := ensureDimension(cmd.Context(), store, ollama); err != nil {
+			return err
+		}
+
+		if importAtomic {
+			err = importAllOrNothing(cmd.Context(), store, ollama, records)
+		} else {
+			err = importEach(cmd.Context(), store, ollama, records)
+		}
+		if err != nil {
+			return err
+		}
+		if timing != nil {
+			timing.Print()
+		}
+
+		fmt.Printf("Imported %d conversations, skipped %d invalid lines\n", len(records), len(invalid))
+		return nil
+	},
+}
+
+// readJSONL validates every line up front so a bad line is reported with
+// its line number instead of failing halfway through the import
+func readJSONL(path string) ([]importRecord, []lineError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	var records []importRecord
+	var invalid []lineError
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		conv, err := parseImportLine(scanner.Bytes())
+		if err != nil {
+			invalid = append(invalid, lineError{Line: line, Err: err})
+			continue
+		}
+		records = append(records, importRecord{Where: fmt.Sprintf("line %d", line), Conversation: conv})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read: %w", err)
+	}
+	return records, invalid, nil
+}
+
+func parseImportLine(data []byte) (Conversation, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Conversation{}, fmt.Errorf("not a JSON object: %w", err)
+	}
+
+	var conv Conversation
+	raw, ok := fields["content"]
+	if !ok {
+		return conv, fmt.Errorf("missing required field \"content\"")
+	}
+	if err := json.Unmarshal(raw, &conv.Content); err != nil {
+		return conv, fmt.Errorf("field \"content\" must be a string")
+	}
+	if conv.Content == "" {
+		return conv, fmt.Errorf("field \"content\" is empty")
+	}
+	conv.Content = normalizeText(conv.Content)
+	conv.ID = hashContent([]byte(conv.Content))
+
+	if raw, ok := fields["id"]; ok {
+		var id string
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return conv, fmt.Errorf("field \"id\" must be a string")
+		}
+		if id != conv.ID {
+			return conv, fmt.Errorf("field \"id\" doesn't match the content hash")
+		}
+	}
+
+	conv.CreatedAt = time.Now()
+	if raw, ok := fields["created_at"]; ok {
+		var ts string
+		if err := json.Unmarshal(raw, &ts); err != nil {
+			return conv, fmt.Errorf("field \"created_at\" must be a string")
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return conv, fmt.Errorf("field \"created_at\" is not RFC3339: %w", err)
+		}
+		conv.CreatedAt = t
+	}
+	return conv, nil
+}
+
+// importEach stores and embeds records one at a time like upload does
+func importEach(ctx context.Context, store *Store, ollama *Ollama, records []importRecord) error {
+	totalFailed := 0
+	for _, r := range records {
+		conv := r.Conversation
+		if err := store.Save(conv); err != nil {
+			return fmt.Errorf("%s: %w", r.Where, err)
+		}
+
+		chunks, skipped := dropShortChunks(chunkText(conv.Content, chunkOpts), minWords)
+		progressf("Importing %s: %d chunks\n", conv.ID[:8], len(chunks))
+		if skipped > 0 {
+			progressf("  skipped %d chunks under %d words\n", skipped, minWords)
+		}
+		failed, err := embedChunks(ctx, store, ollama, conv.ID, chunks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Where, err)
+		}
+		if err := indexTitle(ctx, store, ollama, conv); err != nil {
+			return fmt.Errorf("%s: %w", r.Where, err)
+		}
+		totalFailed += failed
+	}
+	if totalFailed > 0 {
+		fmt.Printf("%d chunks failed (run `memctx retry-failed` later)\n", totalFailed)
+	}
+	return nil
+}
+
+// importAllOrNothing embeds every record in memory first and only then
+// writes them all in one transaction
+func importAllOrNothing(ctx context.Context, store *Store, ollama *Ollama, records []importRecord) error {
+	items := make([]IndexedConversation, 0, len(records))
+	for _, r := range records {
+		conv := r.Conversation
+		item := IndexedConversation{Conversation: conv, EmbedModel: ollama.model, StoreRaw: storeRaw}
+
+		chunks, skipped := dropShortChunks(chunkText(conv.Content, chunkOpts), minWords)
+		progressf("Embedding %s: %d chunks\n", conv.ID[:8], len(chunks))
+		if skipped > 0 {
+			progressf("  skipped %d chunks under %d words\n", skipped, minWords)
+		}
+		embeddings, err := embedAll(ctx, store, ollama, chunks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Where, err)
+		}
+		for i, text := range chunks {
+			item.Chunks = append(item.Chunks, Chunk{ID: chunkID(conv.ID, i), ConvID: conv.ID, Content: text, Position: i})
+		}
+		item.Embeddings = embeddings
+		if chunk, ok := titleChunk(conv); ok {
+			embedding, err := embedWithRetries(ctx, ollama, chunk.Content, embedRetries)
+			if err != nil {
+				return fmt.Errorf("%s: embed title: %w", r.Where, err)
+			}
+			item.Chunks = append(item.Chunks, chunk)
+			item.Embeddings = append(item.Embeddings, embedding)
+		}
+		items = append(items, item)
+	}
+
+	start := time.Now()
+	if err := store.SaveIndexed(items); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	if timing != nil {
+		timing.write.Add(time.Since(start))
+	}
+	return nil
+}
+
+// embedAll embeds chunks in batches with the cache like embedChunks, but
+// stores only cache entries and fails on the first chunk that can't be
+// embedded instead of recording it for retry-failed
+func embedAll(ctx context.Context, store *Store, ollama *Ollama, chunks []string) ([][]float32, error) {
+	all := make([][]float32, 0, len(chunks))
+	for first := 0; first < len(chunks); first += embedBatchSize {
+		batch := chunks[first:min(first+embedBatchSize, len(chunks))]
+		inputs := make([]string, len(batch))
+		for j, text := range batch {
+			inputs[j] = embedInput(text)
+		}
+
+		embeddings, cached, err := embedCached(ctx, store, ollama, inputs)
+		if err != nil {
+			return nil, fmt.Errorf("embed chunk %d: %w", first, err)
+		}
+		for j := range embeddings {
+			if embeddings[j] == nil {
+				embeddings[j], err = embedWithRetries(ctx, ollama, inputs[j], embedRetries)
+				if err != nil {
+					return nil, fmt.Errorf("embed chunk %d: %w", first+j, err)
+				}
+			}
+			if !cached[j] {
+				if err := store.CacheEmbedding(hashContent([]byte(inputs[j])), ollama.model, embeddings[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		all = append(all, embeddings...)
+	}
+	return all, nil
+}
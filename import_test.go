@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chatGPTExport is a ChatGPT conversations.json with one single-message
+// conversation per title and text
+func chatGPTExport(t *testing.T, convs ...[2]string) string {
+	t.Helper()
+	var export []map[string]any
+	for _, c := range convs {
+		export = append(export, map[string]any{
+			"title":        c[0],
+			"create_time":  1700000000,
+			"current_node": "m",
+			"mapping": map[string]any{
+				"m": map[string]any{"message": map[string]any{
+					"author":  map[string]any{"role": "user"},
+					"content": map[string]any{"parts": []string{c[1]}},
+				}},
+			},
+		})
+	}
+	data, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, "conversations.json", string(data))
+}
+
+func TestIndexTitlesMatchesTitleOnly(t *testing.T) {
+	for _, mode := range []string{"each", "atomic"} {
+		t.Run(mode, func(t *testing.T) {
+			f := newFakeOllama(t)
+			db := filepath.Join(t.TempDir(), "test.db")
+			file := chatGPTExport(t,
+				[2]string{"Kubernetes ingress certificates", strings.Repeat("we talked about sourdough starters ", 10)},
+				[2]string{"Trip planning", strings.Repeat("night trains across the alps ", 10)},
+			)
+			args := append(f.args(db), "import", "chatgpt", file, "--index-titles")
+			if mode == "atomic" {
+				args = append(args, "--atomic")
+			}
+			if _, _, err := runCmd(t, args...); err != nil {
+				t.Fatal(err)
+			}
+
+			out, _, err := runCmd(t, append(f.args(db), "search", "--json", "--threshold", "0.5", "kubernetes ingress certificates")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var matches []jsonMatch
+			if err := json.Unmarshal([]byte(out), &matches); err != nil {
+				t.Fatalf("%v in %s", err, out)
+			}
+			if len(matches) != 1 || !matches[0].TitleMatch || matches[0].Content != "Kubernetes ingress certificates" {
+				t.Fatalf("search for the title = %+v, want only its title chunk", matches)
+			}
+
+			store, err := NewStore(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			chunks, err := store.ChunksForConversation(matches[0].ConvID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != 2 || chunks[0].Position != titlePosition || chunks[1].Position != 0 {
+				t.Errorf("chunks = %+v, want the title chunk before the content", chunks)
+			}
+		})
+	}
+}
+
+func TestTitlesAreNotIndexedByDefault(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	file := chatGPTExport(t, [2]string{"Kubernetes ingress certificates", strings.Repeat("sourdough starters ", 10)})
+	if _, _, err := runCmd(t, append(f.args(db), "import", "chatgpt", file)...); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := runCmd(t, append(f.args(db), "search", "--json", "--threshold", "0.5", "kubernetes ingress certificates")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "[]" {
+		t.Errorf("search matched without --index-titles: %s", out)
+	}
+}
+
+func TestParseImportLine(t *testing.T) {
+	conv, err := parseImportLine([]byte(`{"content": "hello", "created_at": "2024-01-02T03:04:05Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conv.ID != hashContent([]byte("hello")) || !conv.CreatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("parseImportLine = %+v", conv)
+	}
+	if _, err := parseImportLine([]byte(`{"content": "hello", "id": "` + conv.ID + `"}`)); err != nil {
+		t.Errorf("matching id rejected: %v", err)
+	}
+
+	for line, want := range map[string]string{
+		`{"content": "hello", "id": "0123abcd"}`:          `field "id" doesn't match the content hash`,
+		`{"content": "hello",`:                            "not a JSON object",
+		`["hello"]`:                                       "not a JSON object",
+		`{"id": "0123abcd"}`:                              `missing required field "content"`,
+		`{"content": 42}`:                                 `field "content" must be a string`,
+		`{"content": ""}`:                                 `field "content" is empty`,
+		`{"content": "hello", "created_at": "yesterday"}`: `field "created_at" is not RFC3339`,
+	} {
+		if _, err := parseImportLine([]byte(line)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseImportLine(%s) = %v, want %q", line, err, want)
+		}
+	}
+}
+
+// jsonlFile writes one {"content": ...} line per text, and the raw lines
+// as they are
+func jsonlFile(t *testing.T, texts []string, raw ...string) string {
+	t.Helper()
+	var lines []string
+	for _, text := range texts {
+		data, err := json.Marshal(map[string]string{"content": text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data))
+	}
+	return writeFile(t, "convs.jsonl", strings.Join(append(lines, raw...), "\n")+"\n")
+}
+
+func TestImportJSONLSkipsMalformedLine(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	file := jsonlFile(t, []string{"worker pools drain the queue", "night trains across the alps"}, `{"content": "cut off`)
+
+	out, _, err := runCmd(t, append(f.args(db), "import", "jsonl", file)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "line 3: not a JSON object") || !strings.Contains(out, "Imported 2 conversations, skipped 1 invalid lines") {
+		t.Errorf("import output:\n%s", out)
+	}
+
+	_, _, err = runCmd(t, append(f.args(filepath.Join(t.TempDir(), "strict.db")), "import", "jsonl", "--strict", file)...)
+	if err == nil || !strings.Contains(err.Error(), "1 invalid lines, nothing imported") {
+		t.Errorf("import --strict = %v, want it to abort", err)
+	}
+}
+
+func TestImportUsesUploadChunkPipeline(t *testing.T) {
+	first := strings.TrimSpace(strings.Repeat("alpha bravo ", 67))
+	second := strings.TrimSpace(strings.Repeat("charlie delta ", 58))
+	shared := strings.TrimSpace(strings.Repeat("echo foxtrot ", 62))
+	texts := []string{first + "\n\n" + shared + "\n\nThanks!", second + "\n\n" + shared}
+
+	for _, mode := range []string{"each", "atomic"} {
+		t.Run(mode, func(t *testing.T) {
+			f := newFakeOllama(t)
+			db := filepath.Join(t.TempDir(), "test.db")
+			args := append(f.args(db), "import", "jsonl", jsonlFile(t, texts), "--min-words", "2", "--store-raw-embedding")
+			if mode == "atomic" {
+				args = append(args, "--atomic")
+			}
+			if _, _, err := runCmd(t, args...); err != nil {
+				t.Fatal(err)
+			}
+
+			requests, inputs := f.embedCalls()
+			if n := strings.Count(strings.Join(inputs, "\x00"), shared); n != 1 {
+				t.Errorf("the shared paragraph was embedded %d times, want once and then cached", n)
+			}
+			// A dimension probe, then one batch per conversation
+			if requests > 1+len(texts) {
+				t.Errorf("%d embed requests for %d conversations, want their chunks batched", requests, len(texts))
+			}
+
+			store, err := NewStore(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			for i, text := range texts {
+				id := hashContent([]byte(normalizeText(text)))
+				chunks, err := store.ChunksForConversation(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(chunks) != 2 {
+					t.Errorf("conversation %d has %d chunks, want 2 with \"Thanks!\" under --min-words", i, len(chunks))
+				}
+				for _, c := range chunks {
+					if _, ok, err := store.RawEmbedding(c.ID); err != nil || !ok {
+						t.Errorf("chunk %s has no raw embedding: %v", c.ID, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestContextMetadataHeadersInPrompt(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	file := chatGPTExport(t,
+		[2]string{"Pool sizing", strings.Repeat("worker pools drain the queue ", 10)},
+		[2]string{"Pool retries", strings.Repeat("worker pools retry the queue ", 10)},
+	)
+	if _, _, err := runCmd(t, append(f.args(db), "import", "chatgpt", file)...); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convs, err := store.List()
+	store.Close()
+	if err != nil || len(convs) != 2 {
+		t.Fatalf("imported %d conversations (%v), want 2", len(convs), err)
+	}
+
+	prime := append(f.args(db), "prime", "--threshold", "0.99", "worker pools")
+	if _, _, err := runCmd(t, append(prime, "--context-include-metadata")...); err != nil {
+		t.Fatal(err)
+	}
+	prompts := f.generatePrompts()
+	prompt := prompts[len(prompts)-1]
+	if !strings.Contains(prompt, "Each excerpt starts with a [source: id, date] line") {
+		t.Error("prompt doesn't explain the source headers")
+	}
+	for _, c := range convs {
+		header := "[source: " + c.ID[:8] + ", " + c.CreatedAt.Format("2006-01-02") + ", \"" + c.Title + "\"]\n"
+		if !strings.Contains(prompt, header+c.Content[:30]) {
+			t.Errorf("prompt has no %q header before its excerpt:\n%s", header, prompt)
+		}
+	}
+
+	if _, _, err := runCmd(t, prime...); err != nil {
+		t.Fatal(err)
+	}
+	prompts = f.generatePrompts()
+	if strings.Contains(prompts[len(prompts)-1], "[source:") {
+		t.Error("source headers added without --context-include-metadata")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+var (
+	jsonOutput bool
+	jsonPretty bool
+)
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "print results as JSON (list, search, prime, debug, stats)")
+	rootCmd.PersistentFlags().BoolVar(&jsonPretty, "json-pretty", false, "like --json, but indented for reading")
+}
+
+// writeJSON prints v to stdout as one line of JSON, or indented with
+// --json-pretty
+func writeJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	if jsonPretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
+
+type jsonListItem struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Preview   string    `json:"preview"`
+	Tags      []string  `json:"tags,omitempty"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// jsonMatch is one search result. Similarity is a percentage, like the
+// human output. Keyword results have a KeywordScore instead.
+type jsonMatch struct {
+	Distance     float64 `json:"distance"`
+	Similarity   float64 `json:"similarity"`
+	KeywordScore float64 `json:"keyword_score,omitempty"`
+	ConvID       string  `json:"conv_id"`
+	Content      string  `json:"content"`
+	// TitleMatch is set when the match is a conversation's title, indexed
+	// with --index-titles, rather than a chunk of its content
+	TitleMatch bool `json:"title_match,omitempty"`
+	// Breakdown is set by search --score-breakdown
+	Breakdown *jsonBreakdown `json:"score_breakdown,omitempty"`
+}
+
+func newJSONMatch(r SearchResult) jsonMatch {
+	if r.KeywordScore > 0 {
+		return jsonMatch{KeywordScore: r.KeywordScore, ConvID: r.ConvID, Content: r.Content, TitleMatch: isTitleChunk(r.ID)}
+	}
+	return jsonMatch{
+		Distance:   r.Distance,
+		Similarity: similarity(r.Distance),
+		ConvID:     r.ConvID,
+		Content:    r.Content,
+		TitleMatch: isTitleChunk(r.ID),
+	}
+}
+
+// jsonBreakdown explains a hybrid result's rank: Fused is
+// VectorContribution + KeywordContribution, each side's 0..1 score times
+// its weight
+type jsonBreakdown struct {
+	Similarity          float64 `json:"similarity"`
+	KeywordScore        float64 `json:"keyword_score"`
+	VectorNorm          float64 `json:"vector_norm"`
+	KeywordNorm         float64 `json:"keyword_norm"`
+	VectorContribution  float64 `json:"vector_contribution"`
+	KeywordContribution float64 `json:"keyword_contribution"`
+	Fused               float64 `json:"fused"`
+	Rank                int     `json:"rank"`
+}
+
+func newJSONBreakdown(r SearchResult) *jsonBreakdown {
+	h := r.Hybrid
+	if h == nil {
+		return nil
+	}
+	return &jsonBreakdown{
+		Similarity:          similarity(r.Distance),
+		KeywordScore:        h.Keyword,
+		VectorNorm:          h.VectorNorm,
+		KeywordNorm:         h.KeywordNorm,
+		VectorContribution:  hybridAlpha * h.VectorNorm,
+		KeywordContribution: (1 - hybridAlpha) * h.KeywordNorm,
+		Fused:               h.Fused,
+		Rank:                h.Rank,
+	}
+}
+
+// jsonGroup is one conversation of search --group and its matching chunks,
+// best first
+type jsonGroup struct {
+	Conversation jsonGroupConversation `json:"conversation"`
+	Chunks       []jsonMatch           `json:"chunks"`
+}
+
+type jsonGroupConversation struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title,omitempty"`
+}
+
+type jsonDebug struct {
+	Query         string      `json:"query"`
+	Chunks        []jsonMatch `json:"chunks"`
+	Conversations []jsonMatch `json:"conversations"`
+}
+
+// jsonPrime is prime's result. Context is the synthesized context, or the
+// retrieved excerpts joined when Synthesized is false.
+type jsonPrime struct {
+	Intent      string      `json:"intent"`
+	Threshold   float64     `json:"threshold"`
+	Matches     []jsonMatch `json:"matches"`
+	Context     string      `json:"context"`
+	Synthesized bool        `json:"synthesized"`
+	Interrupted bool        `json:"interrupted,omitempty"`
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONCompactAndPretty(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20), strings.Repeat("night trains across the alps ", 20))
+
+	for _, args := range [][]string{
+		{"list"},
+		{"search", "--threshold", "0.99", "worker pools"},
+		{"prime", "--threshold", "0.99", "worker pools"},
+		{"stats"},
+	} {
+		run := func(flag string) any {
+			t.Helper()
+			out, _, err := runCmd(t, append(append(f.args(db), flag), args...)...)
+			if err != nil {
+				t.Fatalf("%s %s: %v", args[0], flag, err)
+			}
+			if flag == "--json" && strings.Count(out, "\n") != 1 {
+				t.Errorf("%s --json isn't a single line:\n%s", args[0], out)
+			}
+			if flag == "--json-pretty" && !strings.Contains(out, "\n  ") {
+				t.Errorf("%s --json-pretty isn't indented:\n%s", args[0], out)
+			}
+			var v any
+			if err := json.Unmarshal([]byte(out), &v); err != nil {
+				t.Fatalf("%s %s: %v in %s", args[0], flag, err, out)
+			}
+			return v
+		}
+		if compact, pretty := run("--json"), run("--json-pretty"); !reflect.DeepEqual(compact, pretty) {
+			t.Errorf("%s: --json and --json-pretty differ:\n%v\n%v", args[0], compact, pretty)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// How much commands print besides their results, set by --quiet and
+// --verbose
+const (
+	levelQuiet = iota
+	levelNormal
+	levelVerbose
+)
+
+var (
+	logLevel   = levelNormal
+	quietLog   bool
+	verboseLog bool
+)
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&quietLog, "quiet", false, "print only results, final summaries, warnings and errors, not per-chunk progress")
+	rootCmd.PersistentFlags().BoolVar(&verboseLog, "verbose", false, "also print each Ollama request and how long searches and requests took (on stderr)")
+}
+
+// setLogLevel applies --quiet and --verbose
+func setLogLevel() error {
+	switch {
+	case quietLog && verboseLog:
+		return errors.New("--quiet and --verbose can't be used together")
+	case quietLog:
+		logLevel = levelQuiet
+	case verboseLog:
+		logLevel = levelVerbose
+	default:
+		logLevel = levelNormal
+	}
+	return nil
+}
+
+// progressf prints a progress line, like "chunk 3: 512 chars", unless
+// --quiet is set
+func progressf(format string, args ...any) {
+	if logLevel >= levelNormal {
+		fmt.Printf(format, args...)
+	}
+}
+
+// verbosef prints detail for --verbose on stderr, so it never mixes with
+// results on stdout
+func verbosef(format string, args ...any) {
+	if logLevel >= levelVerbose {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
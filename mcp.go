@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(mcpCmd)
+}
+
+var mcpCmd = &cobra.Command{
+	Use:   "mcp",
+	Short: "Serve search and prime as MCP tools over stdio",
+	Long: `Speak the Model Context Protocol on stdin/stdout so MCP clients such as
+Claude Desktop can use memctx directly. Two tools are offered:
+
+  search_memory(query, k, threshold)   the matching chunks, like search
+  prime_context(intent, k, threshold)  a synthesized context, like prime
+
+To register it with a client, give the client this command, e.g.
+{"command": "memctx", "args": ["mcp"]}. Logs go to stderr.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		s := &mcpServer{store: store, embed: NewOllama(ollamaURL, embedModel), gen: NewOllama(ollamaURL, genModel)}
+		if err := ensureDimension(cmd.Context(), store, s.embed); err != nil {
+			return err
+		}
+		if err := warnMixedModels(store, s.embed); err != nil {
+			return err
+		}
+		return s.serve(cmd.Context(), os.Stdin, os.Stdout)
+	},
+}
+
+// mcpProtocolVersion is offered to clients that ask for a version this
+// server doesn't know
+const mcpProtocolVersion = "2025-06-18"
+
+var mcpProtocolVersions = map[string]bool{"2024-11-05": true, "2025-03-26": true, mcpProtocolVersion: true}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+// rpcMessage is a JSON-RPC request, or a notification when ID is empty
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// mcpTool describes a tool for tools/list
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// mcpToolResult is a tools/call result. Tool failures are reported here
+// with IsError rather than as JSON-RPC errors, so the model sees them.
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpSearchArgs are the arguments of both tools; Query is named intent
+// for prime_context
+type mcpSearchArgs struct {
+	Query     string  `json:"query"`
+	Intent    string  `json:"intent"`
+	K         int     `json:"k"`
+	Threshold float64 `json:"threshold"`
+}
+
+// mcpServer answers one client over a single stream. Requests are handled
+// one at a time, in order.
+type mcpServer struct {
+	store *Store
+	embed *Ollama
+	gen   *Ollama
+}
+
+// serve reads newline-delimited JSON-RPC messages from r until it is
+// closed or ctx is cancelled, writing responses to w
+func (s *mcpServer) serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for ctx.Err() == nil {
+		var msg rpcMessage
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// The stream can't be resynchronized after malformed JSON
+			enc.Encode(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			return fmt.Errorf("read request: %w", err)
+		}
+
+		result, err := s.handle(ctx, msg)
+		if len(msg.ID) == 0 {
+			// Notifications get no response
+			continue
+		}
+		resp := rpcResponse{JSONRPC: "2.0", ID: msg.ID, Result: result}
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+			}
+			resp.Result, resp.Error = nil, rerr
+			log.Printf("%s: %v", msg.Method, err)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *mcpServer) handle(ctx context.Context, msg rpcMessage) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		version := params.ProtocolVersion
+		if !mcpProtocolVersions[version] {
+			version = mcpProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]string{"name": "memctx", "version": buildVersion()},
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpTools()}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, fmt.Errorf("tools/call params: %w", err)
+		}
+		return s.callTool(ctx, params.Name, params.Arguments)
+	}
+	if strings.HasPrefix(msg.Method, "notifications/") {
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q", msg.Method)}
+}
+
+func mcpTools() []mcpTool {
+	schema := func(textArg, textDesc string) map[string]any {
+		return map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				textArg:     map[string]any{"type": "string", "description": textDesc},
+				"k":         map[string]any{"type": "integer", "description": "maximum number of chunks to retrieve (default 10)", "minimum": 1},
+				"threshold": map[string]any{"type": "number", "description": fmt.Sprintf("maximum distance of a match (default %g; lower is stricter)", defaultThreshold)},
+			},
+			"required": []string{textArg},
+		}
+	}
+	return []mcpTool{
+		{
+			Name:        "search_memory",
+			Description: "Search the user's stored past LLM conversations and return the most relevant excerpts verbatim, with their similarity and conversation ID.",
+			InputSchema: schema("query", "what to look for"),
+		},
+		{
+			Name:        "prime_context",
+			Description: "Build a short context summary from the user's stored past LLM conversations that is relevant to what they are about to work on.",
+			InputSchema: schema("intent", "what the user is about to work on"),
+		},
+	}
+}
+
+func (s *mcpServer) callTool(ctx context.Context, name string, rawArgs json.RawMessage) (any, error) {
+	args := mcpSearchArgs{K: 10, Threshold: defaultThreshold}
+	if len(rawArgs) > 0 {
+		if err := json.Unmarshal(rawArgs, &args); err != nil {
+			return nil, fmt.Errorf("%s arguments: %w", name, err)
+		}
+	}
+
+	var text string
+	var err error
+	switch name {
+	case "search_memory":
+		text, err = s.searchMemory(ctx, args)
+	case "prime_context":
+		args.Query = args.Intent
+		text, err = s.primeContext(ctx, args)
+	default:
+		return nil, fmt.Errorf("unknown tool %q", name)
+	}
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: text}}}, nil
+}
+
+func checkToolArgs(args mcpSearchArgs) (string, error) {
+	query, err := requireQuery(args.Query)
+	if err != nil {
+		return "", err
+	}
+	if args.K < 1 {
+		return "", errors.New("k must be at least 1")
+	}
+	if args.Threshold <= 0 {
+		return "", errors.New("threshold must be positive")
+	}
+	return query, nil
+}
+
+func (s *mcpServer) searchMemory(ctx context.Context, args mcpSearchArgs) (string, error) {
+	query, err := checkToolArgs(args)
+	if err != nil {
+		return "", err
+	}
+	results, err := searchStore(ctx, s.store, s.embed, query, args.K, args.Threshold)
+	if err != nil {
+		return "", err
+	}
+	if err := markReturned(s.store, results); err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No stored conversations match.", nil
+	}
+
+	var b strings.Builder
+	for i, r := range results {
+		fmt.Fprintf(&b, "[%d] %s%% similar, from conversation %s\n", i+1, fixed(similarity(r.Distance), 0), shortID(r.ConvID))
+		b.WriteString(strings.TrimSpace(r.Content))
+		b.WriteString("\n\n")
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func (s *mcpServer) primeContext(ctx context.Context, args mcpSearchArgs) (string, error) {
+	intent, err := checkToolArgs(args)
+	if err != nil {
+		return "", err
+	}
+	result, err := primeStore(ctx, s.store, s.embed, s.gen, intent, args.K, args.Threshold)
+	if err != nil {
+		return "", err
+	}
+	// No matches, or --filter-irrelevant rejected them all
+	if len(result.Matches) == 0 || result.Context == "" {
+		return "No stored conversations are relevant to this.", nil
+	}
+	return result.Context, nil
+}
+
+// buildVersion is the module version memctx was installed at, if known
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateTo  string
+	migrateDim int
+)
+
+func init() {
+	rootCmd.AddCommand(migrateDBCmd)
+	migrateDBCmd.Flags().StringVar(&migrateTo, "to", "", "path of the new database (must not exist yet)")
+	migrateDBCmd.Flags().IntVar(&migrateDim, "dim", 0, "embedding dimension the target must have; --embed-model has to produce it (0 = whatever it produces)")
+	migrateDBCmd.MarkFlagRequired("to")
+}
+
+var migrateDBCmd = &cobra.Command{
+	Use:   "migrate-db --to <new.db>",
+	Short: "Copy the database into a new file, re-embedding if the model changed",
+	Long: `Copy every conversation, with its tags and note, from --db into a new
+database file. Chunk embeddings are copied as they are when --embed-model
+is the model that built them and produces the same dimension; otherwise
+each conversation is re-chunked and re-embedded. --metric and --normalize
+set the new database's distance metric and normalization (the source's by
+default). The source is opened read-only and left untouched. Counts are
+checked at the end.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(migrateTo); err == nil {
+			return fmt.Errorf("%s already exists, migrate-db only writes to a new file", migrateTo)
+		}
+
+		src, err := NewReadOnlyStore(dbPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		ollama := NewOllama(ollamaURL, embedModel)
+		dim, err := ollama.Dimension(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if migrateDim > 0 && dim != migrateDim {
+			return fmt.Errorf("%s produces %d-dim embeddings, not %d; pick a model of that dimension with --embed-model", ollama.model, dim, migrateDim)
+		}
+
+		models, err := src.EmbedModels()
+		if err != nil {
+			return err
+		}
+		_, sameModel := models[ollama.model]
+		copyEmbeddings := sameModel && len(models) == 1 && src.Dimension() == dim
+		if copyEmbeddings {
+			fmt.Printf("Copying %s embeddings (%d dims)\n", ollama.model, dim)
+		} else {
+			fmt.Printf("Re-embedding with %s (%d dims)\n", ollama.model, dim)
+		}
+
+		dst, err := NewStore(migrateTo)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		// --metric picks the target's metric, which otherwise stays the same
+		metric := src.Metric()
+		if cmd.Flags().Changed("metric") {
+			metric = distanceMetric
+		}
+		if err := dst.SetMetric(metric); err != nil {
+			return err
+		}
+		// Likewise --normalize; copied embeddings are normalized as they
+		// are saved
+		normalize := src.Normalizes()
+		if cmd.Flags().Changed("normalize") {
+			normalize = normalizeEmbs
+		}
+		if err := dst.SetNormalize(normalize); err != nil {
+			return err
+		}
+		if err := dst.SetMeta(metaVecIndexType, vecIndexFlat); err != nil {
+			return err
+		}
+
+		convs, err := src.List()
+		if err != nil {
+			return err
+		}
+		copied, reembedded, failed := 0, 0, 0
+		for _, c := range convs {
+			reembed, n, err := migrateConversation(cmd.Context(), src, dst, ollama, c.ID, copyEmbeddings)
+			if err != nil {
+				return fmt.Errorf("migrate %s: %w", shortID(c.ID), err)
+			}
+			if reembed {
+				reembedded++
+				failed += n
+			} else {
+				copied++
+			}
+		}
+
+		return verifyMigration(src, dst, len(convs), copied, reembedded, failed)
+	},
+}
+
+// migrateConversation writes one conversation to dst, reporting whether it
+// was re-embedded and how many chunks failed to embed. It is re-embedded
+// when copyEmbeddings is off, or when some of its chunks never got an
+// embedding in the source.
+func migrateConversation(ctx context.Context, src, dst *Store, ollama *Ollama, id string, copyEmbeddings bool) (bool, int, error) {
+	conv, err := src.Get(id)
+	if err != nil {
+		return false, 0, err
+	}
+	tags, err := src.Tags(id)
+	if err != nil {
+		return false, 0, err
+	}
+
+	var item *IndexedConversation
+	if copyEmbeddings {
+		chunks, err := src.ChunksForConversation(id)
+		if err != nil {
+			return false, 0, err
+		}
+		embs, err := src.ChunkEmbeddings(id)
+		if err != nil {
+			return false, 0, err
+		}
+		item = &IndexedConversation{Conversation: conv, EmbedModel: ollama.model, Chunks: chunks}
+		for _, c := range chunks {
+			emb, ok := embs[c.ID]
+			if !ok {
+				item = nil
+				break
+			}
+			item.Embeddings = append(item.Embeddings, emb)
+		}
+		if len(chunks) == 0 {
+			item = nil
+		}
+	}
+
+	reembed, failed := item == nil, 0
+	if !reembed {
+		if err := dst.SaveIndexed([]IndexedConversation{*item}); err != nil {
+			return false, 0, err
+		}
+	} else {
+		if err := dst.Save(conv); err != nil {
+			return false, 0, err
+		}
+		chunks := chunkText(conv.Content, chunkOpts)
+		progressf("Re-embedding %s: %d chunks\n", shortID(id), len(chunks))
+		if failed, err = embedChunks(ctx, dst, ollama, id, chunks); err != nil {
+			return false, 0, err
+		}
+	}
+
+	if err := dst.AddTags(id, tags); err != nil {
+		return false, 0, err
+	}
+	if conv.Note != "" {
+		if err := dst.SetNote(id, conv.Note); err != nil {
+			return false, 0, err
+		}
+	}
+	return reembed, failed, nil
+}
+
+// verifyMigration checks that every conversation arrived and reports
+// what was moved
+func verifyMigration(src, dst *Store, want, copied, reembedded, failed int) error {
+	got, err := dst.CountConversations()
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("verify: %s has %d conversations, expected %d", migrateTo, got, want)
+	}
+	srcChunks, err := src.CountChunks()
+	if err != nil {
+		return err
+	}
+	dstChunks, err := dst.CountChunks()
+	if err != nil {
+		return err
+	}
+	if reembedded == 0 && dstChunks != srcChunks {
+		return fmt.Errorf("verify: %s has %d chunks, expected %d", migrateTo, dstChunks, srcChunks)
+	}
+
+	fmt.Printf("Migrated %d conversations to %s (%d with copied embeddings, %d re-embedded), %d chunks\n", got, migrateTo, copied, reembedded, dstChunks)
+	if failed > 0 {
+		fmt.Printf("%d chunks failed to embed (run `memctx --db %s retry-failed`)\n", failed, migrateTo)
+	}
+	return nil
+}
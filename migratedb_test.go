@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDBToNewDimension(t *testing.T) {
+	f := newFakeOllama(t)
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.db"), filepath.Join(dir, "dst.db")
+	uploadTexts(t, f, src,
+		strings.Repeat("worker pools drain the queue ", 20),
+		strings.Repeat("night trains across the alps ", 20),
+	)
+
+	// The model now makes 8-dim embeddings
+	f.set(func(f *fakeOllama) { f.dim = 8 })
+	if _, _, err := runCmd(t, append(f.args(src), "migrate-db", "--to", dst, "--dim", "16")...); err == nil || !strings.Contains(err.Error(), "produces 8-dim embeddings, not 16") {
+		t.Fatalf("migrate-db --dim 16 = %v, want the model's dimension refused", err)
+	}
+	out, _, err := runCmd(t, append(f.args(src), "migrate-db", "--to", dst, "--dim", "8")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Migrated 2 conversations") || !strings.Contains(out, "2 re-embedded") {
+		t.Errorf("migrate-db output:\n%s", out)
+	}
+
+	for path, dim := range map[string]int{src: 16, dst: 8} {
+		store, err := NewStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		convs, err := store.List()
+		if err != nil || len(convs) != 2 || store.Dimension() != dim {
+			t.Errorf("%s: %d conversations (%v) of %d dims, want 2 of %d", filepath.Base(path), len(convs), err, store.Dimension(), dim)
+		}
+		store.Close()
+	}
+
+	out, _, err = runCmd(t, append(f.args(dst), "search", "--json", "--threshold", "0.5", "night trains")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matches []jsonMatch
+	if err := json.Unmarshal([]byte(out), &matches); err != nil || len(matches) == 0 || !strings.Contains(matches[0].Content, "night trains") {
+		t.Errorf("search on the target = %q (%v), want the migrated conversation", out, err)
+	}
+
+	if _, _, err := runCmd(t, append(f.args(src), "migrate-db", "--to", dst)...); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("migrate-db onto an existing file = %v, want it refused", err)
+	}
+}
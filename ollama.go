@@ -2,40 +2,263 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Ollama struct {
 	baseURL string
 	model   string
+
+	// embedClient serves embedding and model-list requests,
+	// generateClient serves generation
+	embedClient    *http.Client
+	generateClient *http.Client
+
+	// attempts is how many times a request is tried when Ollama is
+	// unreachable or answers 5xx, waiting retryDelay before the first
+	// retry and doubling it after each
+	attempts   int
+	retryDelay time.Duration
+
+	dimWarning sync.Once
+}
+
+// ollamaSlots limits concurrent requests to Ollama across the whole
+// process, whichever operation issues them. nil means no limit.
+var ollamaSlots chan struct{}
+
+// SetMaxParallelOllama caps in-flight Ollama requests at n (0 = no cap).
+// Call it before any requests are made.
+func SetMaxParallelOllama(n int) {
+	if n <= 0 {
+		ollamaSlots = nil
+		return
+	}
+	ollamaSlots = make(chan struct{}, n)
+}
+
+// acquireSlot blocks until a request slot is free or ctx is done, and
+// returns the function that frees it
+func acquireSlot(ctx context.Context) (func(), error) {
+	slots := ollamaSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Default request timeouts for new clients. Generation can take minutes
+// where embedding takes milliseconds, so each has its own.
+var (
+	defaultEmbedTimeout    = 30 * time.Second
+	defaultGenerateTimeout = 5 * time.Minute
+)
+
+// SetOllamaTimeouts sets the default per-request timeouts for embedding
+// and generation (0 = no timeout) of clients created afterwards. The
+// generation timeout covers the whole streamed response.
+func SetOllamaTimeouts(embed, generate time.Duration) {
+	defaultEmbedTimeout = embed
+	defaultGenerateTimeout = generate
+}
+
+// errRetryBudget means an operation used up its --retry-budget
+var errRetryBudget = errors.New("retry budget exhausted")
+
+// retryBudget caps retries across a whole operation, shared by every
+// client. Zero means unlimited.
+var retryBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+// SetRetryBudget caps the total retries of the current operation (0 = no
+// cap) and resets the count
+func SetRetryBudget(n int) {
+	retryBudget.mu.Lock()
+	defer retryBudget.mu.Unlock()
+	retryBudget.limit = n
+	retryBudget.used = 0
+}
+
+// spendRetry takes one retry from the budget, failing once it is used up
+func spendRetry() error {
+	retryBudget.mu.Lock()
+	defer retryBudget.mu.Unlock()
+	if retryBudget.limit > 0 && retryBudget.used >= retryBudget.limit {
+		return fmt.Errorf("%w: Ollama appears unstable, aborting after %d retries (raise --retry-budget to keep going)", errRetryBudget, retryBudget.used)
+	}
+	retryBudget.used++
+	return nil
+}
+
+// knownDims maps embedding models (without tag) to their output dimension
+var knownDims = map[string]int{
+	"nomic-embed-text":       768,
+	"mxbai-embed-large":      1024,
+	"all-minilm":             384,
+	"snowflake-arctic-embed": 1024,
+	"bge-m3":                 1024,
+	"bge-large":              1024,
+}
+
+// knownDim looks up the model in knownDims, ignoring any ":tag" suffix
+func knownDim(model string) (int, bool) {
+	name, _, _ := strings.Cut(model, ":")
+	dim, ok := knownDims[name]
+	return dim, ok
 }
 
-func NewOllama(baseURL, model string) *Ollama {
-	return &Ollama{baseURL: baseURL, model: model}
+// Dimension returns the length of the model's embeddings. Known models
+// come from the registry, anything else is probed with a short embed call.
+func (o *Ollama) Dimension(ctx context.Context) (int, error) {
+	if dim, ok := knownDim(o.model); ok {
+		return dim, nil
+	}
+	emb, err := o.Embed(ctx, "dimension probe")
+	if err != nil {
+		return 0, fmt.Errorf("probe %s dimension: %w", o.model, err)
+	}
+	return len(emb), nil
+}
+
+// OllamaOption configures an Ollama client
+type OllamaOption func(*Ollama)
+
+// WithRetry sets how many attempts each request gets and the delay before
+// the first retry. Attempts below 1 mean a single try.
+func WithRetry(attempts int, baseDelay time.Duration) OllamaOption {
+	return func(o *Ollama) {
+		o.attempts = max(attempts, 1)
+		o.retryDelay = baseDelay
+	}
+}
+
+// WithTimeouts sets the client's embedding and generation timeouts
+// (0 = no timeout) instead of the defaults
+func WithTimeouts(embed, generate time.Duration) OllamaOption {
+	return func(o *Ollama) {
+		o.embedClient = &http.Client{Timeout: embed}
+		o.generateClient = &http.Client{Timeout: generate}
+	}
+}
+
+func NewOllama(baseURL, model string, opts ...OllamaOption) *Ollama {
+	o := &Ollama{
+		baseURL:        baseURL,
+		model:          model,
+		embedClient:    &http.Client{Timeout: defaultEmbedTimeout},
+		generateClient: &http.Client{Timeout: defaultGenerateTimeout},
+		attempts:       3,
+		retryDelay:     500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// do sends a request, retrying connection errors and 5xx responses, which
+// Ollama gives while it is still loading a model. 4xx responses are
+// returned as-is. On success or a final 5xx the caller owns resp.Body.
+func (o *Ollama) do(ctx context.Context, client *http.Client, method, path string, body []byte) (*http.Response, error) {
+	delay := o.retryDelay
+	for attempt := 1; ; attempt++ {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, o.baseURL+path, r)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			verbosef("ollama %s %s (%s): %v after %s\n", method, path, o.model, err, time.Since(start).Round(time.Millisecond))
+		} else {
+			verbosef("ollama %s %s (%s): %d in %s\n", method, path, o.model, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+		}
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= o.attempts || ctx.Err() != nil {
+			if err != nil {
+				return nil, fmt.Errorf("ollama request: %w", err)
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := spendRetry(); err != nil {
+			return nil, err
+		}
+		verbosef("ollama %s %s: retrying in %s (attempt %d of %d)\n", method, path, delay, attempt+1, o.attempts)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("ollama request: %w", ctx.Err())
+		}
+		delay *= 2
+	}
 }
 
 type embedRequest struct {
-	Model string `json:"model"`
-	Input string `json:"input"`
+	Model string   `json:"model"`
+	Input []string `json:"input"`
 }
 
 type embedResponse struct {
 	Embeddings [][]float32 `json:"embeddings"`
 }
 
-func (o *Ollama) Embed(text string) ([]float32, error) {
-	req := embedRequest{Model: o.model, Input: text}
+func (o *Ollama) Embed(ctx context.Context, text string) ([]float32, error) {
+	embs, err := o.EmbedBatch(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return embs[0], nil
+}
+
+// EmbedBatch embeds several texts in one request, returning their
+// embeddings in the same order
+func (o *Ollama) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	req := embedRequest{Model: o.model, Input: texts}
 	body, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := http.Post(o.baseURL+"/api/embed", "application/json", bytes.NewReader(body))
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := o.do(ctx, o.embedClient, http.MethodPost, "/api/embed", body)
 	if err != nil {
-		return nil, fmt.Errorf("ollama request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -49,33 +272,58 @@ func (o *Ollama) Embed(text string) ([]float32, error) {
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	if len(result.Embeddings) == 0 {
-		return nil, fmt.Errorf("no embeddings returned")
+	if len(result.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("ollama returned %d embeddings for %d inputs", len(result.Embeddings), len(texts))
 	}
 
-	return result.Embeddings[0], nil
+	for _, emb := range result.Embeddings {
+		if dim, ok := knownDim(o.model); ok && len(emb) != dim {
+			o.dimWarning.Do(func() {
+				fmt.Fprintf(os.Stderr, "warning: %s returned %d dims, expected %d (has the model changed?)\n", o.model, len(emb), dim)
+			})
+		}
+	}
+	return result.Embeddings, nil
 }
 
 type generateRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
+	Model  string   `json:"model"`
+	Prompt string   `json:"prompt"`
+	Stream bool     `json:"stream"`
+	Images [][]byte `json:"images,omitempty"` // base64-encoded by encoding/json
 }
 
 type generateResponse struct {
 	Response string `json:"response"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error"`
+}
+
+func (o *Ollama) Generate(ctx context.Context, prompt string) (string, error) {
+	return o.generate(ctx, generateRequest{Model: o.model, Prompt: prompt})
 }
 
-func (o *Ollama) Generate(prompt string) (string, error) {
-	req := generateRequest{Model: o.model, Prompt: prompt, Stream: false}
+// Describe asks a multimodal model to describe an image
+func (o *Ollama) Describe(ctx context.Context, prompt string, image []byte) (string, error) {
+	return o.generate(ctx, generateRequest{Model: o.model, Prompt: prompt, Images: [][]byte{image}})
+}
+
+// generate sends a non-streaming generate request
+func (o *Ollama) generate(ctx context.Context, req generateRequest) (string, error) {
 	body, err := json.Marshal(req)
 	if err != nil {
 		return "", err
 	}
 
-	resp, err := http.Post(o.baseURL+"/api/generate", "application/json", bytes.NewReader(body))
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	resp, err := o.do(ctx, o.generateClient, http.MethodPost, "/api/generate", body)
 	if err != nil {
-		return "", fmt.Errorf("ollama request: %w", err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
@@ -92,3 +340,143 @@ func (o *Ollama) Generate(prompt string) (string, error) {
 	return result.Response, nil
 }
 
+// GenerateStream is like Generate but streams the response, writing each
+// piece to w (if not nil) as it arrives. It also returns the whole text. If
+// ctx is cancelled, the text produced so far, possibly none, is returned
+// with a nil error.
+func (o *Ollama) GenerateStream(ctx context.Context, prompt string, w io.Writer) (string, error) {
+	req := generateRequest{Model: o.model, Prompt: prompt, Stream: true}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", nil
+		}
+		return "", err
+	}
+	defer release()
+
+	resp, err := o.do(ctx, o.generateClient, http.MethodPost, "/api/generate", body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", nil
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("ollama error %d: %s", resp.StatusCode, string(b))
+	}
+
+	var out strings.Builder
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk generateResponse
+		if err := dec.Decode(&chunk); err != nil {
+			if ctx.Err() != nil {
+				return out.String(), nil
+			}
+			if err == io.EOF {
+				break
+			}
+			return out.String(), fmt.Errorf("decode stream: %w", err)
+		}
+		if chunk.Error != "" {
+			return out.String(), fmt.Errorf("ollama error: %s", chunk.Error)
+		}
+
+		out.WriteString(chunk.Response)
+		if w != nil {
+			if _, err := io.WriteString(w, chunk.Response); err != nil {
+				return out.String(), fmt.Errorf("write stream: %w", err)
+			}
+		}
+		if chunk.Done {
+			break
+		}
+	}
+
+	return out.String(), nil
+}
+
+type tagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+// HasModel reports whether the model is pulled locally. A model given
+// without a tag matches its ":latest" version.
+func (o *Ollama) HasModel(ctx context.Context) (bool, error) {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	resp, err := o.do(ctx, o.embedClient, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("ollama error %d: %s", resp.StatusCode, string(b))
+	}
+
+	var result tagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("decode response: %w", err)
+	}
+
+	for _, m := range result.Models {
+		if m.Name == o.model || m.Name == o.model+":latest" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Ping checks that Ollama is up and answering
+func (o *Ollama) Ping(ctx context.Context) error {
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	resp, err := o.do(ctx, o.embedClient, http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ollama error %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// CheckModel fails with what to do about it when Ollama isn't reachable
+// or the model isn't pulled, so long operations don't fail halfway
+func (o *Ollama) CheckModel(ctx context.Context) error {
+	if err := o.Ping(ctx); err != nil {
+		return fmt.Errorf("can't reach Ollama at %s (is `ollama serve` running?): %w", o.baseURL, err)
+	}
+	ok, err := o.HasModel(ctx)
+	if err != nil {
+		return fmt.Errorf("list Ollama models: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("model %s not found, run `ollama pull %s`", o.model, o.model)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode"
+)
+
+// fakeOllama is an Ollama API for tests. Its embeddings are bags of
+// words, each word adding 1 to the dimension its hash picks, so texts
+// sharing words are close and unrelated ones are far apart.
+type fakeOllama struct {
+	*httptest.Server
+
+	mu  sync.Mutex
+	dim int
+	// models are the names /api/tags lists
+	models []string
+	// failing makes embed requests with an input containing it fail with
+	// a 400, which isn't retried
+	failing string
+	// response is what generate answers, one stream chunk per piece
+	response []string
+	// reply, if set, answers each generate prompt in place of response
+	reply func(prompt string) string
+	// hold keeps a stream open after response until the client goes away
+	hold bool
+
+	embedRequests int
+	embedded      []string
+	prompts       []string
+	images        [][]byte
+	// started, if not nil, is closed when the next generate request
+	// arrives
+	started chan struct{}
+}
+
+const (
+	testEmbedModel = "test-embed"
+	testGenModel   = "test-gen"
+)
+
+func newFakeOllama(t *testing.T) *fakeOllama {
+	t.Helper()
+	f := &fakeOllama{
+		dim:      16,
+		models:   []string{testEmbedModel + ":latest", testGenModel + ":latest"},
+		response: []string{"- a fact"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Ollama is running"))
+	})
+	mux.HandleFunc("/api/tags", f.tags)
+	mux.HandleFunc("/api/embed", f.embed)
+	mux.HandleFunc("/api/generate", f.generate)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// client returns a client for model that doesn't retry
+func (f *fakeOllama) client(model string) *Ollama {
+	return NewOllama(f.URL, model, WithRetry(1, 0))
+}
+
+// args are the global flags pointing a command at db and this server
+func (f *fakeOllama) args(db string) []string {
+	return []string{"--db", db, "--ollama", f.URL, "--embed-model", testEmbedModel, "--gen-model", testGenModel}
+}
+
+func (f *fakeOllama) set(fn func(f *fakeOllama)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(f)
+}
+
+// embedCalls returns how many embed requests were made and every input
+// they held
+func (f *fakeOllama) embedCalls() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.embedRequests, append([]string(nil), f.embedded...)
+}
+
+func (f *fakeOllama) generatePrompts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.prompts...)
+}
+
+func (f *fakeOllama) tags(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	var resp tagsResponse
+	for _, m := range f.models {
+		resp.Models = append(resp.Models, struct {
+			Name string `json:"name"`
+		}{m})
+	}
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeOllama) embed(w http.ResponseWriter, r *http.Request) {
+	var req embedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.embedRequests++
+	for _, in := range req.Input {
+		if f.failing != "" && strings.Contains(in, f.failing) {
+			http.Error(w, "cannot embed "+f.failing, http.StatusBadRequest)
+			return
+		}
+	}
+	f.embedded = append(f.embedded, req.Input...)
+
+	resp := embedResponse{}
+	for _, in := range req.Input {
+		resp.Embeddings = append(resp.Embeddings, fakeEmbedding(in, f.dim))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeOllama) generate(w http.ResponseWriter, r *http.Request) {
+	var req generateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.prompts = append(f.prompts, req.Prompt)
+	f.images = append(f.images, req.Images...)
+	pieces, hold, started := f.response, f.hold, f.started
+	if f.reply != nil {
+		pieces = []string{f.reply(req.Prompt)}
+	}
+	f.started = nil
+	f.mu.Unlock()
+	if started != nil {
+		close(started)
+	}
+
+	if !req.Stream {
+		json.NewEncoder(w).Encode(generateResponse{Response: strings.Join(pieces, ""), Done: true})
+		return
+	}
+	enc := json.NewEncoder(w)
+	for _, p := range pieces {
+		enc.Encode(generateResponse{Response: p})
+		w.(http.Flusher).Flush()
+	}
+	if hold {
+		<-r.Context().Done()
+		return
+	}
+	enc.Encode(generateResponse{Done: true})
+}
+
+// fakeEmbedding is the bag-of-words vector the fake server returns
+func fakeEmbedding(text string, dim int) []float32 {
+	v := make([]float32, dim)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		v[h.Sum32()%uint32(dim)]++
+	}
+	return v
+}
+
+// cancelWriter cancels a context on the first write
+type cancelWriter struct {
+	cancel context.CancelFunc
+	got    strings.Builder
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.got.Write(p)
+	w.cancel()
+	return len(p), nil
+}
+
+func TestGenerateStreamCancelledMidStream(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) { f.response, f.hold = []string{"partial "}, true })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelWriter{cancel: cancel}
+	out, err := f.client(testGenModel).GenerateStream(ctx, "prompt", w)
+	if err != nil {
+		t.Fatalf("GenerateStream returned error %v, want the partial output", err)
+	}
+	if out != "partial " || w.got.String() != "partial " {
+		t.Errorf("GenerateStream = %q, streamed %q; want %q for both", out, w.got.String(), "partial ")
+	}
+}
+
+func TestGenerateStreamCancelledBeforeFirstToken(t *testing.T) {
+	f := newFakeOllama(t)
+	started := make(chan struct{})
+	f.set(func(f *fakeOllama) { f.response, f.hold, f.started = nil, true, started })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-started
+		cancel()
+	}()
+	out, err := f.client(testGenModel).GenerateStream(ctx, "prompt", nil)
+	if err != nil || out != "" {
+		t.Errorf("GenerateStream = %q, %v; want empty output and no error", out, err)
+	}
+
+	// Cancelled before the request is even sent
+	out, err = f.client(testGenModel).GenerateStream(ctx, "prompt", nil)
+	if err != nil || out != "" {
+		t.Errorf("GenerateStream with a done context = %q, %v; want empty output and no error", out, err)
+	}
+}
+
+func TestDimensionProbesOnlyUnknownModels(t *testing.T) {
+	f := newFakeOllama(t)
+
+	dim, err := f.client("nomic-embed-text:latest").Dimension(context.Background())
+	if err != nil || dim != 768 {
+		t.Errorf("known model Dimension = %d, %v; want 768 from the registry", dim, err)
+	}
+	if n, _ := f.embedCalls(); n != 0 {
+		t.Errorf("known model made %d embed calls, want none", n)
+	}
+
+	dim, err = f.client(testEmbedModel).Dimension(context.Background())
+	if err != nil || dim != f.dim {
+		t.Errorf("unknown model Dimension = %d, %v; want the probed %d", dim, err, f.dim)
+	}
+	if n, _ := f.embedCalls(); n != 1 {
+		t.Errorf("unknown model made %d embed calls, want one probe", n)
+	}
+}
+
+func TestEmbedWarnsWhenKnownModelChangesDimension(t *testing.T) {
+	f := newFakeOllama(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = w
+	o := f.client("nomic-embed-text")
+	_, err = o.Embed(context.Background(), "one")
+	if err == nil {
+		_, err = o.Embed(context.Background(), "two")
+	}
+	os.Stderr = old
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(out), "returned 16 dims, expected 768"); got != 1 {
+		t.Errorf("stderr has %d dimension warnings, want 1:\n%s", got, out)
+	}
+}
+
+// Run with -race
+func TestMaxParallelOllamaCapsAllRequests(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	track := func(w http.ResponseWriter, v any) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/embed", func(w http.ResponseWriter, r *http.Request) {
+		track(w, embedResponse{Embeddings: [][]float32{{1, 0}}})
+	})
+	mux.HandleFunc("/api/generate", func(w http.ResponseWriter, r *http.Request) {
+		track(w, generateResponse{Response: "ok", Done: true})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	const limit = 3
+	SetMaxParallelOllama(limit)
+	defer SetMaxParallelOllama(0)
+
+	embed := NewOllama(srv.URL, testEmbedModel, WithRetry(1, 0))
+	gen := NewOllama(srv.URL, testGenModel, WithRetry(1, 0))
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if _, err := embed.Embed(ctx, "text"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := gen.Generate(ctx, "prompt"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := gen.GenerateStream(ctx, "prompt", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > limit {
+		t.Errorf("%d requests were in flight at once, want at most %d", p, limit)
+	} else if p < limit {
+		t.Errorf("at most %d requests ran at once; the test didn't reach the cap of %d", p, limit)
+	}
+}
+
+func TestEmbedAndGenerateTimeoutsAreSeparate(t *testing.T) {
+	mux := http.NewServeMux()
+	slow := func(v any) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+			json.NewEncoder(w).Encode(v)
+		}
+	}
+	mux.HandleFunc("/api/embed", slow(embedResponse{Embeddings: [][]float32{{1, 0}}}))
+	mux.HandleFunc("/api/generate", slow(generateResponse{Response: "ok", Done: true}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	short, long := 50*time.Millisecond, 5*time.Second
+
+	o := NewOllama(srv.URL, testGenModel, WithRetry(1, 0), WithTimeouts(short, long))
+	if _, err := o.Embed(ctx, "text"); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("Embed past a %s embed timeout = %v, want a timeout", short, err)
+	}
+	if out, err := o.Generate(ctx, "prompt"); err != nil || out != "ok" {
+		t.Errorf("Generate within a %s generate timeout = %q, %v", long, out, err)
+	}
+
+	// The defaults new clients get, as --embed-timeout and --generate-timeout set
+	SetOllamaTimeouts(long, short)
+	defer SetOllamaTimeouts(embedTimeout, generateTimeout)
+	o = NewOllama(srv.URL, testGenModel, WithRetry(1, 0))
+	if _, err := o.Embed(ctx, "text"); err != nil {
+		t.Errorf("Embed within a %s embed timeout: %v", long, err)
+	}
+	if _, err := o.GenerateStream(ctx, "prompt", nil); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("GenerateStream past a %s generate timeout = %v, want a timeout", short, err)
+	}
+}
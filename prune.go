@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneOlderThan string
+	pruneEmpty     bool
+	pruneDryRun    bool
+)
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().StringVar(&pruneOlderThan, "older-than", "", "remove conversations created longer ago than this (e.g. 90d)")
+	pruneCmd.Flags().BoolVar(&pruneEmpty, "empty", false, "remove conversations that have no chunks")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only report what would be removed")
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune [--older-than <age>] [--empty]",
+	Short: "Remove old conversations or ones without chunks",
+	Long: `Remove conversations created before --older-than (like 90d or 720h),
+and with --empty those that produced no chunks, e.g. because every chunk
+was under --min-words. Their chunks, embeddings and tags go with them.
+--dry-run reports the counts without deleting anything.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if pruneOlderThan == "" && !pruneEmpty {
+			return errors.New("nothing to prune: pass --older-than, --empty or both")
+		}
+		var cutoff time.Time
+		if pruneOlderThan != "" {
+			age, err := parseAge(pruneOlderThan)
+			if err != nil {
+				return err
+			}
+			cutoff = time.Now().Add(-age)
+		}
+		if dbReadOnly && !pruneDryRun {
+			return errors.New("can't prune with --db-readonly (use --dry-run)")
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		convs, chunks := 0, 0
+		if pruneOlderThan != "" {
+			if pruneDryRun {
+				convs, chunks, err = store.CountOlderThan(cutoff)
+			} else {
+				convs, chunks, err = store.DeleteOlderThan(cutoff)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if pruneEmpty {
+			// Those older than the cutoff are already counted, and in a
+			// dry run still there
+			empty, err := store.ListEmpty(cutoff)
+			if err != nil {
+				return err
+			}
+			var ids []string
+			for _, c := range empty {
+				ids = append(ids, c.ID)
+			}
+			if !pruneDryRun {
+				if err := store.DeleteConversations(ids); err != nil {
+					return err
+				}
+			}
+			convs += len(ids)
+		}
+
+		if pruneDryRun {
+			fmt.Printf("Would remove %d conversations and %d chunks.\n", convs, chunks)
+			return nil
+		}
+		fmt.Printf("Removed %d conversations and %d chunks.\n", convs, chunks)
+		return nil
+	},
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneCountsEachConversationOnce(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty conversations either side of the cutoff, in offsets that
+	// misorder them as text
+	now := time.Now()
+	for id, created := range map[string]time.Time{
+		"old": now.Add(-25 * time.Hour).In(time.FixedZone("LINT", 14*3600)),
+		"new": now.Add(-23 * time.Hour).In(time.FixedZone("HST", -10*3600)),
+	} {
+		if err := store.Save(Conversation{ID: id, Content: id, CreatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--older-than", "24h", "--dry-run"}, "Would remove 1 conversations"},
+		{[]string{"--empty", "--dry-run"}, "Would remove 2 conversations"},
+		{[]string{"--older-than", "24h", "--empty", "--dry-run"}, "Would remove 2 conversations"},
+		{[]string{"--older-than", "24h"}, "Removed 1 conversations"},
+		{[]string{"--empty"}, "Removed 1 conversations"},
+	} {
+		out, _, err := runCmd(t, append(append(f.args(db), "prune"), tc.args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, tc.want) {
+			t.Errorf("prune %v = %q, want %q", tc.args, out, tc.want)
+		}
+	}
+}
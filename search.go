@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	keywordSearch  bool
+	scoreBreakdown bool
+	groupResults   bool
+)
+
+func init() {
+	rootCmd.AddCommand(searchCmd)
+	searchCmd.Flags().IntVar(&topK, "limit", 10, "same as --top-k")
+	searchCmd.Flags().BoolVar(&keywordSearch, "keyword", false, "find chunks containing every word of the query instead of searching embeddings (for error codes, function names, ...)")
+	searchCmd.Flags().BoolVar(&scoreBreakdown, "score-breakdown", false, "with --hybrid, show each result's vector and keyword scores and how they add up to its rank")
+	searchCmd.Flags().BoolVar(&groupResults, "group", false, "show matching chunks under the conversation they came from, conversations ordered by their best match")
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Show matching chunks without synthesizing them",
+	Long: `Embed the query and print the closest stored chunks with their
+similarity and source conversation. Unlike prime it never calls the
+generation model, so only an embedding model is needed. With --keyword it
+matches words in the stored text instead and needs no model at all.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		query, err := requireQuery(args[0])
+		if err != nil {
+			return err
+		}
+
+		if scoreBreakdown && !hybridSearch {
+			return fmt.Errorf("--score-breakdown only applies to --hybrid")
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		if keywordSearch {
+			if hybridSearch {
+				return fmt.Errorf("--keyword and --hybrid can't be combined (--hybrid already includes keyword matches)")
+			}
+			results, err := store.SearchText(query, topK, tagFilter)
+			if err != nil {
+				return err
+			}
+			if err := markReturned(store, results); err != nil {
+				return err
+			}
+			return printSearchResults(store, results)
+		}
+
+		embedOllama := NewOllama(ollamaURL, embedModel)
+		if err := ensureDimension(cmd.Context(), store, embedOllama); err != nil {
+			return err
+		}
+		if err := warnMixedModels(store, embedOllama); err != nil {
+			return err
+		}
+
+		results, err := searchStore(cmd.Context(), store, embedOllama, query, topK, distanceThreshold)
+		if err != nil {
+			return err
+		}
+		if err := markReturned(store, results); err != nil {
+			return err
+		}
+		return printSearchResults(store, results)
+	},
+}
+
+// markReturned records that results' conversations were just returned by
+// a search, so forget --unused-for keeps them. With --db-readonly nothing
+// is recorded.
+func markReturned(store *Store, results []SearchResult) error {
+	if dbReadOnly {
+		return nil
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if !seen[r.ConvID] {
+			seen[r.ConvID] = true
+			ids = append(ids, r.ConvID)
+		}
+	}
+	return store.MarkAccessed(ids)
+}
+
+// printSearchResults prints search's results, each with its similarity or,
+// for keyword results, its score. With --group they are shown under their
+// conversation, which store is needed for.
+func printSearchResults(store *Store, results []SearchResult) error {
+	if groupResults {
+		return printGroupedResults(store, results)
+	}
+	if jsonOutput {
+		matches := []jsonMatch{}
+		for _, r := range results {
+			matches = append(matches, searchMatch(r))
+		}
+		return writeJSON(matches)
+	}
+
+	if len(results) == 0 {
+		printNoMatches()
+		return nil
+	}
+
+	for i, r := range results {
+		fmt.Printf("[%d] %s | %s%s\n", i+1, resultScore(r), shortID(r.ConvID), titleMark(r))
+		printBreakdown(r)
+		fmt.Println(strings.TrimSpace(r.Content))
+		fmt.Println()
+	}
+	return nil
+}
+
+// resultGroup is a conversation's chunks among the search results
+type resultGroup struct {
+	ConvID  string
+	Results []SearchResult
+}
+
+// groupByConversation collects results under their conversation. Results
+// come best first, so the groups are ordered by their best chunk and keep
+// that order inside.
+func groupByConversation(results []SearchResult) []resultGroup {
+	var groups []resultGroup
+	index := make(map[string]int)
+	for _, r := range results {
+		i, ok := index[r.ConvID]
+		if !ok {
+			i = len(groups)
+			index[r.ConvID] = i
+			groups = append(groups, resultGroup{ConvID: r.ConvID})
+		}
+		groups[i].Results = append(groups[i].Results, r)
+	}
+	return groups
+}
+
+// printGroupedResults implements search --group
+func printGroupedResults(store *Store, results []SearchResult) error {
+	groups := groupByConversation(results)
+	convs := make([]Conversation, len(groups))
+	for i, g := range groups {
+		conv, err := store.Get(g.ConvID)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", shortID(g.ConvID), err)
+		}
+		convs[i] = conv
+	}
+
+	if jsonOutput {
+		out := []jsonGroup{}
+		for i, g := range groups {
+			jg := jsonGroup{Conversation: jsonGroupConversation{ID: convs[i].ID, CreatedAt: convs[i].CreatedAt, Title: convs[i].Title}, Chunks: []jsonMatch{}}
+			for _, r := range g.Results {
+				jg.Chunks = append(jg.Chunks, searchMatch(r))
+			}
+			out = append(out, jg)
+		}
+		return writeJSON(out)
+	}
+
+	if len(groups) == 0 {
+		printNoMatches()
+		return nil
+	}
+
+	for i, g := range groups {
+		header := fmt.Sprintf("[%d] %s | %s", i+1, shortID(g.ConvID), convs[i].CreatedAt.Format("2006-01-02"))
+		if convs[i].Title != "" {
+			header += fmt.Sprintf(" | %q", convs[i].Title)
+		}
+		fmt.Println(header)
+		for _, r := range g.Results {
+			fmt.Printf("  %s%s\n", resultScore(r), titleMark(r))
+			printBreakdown(r)
+			fmt.Println(indent(strings.TrimSpace(r.Content), "  "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// searchMatch is a search result as JSON, with its breakdown under
+// --score-breakdown
+func searchMatch(r SearchResult) jsonMatch {
+	m := newJSONMatch(r)
+	if scoreBreakdown {
+		m.Breakdown = newJSONBreakdown(r)
+	}
+	return m
+}
+
+func printNoMatches() {
+	if keywordSearch {
+		fmt.Println("No matches (no chunk contains every word).")
+		return
+	}
+	fmt.Println("No matches (nothing within --threshold).")
+}
+
+// resultScore is a result's similarity, or its score for keyword results
+func resultScore(r SearchResult) string {
+	if keywordSearch {
+		return "score " + fixed(r.KeywordScore, 2)
+	}
+	return fixed(similarity(r.Distance), 0) + "%"
+}
+
+// titleMark labels a match on a conversation's title pseudo-chunk
+func titleMark(r SearchResult) string {
+	if isTitleChunk(r.ID) {
+		return " | title"
+	}
+	return ""
+}
+
+// printBreakdown prints a hybrid result's scores for --score-breakdown
+func printBreakdown(r SearchResult) {
+	if !scoreBreakdown || r.Hybrid == nil {
+		return
+	}
+	h := r.Hybrid
+	fmt.Printf("    fused %s (rank %d) = %s × vector %s (similarity %s%%) + %s × keyword %s (score %s)\n",
+		fixed(h.Fused, 3), h.Rank, fixed(hybridAlpha, 2), fixed(h.VectorNorm, 3), fixed(similarity(r.Distance), 0),
+		fixed(1-hybridAlpha, 2), fixed(h.KeywordNorm, 3), fixed(h.Keyword, 2))
+}
+
+// searchStore embeds the query and returns the closest chunks within
+// threshold. Databases from before chunking only have whole-conversation
+// embeddings, so for those each result is a whole conversation.
+func searchStore(ctx context.Context, store *Store, embed *Ollama, query string, limit int, threshold float64) ([]SearchResult, error) {
+	queryEmb, err := embedQuery(ctx, embed, query)
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+	return searchEmbedded(store, queryEmb, query, limit, threshold)
+}
+
+// searchEmbedded is searchStore for a query that is already embedded
+func searchEmbedded(store *Store, queryEmb []float32, query string, limit int, threshold float64) ([]SearchResult, error) {
+	queryEmb = coerceQueryDim(store, queryEmb)
+	if validateDims {
+		if err := store.ValidateQueryDim(queryEmb); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.HasChunks() {
+		results, err := searchChunks(store, queryEmb, query, limit, threshold)
+		if err != nil {
+			return nil, fmt.Errorf("search chunks: %w", err)
+		}
+		return results, nil
+	}
+
+	results, err := searchDocs(store, queryEmb, limit, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	for i, r := range results {
+		conv, err := store.Get(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		results[i].ConvID = conv.ID
+		results[i].Content = conv.Content
+	}
+	return results, nil
+}
+
+// primeStore is prime without a terminal: it retrieves the matches for
+// intent and synthesizes them into a context, or, without a generation
+// model, returns the matches joined as they are
+func primeStore(ctx context.Context, store *Store, embed, gen *Ollama, intent string, limit int, threshold float64) (jsonPrime, error) {
+	results, err := searchStore(ctx, store, embed, intent, limit, threshold)
+	if err != nil {
+		return jsonPrime{Intent: intent, Threshold: threshold, Matches: []jsonMatch{}}, err
+	}
+	return primeResults(ctx, store, gen, intent, threshold, results)
+}
+
+// primeResults is primeStore for matches that were already retrieved
+func primeResults(ctx context.Context, store *Store, gen *Ollama, intent string, threshold float64, results []SearchResult) (jsonPrime, error) {
+	result := jsonPrime{Intent: intent, Threshold: threshold, Matches: []jsonMatch{}}
+	if len(results) == 0 {
+		return result, nil
+	}
+
+	var contexts, accessed []string
+	for _, res := range results {
+		result.Matches = append(result.Matches, newJSONMatch(res))
+		contexts = append(contexts, res.Content)
+		accessed = append(accessed, res.ConvID)
+	}
+	if !dbReadOnly {
+		if err := store.MarkAccessed(accessed); err != nil {
+			return result, err
+		}
+	}
+	// Drops are logged on stderr; for mcp, stdout is the protocol stream
+	if filterIrrelevant {
+		if contexts = filterRelevant(ctx, NewOllama(gen.baseURL, scoringModel), intent, contexts, os.Stderr); len(contexts) == 0 {
+			return result, nil
+		}
+	}
+
+	if ok, err := gen.HasModel(ctx); err == nil && !ok {
+		result.Context = strings.Join(contexts, "\n\n")
+		return result, nil
+	}
+	opts := synthOptions{MaxContentBytes: maxContentBytes, MaxTotalChars: maxContextChars}
+	synthesized, err := synthesize(ctx, gen, intent, contexts, opts, nil)
+	if err != nil {
+		return result, fmt.Errorf("synthesize: %w", err)
+	}
+	result.Context = stripWrappingFence(synthesized)
+	result.Synthesized = true
+	return result, nil
+}
+
+// indent puts prefix before every line of s
+func indent(s, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
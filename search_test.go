@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uploadTexts uploads each text as its own conversation into db
+func uploadTexts(t *testing.T, f *fakeOllama, db string, texts ...string) {
+	t.Helper()
+	for i, text := range texts {
+		file := writeFile(t, "conv"+string(rune('a'+i))+".txt", text)
+		if _, _, err := runCmd(t, append(f.args(db), "upload", file)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchScoreBreakdownJSON(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db,
+		strings.Repeat("worker pools drain the queue ", 20),
+		strings.Repeat("dialContext returned ERR_CONN_RESET again ", 20),
+	)
+
+	out, _, err := runCmd(t, append(f.args(db), "search", "--hybrid", "--score-breakdown", "--json", "--threshold", "0.99", "worker ERR_CONN_RESET")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matches []jsonMatch
+	if err := json.Unmarshal([]byte(out), &matches); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(matches) == 0 {
+		t.Fatal("no matches")
+	}
+	for i, m := range matches {
+		b := m.Breakdown
+		if b == nil {
+			t.Fatalf("match %d has no score_breakdown: %s", i, out)
+		}
+		if b.Rank != i+1 {
+			t.Errorf("match %d has rank %d", i, b.Rank)
+		}
+		if math.Abs(b.VectorContribution-hybridAlpha*b.VectorNorm) > 1e-9 ||
+			math.Abs(b.KeywordContribution-(1-hybridAlpha)*b.KeywordNorm) > 1e-9 ||
+			math.Abs(b.Fused-(b.VectorContribution+b.KeywordContribution)) > 1e-9 {
+			t.Errorf("match %d: breakdown %+v doesn't add up", i, *b)
+		}
+	}
+
+	if _, _, err := runCmd(t, append(f.args(db), "search", "--score-breakdown", "worker")...); err == nil {
+		t.Error("--score-breakdown without --hybrid succeeded")
+	}
+}
+
+func TestAlphaOutOfRange(t *testing.T) {
+	for _, alpha := range []string{"-0.1", "1.5"} {
+		if _, _, err := runCmd(t, "search", "--hybrid", "--alpha", alpha, "x"); err == nil || !strings.Contains(err.Error(), "--alpha") {
+			t.Errorf("--alpha %s: err = %v, want a range error", alpha, err)
+		}
+	}
+}
+
+func TestGroupByConversation(t *testing.T) {
+	results := []SearchResult{
+		{ID: "b:0", ConvID: "b", Distance: 0.1},
+		{ID: "a:2", ConvID: "a", Distance: 0.2},
+		{ID: "b:3", ConvID: "b", Distance: 0.3},
+		{ID: "a:0", ConvID: "a", Distance: 0.4},
+		{ID: "c:1", ConvID: "c", Distance: 0.5},
+	}
+	groups := groupByConversation(results)
+	var got []string
+	for _, g := range groups {
+		var ids []string
+		for _, r := range g.Results {
+			ids = append(ids, r.ID)
+		}
+		got = append(got, g.ConvID+"="+strings.Join(ids, ","))
+	}
+	want := []string{"b=b:0,b:3", "a=a:2,a:0", "c=c:1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("groupByConversation = %v, want %v", got, want)
+	}
+}
+
+func TestSearchGroupJSON(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	pools := strings.Repeat("worker pools drain the queue ", 20)
+	uploadTexts(t, f, db,
+		pools+"\n\n"+strings.Repeat("worker pools and retries ", 20),
+		strings.Repeat("worker pools in another project ", 20),
+	)
+
+	out, _, err := runCmd(t, append(f.args(db), "search", "--group", "--json", "--threshold", "0.99", "worker pools")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []jsonGroup
+	if err := json.Unmarshal([]byte(out), &groups); err != nil {
+		t.Fatalf("%v in %s", err, out)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want one per conversation: %s", len(groups), out)
+	}
+	seen := map[string]bool{}
+	best := 101.0
+	for _, g := range groups {
+		if seen[g.Conversation.ID] {
+			t.Errorf("conversation %s is listed twice", g.Conversation.ID)
+		}
+		seen[g.Conversation.ID] = true
+		if g.Conversation.CreatedAt.IsZero() || len(g.Chunks) == 0 {
+			t.Errorf("group %+v has no date or no chunks", g)
+		}
+		for i, c := range g.Chunks {
+			if c.ConvID != g.Conversation.ID {
+				t.Errorf("chunk of %s under %s", c.ConvID, g.Conversation.ID)
+			}
+			if i > 0 && c.Similarity > g.Chunks[i-1].Similarity {
+				t.Errorf("chunks of %s aren't best first", g.Conversation.ID)
+			}
+		}
+		if g.Chunks[0].Similarity > best {
+			t.Errorf("groups aren't ordered by their best chunk")
+		}
+		best = g.Chunks[0].Similarity
+	}
+	if len(groups[0].Chunks)+len(groups[1].Chunks) != 3 {
+		t.Errorf("want all 3 chunks grouped, got %s", out)
+	}
+}
+
+func TestSearchExpandEmbedsTheExpansion(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("login token expiry breaks session refresh ", 20))
+	expansion := "login token expiry breaks session refresh"
+	f.set(func(f *fakeOllama) { f.response = []string{"  " + expansion + "\n"} })
+
+	out, stderr, err := runCmd(t, append(f.args(db), "search", "--expand", "--verbose", "--json", "--threshold", "0.5", "the auth bug")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, embedded := f.embedCalls()
+	if searched := embedded[len(embedded)-1]; searched != expansion || slices.Contains(embedded, "the auth bug") {
+		t.Errorf("embedded %q, want the expansion %q instead of the query", embedded, expansion)
+	}
+	if prompts := f.generatePrompts(); len(prompts) != 1 || !strings.Contains(prompts[0], "Query: the auth bug") {
+		t.Errorf("generate prompts = %q, want one expanding the query", prompts)
+	}
+	var matches []jsonMatch
+	if err := json.Unmarshal([]byte(out), &matches); err != nil || len(matches) == 0 {
+		t.Errorf("search --expand --json = %s (%v), want matches found through the expansion", out, err)
+	}
+	if !strings.Contains(stderr, "expanded query: "+expansion) {
+		t.Errorf("--verbose doesn't show the expansion:\n%s", stderr)
+	}
+}
+
+func TestSearchWarnsOnMixedModels(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) { f.models = append(f.models, "other-embed:latest") })
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	search := append(f.args(db), "search", "--threshold", "0.99", "worker pools")
+	_, stderr, err := runCmd(t, search...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stderr, "vectors from different models") {
+		t.Errorf("warning for a single-model index:\n%s", stderr)
+	}
+
+	file := writeFile(t, "other.txt", strings.Repeat("night trains across the alps ", 20))
+	if _, _, err := runCmd(t, append(f.args(db), "upload", file, "--embed-model", "other-embed")...); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, err = runCmd(t, search...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "stored embeddings come from other-embed (1), test-embed (1) and queries use test-embed"; !strings.Contains(stderr, want) {
+		t.Errorf("stderr doesn't have %q:\n%s", want, stderr)
+	}
+}
+
+func TestPrecisionFlag(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"search", "--threshold", "0.99", "worker pools"}, `(^|[^.\d])\d+%`},
+		{[]string{"search", "--threshold", "0.99", "--precision", "3", "worker pools"}, `\b\d+\.\d{3}%`},
+		{[]string{"debug", "worker pools"}, `(?m)^\d\.\d{4} +\|`},
+		{[]string{"debug", "--precision", "1", "worker pools"}, `(?m)^\d\.\d +\| +\d+\.\d%`},
+	} {
+		out, _, err := runCmd(t, append(f.args(db), tc.args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(tc.want).MatchString(out) {
+			t.Errorf("%v output doesn't match %s:\n%s", tc.args, tc.want, out)
+		}
+	}
+}
+
+func TestWarnSlowQuery(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	// Any search outlasts a nanosecond
+	for flag, want := range map[string]bool{"1ns": true, "2s": false, "0": false} {
+		_, stderr, err := runCmd(t, append(f.args(db), "search", "--warn-slow-query", flag, "worker pools")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(stderr, "over 1 embedded chunks"); got != want {
+			t.Errorf("--warn-slow-query %s warned: %v, want %v:\n%s", flag, got, want, stderr)
+		}
+	}
+}
+
+func TestCoerceDimsTruncatesOrPadsQuery(t *testing.T) {
+	f := newFakeOllama(t)
+	f.set(func(f *fakeOllama) { f.dim = 768 })
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	// The model now gives 1024 dims, as after switching to another one
+	f.set(func(f *fakeOllama) { f.dim = 1024 })
+	search := append(f.args(db), "search", "--json", "--threshold", "2", "worker pools")
+	if _, _, err := runCmd(t, search...); err == nil || !strings.Contains(err.Error(), "1024-dim embeddings but the database holds 768-dim") {
+		t.Fatalf("search without --coerce-dims = %v, want the dimension mismatch", err)
+	}
+	coerceWarning = sync.Once{}
+	out, stderr, err := runCmd(t, append(search, "--coerce-dims")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "query has 1024 dims but the index has 768, truncating it") {
+		t.Errorf("no accuracy warning:\n%s", stderr)
+	}
+	var matches []jsonMatch
+	if err := json.Unmarshal([]byte(out), &matches); err != nil || len(matches) != 1 {
+		t.Errorf("coerced search = %q (%v), want the stored chunk", out, err)
+	}
+
+	store := newTestStore(t)
+	seed(t, store, "conv1", "worker pools")
+	setVar(t, &coerceDims, true)
+	coerceWarning = sync.Once{}
+	short := []float32{1, 2, 3}
+	if got := coerceQueryDim(store, short); len(got) != 16 || !slices.Equal(got[:3], short) || slices.ContainsFunc(got[3:], func(v float32) bool { return v != 0 }) {
+		t.Errorf("coerceQueryDim(%v) = %v, want it zero-padded to 16", short, got)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveAddr   string
+	serveFollow bool
+)
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "address to listen on")
+	serveCmd.Flags().Int64Var(&limitBytes, "limit-bytes", 10<<20, "refuse uploads larger than this many bytes")
+	serveCmd.Flags().BoolVar(&serveFollow, "follow", false, "before each request, reload what the server caches about the database if another process wrote to it")
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve upload, search and prime over HTTP",
+	Long: `Start an HTTP server so other applications can use memctx without
+shelling out:
+
+  POST /upload                      body is the text to store
+  GET  /search?q=...&k=10&threshold=0.45
+  POST /prime                       body is {"intent": "...", "k": 10, "threshold": 0.45}
+  POST /warm                        body is {"queries": ["...", ...], "k": 10, "threshold": 0.45}
+
+Responses are JSON; errors are {"error": "..."} with a matching status
+code. With --db-readonly, /upload is refused.
+
+Query embeddings are kept in the database's embedding cache and results
+in memory until the next write, so a repeated query doesn't reach Ollama.
+/warm runs a list of queries to fill both, see warm-queries.
+
+With --follow the server keeps up with uploads and reindexes run from the
+CLI against the same database: a request that finds the database changed
+since the last one first reloads the embedding dimension and anything
+else the server keeps in memory.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		s := &server{store: store, embed: NewOllama(ollamaURL, embedModel), gen: NewOllama(ollamaURL, genModel), follow: serveFollow}
+		if s.version, err = store.DataVersion(); err != nil {
+			return err
+		}
+		if err := ensureDimension(cmd.Context(), store, s.embed); err != nil {
+			return err
+		}
+		if err := warnMixedModels(store, s.embed); err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/upload", allow(http.MethodPost, s.handleUpload))
+		mux.HandleFunc("/search", allow(http.MethodGet, s.handleSearch))
+		mux.HandleFunc("/prime", allow(http.MethodPost, s.handlePrime))
+		mux.HandleFunc("/warm", allow(http.MethodPost, s.handleWarm))
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			writeResponse(w, 0, nil, &httpError{status: http.StatusNotFound, err: fmt.Errorf("no endpoint %s", r.URL.Path)})
+		})
+
+		srv := &http.Server{
+			Addr:    serveAddr,
+			Handler: mux,
+			// Requests carry the command's context, so Ctrl-C also stops
+			// in-flight Ollama calls
+			BaseContext: func(net.Listener) context.Context { return cmd.Context() },
+		}
+		go func() {
+			<-cmd.Context().Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}()
+
+		log.Printf("memctx listening on %s", serveAddr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+// server handles API requests against one open store. Store is safe for
+// concurrent use, so searches run in parallel; uploads are serialized so
+// the check for an existing copy and the write that follows can't race.
+type server struct {
+	store    *Store
+	embed    *Ollama
+	gen      *Ollama
+	uploadMu sync.Mutex
+
+	// follow makes every request check for writes from other processes
+	// first, see refresh
+	follow    bool
+	versionMu sync.Mutex
+	version   int64
+
+	// results caches /search and /prime matches, see cachedSearch
+	results resultCache
+}
+
+// refresh reloads what the store caches when another process has
+// committed to the database since the last request, if --follow is set
+func (s *server) refresh() error {
+	if !s.follow {
+		return nil
+	}
+	v, err := s.store.DataVersion()
+	if err != nil {
+		return err
+	}
+
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	if v == s.version {
+		return nil
+	}
+	if err := s.store.Refresh(); err != nil {
+		return err
+	}
+	s.version = v
+	verbosef("database changed, reloaded\n")
+	return nil
+}
+
+// httpError is an error with the status code to report it with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+
+// allow rejects requests with any other method, with a JSON error like
+// every other failure
+func allow(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeResponse(w, 0, nil, &httpError{status: http.StatusMethodNotAllowed, err: fmt.Errorf("%s takes %s", r.URL.Path, method)})
+			return
+		}
+		h(w, r)
+	}
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+// writeResponse sends v as JSON, or err as {"error": ...} with its status
+// (500 unless it is an *httpError)
+func writeResponse(w http.ResponseWriter, status int, v any, err error) {
+	if err != nil {
+		status = http.StatusInternalServerError
+		var he *httpError
+		if errors.As(err, &he) {
+			status = he.status
+		}
+		v = map[string]string{"error": err.Error()}
+		log.Printf("%d: %v", status, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type uploadResponse struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+	Failed int    `json:"failed,omitempty"`
+	// Existing is set when the content was already stored and nothing
+	// was embedded
+	Existing bool `json:"existing,omitempty"`
+}
+
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, limitBytes)
+	resp, err := s.upload(r)
+	status := http.StatusCreated
+	if resp.Existing {
+		status = http.StatusOK
+	}
+	writeResponse(w, status, resp, err)
+}
+
+func (s *server) upload(r *http.Request) (uploadResponse, error) {
+	if dbReadOnly {
+		return uploadResponse{}, &httpError{status: http.StatusForbidden, err: errors.New("server is read-only (--db-readonly)")}
+	}
+	if err := s.refresh(); err != nil {
+		return uploadResponse{}, err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			return uploadResponse{}, &httpError{status: http.StatusRequestEntityTooLarge, err: fmt.Errorf("body is over %d bytes", limitBytes)}
+		}
+		return uploadResponse{}, badRequest("read body: %v", err)
+	}
+	text := normalizeText(string(body))
+	if strings.TrimSpace(text) == "" {
+		return uploadResponse{}, badRequest("body is empty")
+	}
+	id := hashContent([]byte(text))
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	exists, err := s.store.Exists(id)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	if exists {
+		chunks, err := s.store.ChunksForConversation(id)
+		return uploadResponse{ID: id, Chunks: len(chunks), Existing: true}, err
+	}
+
+	if err := s.store.Save(Conversation{ID: id, Content: text, CreatedAt: time.Now()}); err != nil {
+		return uploadResponse{}, err
+	}
+	chunks := chunkText(text, chunkOpts)
+	failed, err := embedChunks(r.Context(), s.store, s.embed, id, chunks)
+	s.results.clear()
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	return uploadResponse{ID: id, Chunks: len(chunks), Failed: failed}, nil
+}
+
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	matches, err := s.search(r)
+	writeResponse(w, http.StatusOK, matches, err)
+}
+
+func (s *server) search(r *http.Request) ([]jsonMatch, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	query, err := requireQuery(q.Get("q"))
+	if err != nil {
+		return nil, badRequest("q: %v", err)
+	}
+	k, threshold := 10, defaultThreshold
+	if v := q.Get("k"); v != "" {
+		if k, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest("k must be an integer")
+		}
+	}
+	if v := q.Get("threshold"); v != "" {
+		if threshold, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, badRequest("threshold must be a number")
+		}
+	}
+	if err := checkSearchParams(k, threshold); err != nil {
+		return nil, err
+	}
+
+	results, err := s.cachedSearch(r.Context(), query, k, threshold)
+	if err != nil {
+		return nil, err
+	}
+	// Cached results count as returned too
+	if err := markReturned(s.store, results); err != nil {
+		return nil, err
+	}
+	matches := []jsonMatch{}
+	for _, res := range results {
+		matches = append(matches, newJSONMatch(res))
+	}
+	return matches, nil
+}
+
+func checkSearchParams(k int, threshold float64) error {
+	if k < 1 {
+		return badRequest("k must be at least 1")
+	}
+	if threshold <= 0 {
+		return badRequest("threshold must be positive")
+	}
+	return nil
+}
+
+type primeRequest struct {
+	Intent    string  `json:"intent"`
+	K         int     `json:"k"`
+	Threshold float64 `json:"threshold"`
+}
+
+func (s *server) handlePrime(w http.ResponseWriter, r *http.Request) {
+	result, err := s.prime(r)
+	writeResponse(w, http.StatusOK, result, err)
+}
+
+func (s *server) prime(r *http.Request) (jsonPrime, error) {
+	if err := s.refresh(); err != nil {
+		return jsonPrime{}, err
+	}
+	req := primeRequest{K: 10, Threshold: defaultThreshold}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return jsonPrime{}, badRequest("body must be {\"intent\": ...}: %v", err)
+	}
+	intent, err := requireQuery(req.Intent)
+	if err != nil {
+		return jsonPrime{}, badRequest("intent: %v", err)
+	}
+	if err := checkSearchParams(req.K, req.Threshold); err != nil {
+		return jsonPrime{}, err
+	}
+
+	results, err := s.cachedSearch(r.Context(), intent, req.K, req.Threshold)
+	if err != nil {
+		return jsonPrime{Intent: intent, Threshold: req.Threshold, Matches: []jsonMatch{}}, err
+	}
+	return primeResults(r.Context(), s.store, s.gen, intent, req.Threshold, results)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestServer returns a server over a fresh store, embedding with f
+func newTestServer(t *testing.T, f *fakeOllama) *server {
+	t.Helper()
+	return &server{store: newTestStore(t), embed: f.client(testEmbedModel), gen: f.client(testGenModel)}
+}
+
+// get runs a GET request through handler and decodes its JSON response
+// into v
+func get(t *testing.T, handler http.HandlerFunc, target string, v any) int {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Errorf("decode %s: %v", target, err)
+	}
+	return rec.Code
+}
+
+// Run with -race: searches share the store's read pool
+func TestServeConcurrentSearches(t *testing.T) {
+	f := newFakeOllama(t)
+	s := newTestServer(t, f)
+	topics := map[string]string{
+		"pools":     "worker pools drain the job queue",
+		"sourdough": "sourdough bread needs a starter",
+		"trains":    "night trains across the alps",
+	}
+	for id, text := range topics {
+		seed(t, s.store, id, text)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		for id, text := range topics {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var matches []jsonMatch
+				code := get(t, s.handleSearch, "/search?threshold=0.5&q="+url.QueryEscape(text), &matches)
+				if code != http.StatusOK || len(matches) == 0 || matches[0].ConvID != id {
+					t.Errorf("search for %q = %d %+v, want %s first", text, code, matches, id)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// Run with -race: uploads take the single writer while searches keep
+// reading through the pool
+func TestServeSearchesDuringUploads(t *testing.T) {
+	f := newFakeOllama(t)
+	s := newTestServer(t, f)
+	seed(t, s.store, "pools", "worker pools drain the job queue")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			body := strings.NewReader(fmt.Sprintf("note %d about night trains across the alps", i))
+			rec := httptest.NewRecorder()
+			s.handleUpload(rec, httptest.NewRequest(http.MethodPost, "/upload", body))
+			if rec.Code != http.StatusCreated {
+				t.Errorf("upload %d: %d %s", i, rec.Code, rec.Body)
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				var matches []jsonMatch
+				code := get(t, s.handleSearch, "/search?threshold=0.5&q="+url.QueryEscape("worker pools drain the job queue"), &matches)
+				if code != http.StatusOK || len(matches) == 0 || matches[0].ConvID != "pools" {
+					t.Errorf("search during uploads = %d %+v, want pools first", code, matches)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	convs, err := s.store.List()
+	if err != nil || len(convs) != 21 {
+		t.Errorf("store has %d conversations (%v), want 21", len(convs), err)
+	}
+}
+
+func TestServeRejectsEmptyQuery(t *testing.T) {
+	f := newFakeOllama(t)
+	s := newTestServer(t, f)
+	var resp map[string]string
+	if code := get(t, s.handleSearch, "/search?q="+url.QueryEscape("  "), &resp); code != http.StatusBadRequest {
+		t.Errorf("search for a blank query = %d %v, want 400", code, resp)
+	}
+	if n, _ := f.embedCalls(); n != 0 {
+		t.Errorf("blank query made %d embed calls, want none", n)
+	}
+}
+
+func TestServeFollowPicksUpExternalReindex(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+
+	open := func(follow bool) *server {
+		store, err := NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		s := &server{store: store, embed: f.client(testEmbedModel), gen: f.client(testGenModel), follow: follow}
+		if s.version, err = store.DataVersion(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	following, static := open(true), open(false)
+	for _, s := range []*server{following, static} {
+		var matches []jsonMatch
+		if code := get(t, s.handleSearch, "/search?threshold=0.5&q="+url.QueryEscape("worker pools"), &matches); code != http.StatusOK || len(matches) == 0 {
+			t.Fatalf("search before the reindex = %d %+v", code, matches)
+		}
+	}
+
+	// Another process reindexes with the model now making other
+	// dimensions, then uploads. The cache would hand back the old vectors.
+	f.set(func(f *fakeOllama) { f.dim = 8 })
+	if _, _, err := runCmd(t, append(f.args(db), "reindex", "--no-cache")...); err != nil {
+		t.Fatal(err)
+	}
+	uploadTexts(t, f, db, strings.Repeat("night trains across the alps ", 20))
+
+	query := "/search?threshold=0.5&q=" + url.QueryEscape("night trains across the alps")
+	var matches []jsonMatch
+	code := get(t, following.handleSearch, query, &matches)
+	if code != http.StatusOK || len(matches) == 0 || !strings.Contains(matches[0].Content, "night trains") {
+		t.Errorf("--follow search after the reindex = %d %+v, want the new conversation", code, matches)
+	}
+	var resp map[string]string
+	if code := get(t, static.handleSearch, query, &resp); code != http.StatusInternalServerError || !strings.Contains(resp["error"], "built with a different model") {
+		t.Errorf("search without --follow = %d %v, want the stale dimension check to fail", code, resp)
+	}
+
+	rec := httptest.NewRecorder()
+	following.handleUpload(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("sourdough needs a starter")))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("--follow upload with the new dimension = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
+
+// dbStats is what stats prints, also its --json output
+type dbStats struct {
+	Conversations   int     `json:"conversations"`
+	Chunks          int     `json:"chunks"`
+	ChunksPerConv   float64 `json:"avg_chunks_per_conversation"`
+	Embeddings      int     `json:"embeddings"`
+	ChunkEmbeddings int     `json:"chunk_embeddings"`
+	ConvEmbeddings  int     `json:"conversation_embeddings"`
+	EmbeddingDim    int     `json:"embedding_dim"`
+	FileBytes       int64   `json:"file_bytes"`
+	WALBytes        int64   `json:"wal_bytes"`
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Summarize how much is stored and how big the database is",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var st dbStats
+		for _, c := range []struct {
+			dest *int
+			fn   func() (int, error)
+		}{
+			{&st.Conversations, store.CountConversations},
+			{&st.Chunks, store.CountChunks},
+			{&st.ChunkEmbeddings, store.CountChunkEmbeddings},
+			{&st.ConvEmbeddings, store.CountConversationEmbeddings},
+		} {
+			if *c.dest, err = c.fn(); err != nil {
+				return err
+			}
+		}
+		st.Embeddings = st.ChunkEmbeddings + st.ConvEmbeddings
+		if st.Conversations > 0 {
+			st.ChunksPerConv = float64(st.Chunks) / float64(st.Conversations)
+		}
+		st.EmbeddingDim = store.Dimension()
+
+		fi, err := os.Stat(dbPath)
+		if err != nil {
+			return err
+		}
+		st.FileBytes = fi.Size()
+		// Recent writes may still be in the write-ahead log
+		if fi, err := os.Stat(dbPath + "-wal"); err == nil {
+			st.WALBytes = fi.Size()
+		}
+
+		if jsonOutput {
+			return writeJSON(st)
+		}
+
+		fmt.Printf("Conversations:      %d\n", st.Conversations)
+		fmt.Printf("Chunks:             %d (%.1f per conversation)\n", st.Chunks, st.ChunksPerConv)
+		fmt.Printf("Embeddings:         %d (%d chunks, %d whole conversations)\n", st.Embeddings, st.ChunkEmbeddings, st.ConvEmbeddings)
+		if st.EmbeddingDim > 0 {
+			fmt.Printf("Embedding dim:      %d\n", st.EmbeddingDim)
+		} else {
+			fmt.Println("Embedding dim:      (nothing embedded yet)")
+		}
+		fmt.Printf("Database file:      %s (%s on disk", dbPath, formatBytes(st.FileBytes))
+		if st.WALBytes > 0 {
+			fmt.Printf(", plus %s in the WAL", formatBytes(st.WALBytes))
+		}
+		fmt.Println(")")
+		return nil
+	},
+}
+
+// formatBytes renders a size with a binary unit, e.g. 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,250 +2,2039 @@ package main
 
 import (
 	"database/sql"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// fetchedContent counts the conversation content bytes Get and GetPreview
+// have read, so tests can tell a preview from a whole conversation
+var fetchedContent atomic.Int64
+
+// Store writes through a single connection and reads through a separate
+// pool, so searches run in parallel with each other and with a writer.
 type Store struct {
-	db *sql.DB
+	db  *sql.DB
+	rdb *sql.DB
+
+	// sampled by ValidateQueryDim on first use, and again after Refresh
+	sampleMu  sync.Mutex
+	sampled   bool
+	storedDim int
+	dimErr    error
+
+	// dim is the embedding length recorded in meta, 0 until the first
+	// embedding is stored. Every embedding written must match it.
+	dimMu sync.Mutex
+	dim   int
+
+	// metric is the distance search ranks and thresholds by, see SetMetric
+	metric string
+	// normalize scales embeddings and queries to unit length, see
+	// SetNormalize
+	normalize bool
+	// created is whether migrate built the schema of an empty database
+	created bool
+}
+
+// Distance metrics. Cosine ignores vector length; L2 is Euclidean
+// distance, which ranks the same as cosine for normalized embeddings but
+// on a different scale.
+const (
+	metricCosine = "cosine"
+	metricL2     = "l2"
+)
+
+// metaDistanceMetric records the metric a database was created with.
+// Databases from before it was recorded use cosine.
+const metaDistanceMetric = "distance_metric"
+
+// metaNormalize records whether a database stores L2-normalized
+// embeddings. Databases from before it was recorded don't.
+const metaNormalize = "normalize_embeddings"
+
+// metaEmbeddingDim records the database's embedding dimension so it
+// doesn't depend on which model the code happens to default to
+const metaEmbeddingDim = "embedding_dim"
+
+type Conversation struct {
+	ID        string
+	Content   string
+	CreatedAt time.Time
+	// Title is the original title of imported conversations, if any
+	Title string
+	// Note is the user's own annotation, see SetNote
+	Note string
+
+	// set on uploads stored with --on-conflict version: ParentID is the
+	// original conversation and Version counts from 2 (the original is 1)
+	ParentID string
+	Version  int
+}
+
+type Chunk struct {
+	ID       string
+	ConvID   string
+	Content  string
+	Position int
+	// CreatedAt is when the chunk was last (re)written, zero for chunks
+	// stored before it was recorded
+	CreatedAt time.Time
+}
+
+// chunkIDSep joins a conversation ID and chunk position into a chunk ID.
+// Positions are always the text after the last separator, so conversation
+// IDs may contain it too.
+const chunkIDSep = "_"
+
+func chunkID(convID string, position int) string {
+	return convID + chunkIDSep + strconv.Itoa(position)
+}
+
+// titlePosition is the position of a conversation's title pseudo-chunk,
+// stored with --index-titles so a query can match the title alone
+const titlePosition = -1
+
+// isTitleChunk reports whether id is a title pseudo-chunk's
+func isTitleChunk(id string) bool {
+	_, pos, err := ParseChunkID(id)
+	return err == nil && pos == titlePosition
+}
+
+// versionSep joins an original conversation ID and a version number into
+// the ID of a later version stored with --on-conflict version
+const versionSep = "-v"
+
+func versionID(parentID string, version int) string {
+	return parentID + versionSep + strconv.Itoa(version)
+}
+
+// baseID strips a version suffix, returning the ID of the original
+// conversation a version was uploaded from
+func baseID(id string) string {
+	i := strings.LastIndex(id, versionSep)
+	if i <= 0 {
+		return id
+	}
+	if _, err := strconv.Atoi(id[i+len(versionSep):]); err != nil {
+		return id
+	}
+	return id[:i]
+}
+
+// ParseChunkID splits a chunk ID back into its conversation ID and
+// position, which is titlePosition for a title pseudo-chunk
+func ParseChunkID(id string) (string, int, error) {
+	i := strings.LastIndex(id, chunkIDSep)
+	if i <= 0 || i == len(id)-len(chunkIDSep) {
+		return "", 0, fmt.Errorf("invalid chunk id %q", id)
+	}
+
+	pos, err := strconv.Atoi(id[i+len(chunkIDSep):])
+	if err != nil || pos < titlePosition || strconv.Itoa(pos) != id[i+len(chunkIDSep):] {
+		return "", 0, fmt.Errorf("invalid chunk id %q: bad position", id)
+	}
+	return id[:i], pos, nil
+}
+
+// NewStore opens (creating if needed) the database at path. Store is safe
+// for concurrent use: WAL lets readers run alongside a writer, and the busy
+// timeout makes writers from other processes wait for the lock instead of
+// failing with "database is locked".
+func NewStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(path))
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("ping db: %w", err)
+	}
+
+	// SQLite allows one writer at a time, a single connection queues
+	// writes in-process instead of contending for the file lock
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	rdb, err := sql.Open("sqlite3", sqliteDSN(path)+"&_query_only=true")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open read pool: %w", err)
+	}
+	s.rdb = rdb
+
+	if err := s.loadDimension(true); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.loadMetric(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.loadNormalize(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewReadOnlyStore opens an existing database so that any write fails.
+// No migrations run, so the schema must already be current.
+func NewReadOnlyStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open db read-only: %w", err)
+	}
+
+	s := &Store{db: db, rdb: db}
+	if _, err := s.storedSchemaVersion(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadDimension(false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadMetric(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadNormalize(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadDimension reads the recorded embedding dimension. Databases from
+// before it was recorded get it from a stored embedding, saved back to
+// meta when backfill is set.
+func (s *Store) loadDimension(backfill bool) error {
+	v, ok, err := s.GetMeta(metaEmbeddingDim)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.dim, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("stored embedding dimension %q: %w", v, err)
+		}
+		return nil
+	}
+
+	s.dim, err = s.EmbeddingDim()
+	if err != nil || s.dim == 0 || !backfill {
+		return err
+	}
+	return s.SetMeta(metaEmbeddingDim, strconv.Itoa(s.dim))
+}
+
+func (s *Store) loadMetric() error {
+	v, ok, err := s.GetMeta(metaDistanceMetric)
+	if err != nil {
+		return err
+	}
+	s.metric = metricCosine
+	if ok {
+		if distanceFunc(v) == nil {
+			return fmt.Errorf("stored distance metric %q is unknown", v)
+		}
+		s.metric = v
+	}
+	return nil
+}
+
+// Metric returns the distance metric searches use
+func (s *Store) Metric() string {
+	return s.metric
+}
+
+// HasMetric reports whether the database has a metric recorded
+func (s *Store) HasMetric() (bool, error) {
+	_, ok, err := s.GetMeta(metaDistanceMetric)
+	return ok, err
+}
+
+// SetMetric records the distance metric searches use. Embeddings are
+// compared at query time, so stored vectors don't depend on it, but
+// thresholds do.
+func (s *Store) SetMetric(metric string) error {
+	if distanceFunc(metric) == nil {
+		return fmt.Errorf("unknown distance metric %q (want %s or %s)", metric, metricCosine, metricL2)
+	}
+	if err := s.SetMeta(metaDistanceMetric, metric); err != nil {
+		return err
+	}
+	s.metric = metric
+	return nil
+}
+
+func (s *Store) loadNormalize() error {
+	v, ok, err := s.GetMeta(metaNormalize)
+	if err != nil || !ok {
+		return err
+	}
+	s.normalize, err = strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("stored %s %q: %w", metaNormalize, v, err)
+	}
+	return nil
+}
+
+// Normalizes reports whether embeddings are L2-normalized when saved and
+// queries before searching
+func (s *Store) Normalizes() bool {
+	return s.normalize
+}
+
+// HasNormalize reports whether the database has recorded whether it
+// normalizes embeddings
+func (s *Store) HasNormalize() (bool, error) {
+	_, ok, err := s.GetMeta(metaNormalize)
+	return ok, err
+}
+
+// SetNormalize records whether embeddings are normalized. It only affects
+// vectors saved from now on, so it belongs to new databases, before
+// anything is embedded.
+func (s *Store) SetNormalize(normalize bool) error {
+	if err := s.SetMeta(metaNormalize, strconv.FormatBool(normalize)); err != nil {
+		return err
+	}
+	s.normalize = normalize
+	return nil
+}
+
+// prepare is how an embedding is stored or searched with: normalized to
+// unit length if the database normalizes, as-is otherwise
+func (s *Store) prepare(embedding []float32) []float32 {
+	if !s.normalize {
+		return embedding
+	}
+	return normalizeVector(embedding)
+}
+
+// distance compares two embeddings with the store's metric
+func (s *Store) distance(a, b []float32) float64 {
+	return distanceFunc(s.metric)(a, b)
+}
+
+// Dimension returns the database's embedding dimension, 0 if nothing has
+// been embedded yet
+func (s *Store) Dimension() int {
+	s.dimMu.Lock()
+	defer s.dimMu.Unlock()
+	return s.dim
+}
+
+// ResetDimension forgets the recorded dimension so a reindex can switch
+// to a model with a different one
+func (s *Store) ResetDimension() error {
+	s.dimMu.Lock()
+	defer s.dimMu.Unlock()
+	if _, err := s.db.Exec(`DELETE FROM meta WHERE key = ?`, metaEmbeddingDim); err != nil {
+		return fmt.Errorf("reset embedding dimension: %w", err)
+	}
+	s.dim = 0
+	return nil
+}
+
+// claimDimension checks an embedding against the recorded dimension,
+// recording it through e if this is the first embedding. It reports
+// whether it recorded one, so callers in a transaction can undo s.dim if
+// the transaction fails. The caller holds dimMu.
+func (s *Store) claimDimension(e execer, embedding []float32) (bool, error) {
+	if s.dim != 0 {
+		if len(embedding) != s.dim {
+			return false, fmt.Errorf("embedding has %d dims but the database holds %d-dim ones; use the original model or reindex", len(embedding), s.dim)
+		}
+		return false, nil
+	}
+	if _, err := e.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, metaEmbeddingDim, strconv.Itoa(len(embedding))); err != nil {
+		return false, fmt.Errorf("record embedding dimension: %w", err)
+	}
+	s.dim = len(embedding)
+	return true, nil
+}
+
+// sqliteDSN adds the connection options every Store connection needs
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+}
+
+// metaSchemaVersion records how many of migrations a database has had
+const metaSchemaVersion = "schema_version"
+
+// migrations build the schema in order: migrations[i] takes a database
+// from schema version i to i+1. Databases from before the version was
+// recorded start at 0 whatever they already have, so every step must be
+// safe to rerun over a schema it already created. Add new steps at the
+// end; never change or reorder released ones.
+var migrations = []func(s *Store) error{
+	(*Store).migrateBase,
+	(*Store).migrateUsageColumns,
+	(*Store).migrateVersions,
+	(*Store).migrateTitleNote,
+	(*Store).migrateTags,
+	(*Store).migrateFTS,
+	(*Store).migrateRawEmbeddings,
+	(*Store).migrateEmbeddingCache,
+}
+
+// schemaVersion is the version of a database all migrations have run on
+var schemaVersion = len(migrations)
+
+// migrate brings the schema up to schemaVersion, recording the version
+// after each step so an interrupted upgrade resumes where it stopped
+func (s *Store) migrate() error {
+	// meta holds the version, so it comes before any step
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS meta (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	version, err := s.storedSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'conversations'`).Scan(&n); err != nil {
+			return fmt.Errorf("look for tables: %w", err)
+		}
+		s.created = n == 0
+	}
+	for v := version; v < schemaVersion; v++ {
+		if err := migrations[v](s); err != nil {
+			return fmt.Errorf("schema version %d: %w", v+1, err)
+		}
+		if err := s.SetMeta(metaSchemaVersion, strconv.Itoa(v+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Created reports whether the database was empty when NewStore opened it,
+// so this Store created its schema
+func (s *Store) Created() bool {
+	return s.created
+}
+
+// storedSchemaVersion reads the recorded schema version, 0 if there is
+// none. A database from a newer memctx is refused rather than written to
+// with a schema it doesn't know.
+func (s *Store) storedSchemaVersion() (int, error) {
+	var v string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, metaSchemaVersion).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get meta %s: %w", metaSchemaVersion, err)
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("stored schema version %q: %w", v, err)
+	}
+	if version > schemaVersion {
+		return 0, fmt.Errorf("database schema version %d is newer than this memctx supports (%d), upgrade memctx", version, schemaVersion)
+	}
+	return version, nil
+}
+
+// migrateBase creates the original tables: conversations and their
+// chunks, failed chunks and feedback
+func (s *Store) migrateBase() error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS conversations (
+			id TEXT PRIMARY KEY,
+			content TEXT NOT NULL,
+			embedding TEXT,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS chunks (
+			id TEXT PRIMARY KEY,
+			conv_id TEXT NOT NULL,
+			content TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			embedding TEXT,
+			FOREIGN KEY (conv_id) REFERENCES conversations(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_chunks_conv_id ON chunks(conv_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_chunks_conv_position ON chunks(conv_id, position)`,
+		`CREATE TABLE IF NOT EXISTS failed_chunks (
+			chunk_id TEXT PRIMARY KEY,
+			conv_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			text_hash TEXT NOT NULL,
+			error TEXT NOT NULL,
+			failed_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS feedback (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			query TEXT NOT NULL,
+			threshold REAL NOT NULL,
+			results INTEGER NOT NULL,
+			signal TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUsageColumns adds when conversations were last returned and
+// which model embedded them, and when chunks were written
+func (s *Store) migrateUsageColumns() error {
+	if err := s.addColumn("conversations", "last_accessed_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := s.addColumn("chunks", "created_at", "DATETIME"); err != nil {
+		return err
+	}
+	return s.addColumn("conversations", "embed_model", "TEXT")
+}
+
+// migrateVersions adds the link from a conversation version to its root
+func (s *Store) migrateVersions() error {
+	if err := s.addColumn("conversations", "parent_id", "TEXT"); err != nil {
+		return err
+	}
+	return s.addColumn("conversations", "version", "INTEGER")
+}
+
+// migrateTitleNote adds imported titles and user notes
+func (s *Store) migrateTitleNote() error {
+	if err := s.addColumn("conversations", "title", "TEXT"); err != nil {
+		return err
+	}
+	return s.addColumn("conversations", "note", "TEXT")
+}
+
+func (s *Store) migrateTags() error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS tags (
+			conv_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (conv_id, tag)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag)`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) migrateRawEmbeddings() error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS raw_embeddings (
+			chunk_id TEXT PRIMARY KEY,
+			conv_id TEXT NOT NULL,
+			embedding BLOB NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_raw_embeddings_conv_id ON raw_embeddings(conv_id)`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) migrateEmbeddingCache() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS chunk_embedding_cache (
+			text_hash TEXT NOT NULL,
+			model TEXT NOT NULL,
+			embedding TEXT NOT NULL,
+			PRIMARY KEY (text_hash, model)
+		)
+	`)
+	return err
+}
+
+// migrateFTS creates chunks_fts, the full-text index of chunk content
+// behind SearchText. Its docids are chunk rowids and triggers keep it in
+// step with chunks; a database from before it existed is indexed once.
+func (s *Store) migrateFTS() error {
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'chunks_fts'`).Scan(&n); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS chunks_fts USING fts4(content)`,
+		`CREATE TRIGGER IF NOT EXISTS chunks_fts_insert AFTER INSERT ON chunks BEGIN
+			INSERT INTO chunks_fts (docid, content) VALUES (new.rowid, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS chunks_fts_update AFTER UPDATE OF content ON chunks BEGIN
+			UPDATE chunks_fts SET content = new.content WHERE docid = old.rowid;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS chunks_fts_delete AFTER DELETE ON chunks BEGIN
+			DELETE FROM chunks_fts WHERE docid = old.rowid;
+		END`,
+	} {
+		if _, err := s.db.Exec(q); err != nil {
+			return fmt.Errorf("full-text index: %w", err)
+		}
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := s.db.Exec(`INSERT INTO chunks_fts (docid, content) SELECT rowid, content FROM chunks`); err != nil {
+		return fmt.Errorf("build full-text index: %w", err)
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already there
+func (s *Store) addColumn(table, column, decl string) error {
+	rows, err := s.db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so writes can run
+// standalone or as part of a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *Store) Save(c Conversation) error {
+	return saveConversation(s.db, c)
+}
+
+func saveConversation(e execer, c Conversation) error {
+	_, err := e.Exec(
+		`INSERT OR REPLACE INTO conversations (id, content, created_at, parent_id, version, title, note)
+		 VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), (SELECT note FROM conversations WHERE id = ?))`,
+		c.ID, c.Content, c.CreatedAt.Format(time.RFC3339), c.ParentID, c.Version, c.Title, c.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("insert conversation: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) SaveEmbedding(id string, embedding []float32) error {
+	embedding = s.prepare(embedding)
+	s.dimMu.Lock()
+	defer s.dimMu.Unlock()
+	if _, err := s.claimDimension(s.db, embedding); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(embedding)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE conversations SET embedding = ? WHERE id = ?`, string(data), id)
+	if err != nil {
+		return fmt.Errorf("save embedding: %w", err)
+	}
+	return nil
+}
+
+// ClearConversationEmbeddings drops the whole-conversation embeddings of
+// databases from before chunking. A reindex replaces them with chunk
+// embeddings, and left behind they would keep the old model's dimension.
+func (s *Store) ClearConversationEmbeddings() error {
+	if _, err := s.db.Exec(`UPDATE conversations SET embedding = NULL WHERE embedding IS NOT NULL`); err != nil {
+		return fmt.Errorf("clear conversation embeddings: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) SaveChunk(c Chunk) error {
+	return saveChunk(s.db, c)
+}
+
+func saveChunk(e execer, c Chunk) error {
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = time.Now()
+	}
+	// An upsert rather than INSERT OR REPLACE: the replaced row's delete
+	// wouldn't fire the trigger that keeps chunks_fts in step. Like a
+	// replace, it clears any old embedding.
+	_, err := e.Exec(
+		`INSERT INTO chunks (id, conv_id, content, position, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (id) DO UPDATE SET conv_id = excluded.conv_id, content = excluded.content,
+			position = excluded.position, created_at = excluded.created_at, embedding = NULL`,
+		c.ID, c.ConvID, c.Content, c.Position, c.CreatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+func (s *Store) SaveChunkEmbedding(id string, embedding []float32) error {
+	embedding = s.prepare(embedding)
+	s.dimMu.Lock()
+	defer s.dimMu.Unlock()
+	if _, err := s.claimDimension(s.db, embedding); err != nil {
+		return err
+	}
+	return saveChunkEmbedding(s.db, id, embedding)
+}
+
+func saveChunkEmbedding(e execer, id string, embedding []float32) error {
+	data, err := json.Marshal(embedding)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec(`UPDATE chunks SET embedding = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
+// CachedEmbedding returns the embedding a model produced for text with
+// this hash before, and false if there is none
+func (s *Store) CachedEmbedding(textHash, model string) ([]float32, bool, error) {
+	var embJSON string
+	err := s.rdb.QueryRow(`SELECT embedding FROM chunk_embedding_cache WHERE text_hash = ? AND model = ?`, textHash, model).Scan(&embJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get cached embedding: %w", err)
+	}
+	var emb []float32
+	if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+		return nil, false, fmt.Errorf("decode cached embedding: %w", err)
+	}
+	return emb, true, nil
+}
+
+// CacheEmbedding remembers the embedding a model produced for text with
+// this hash. Entries outlive the chunks they were made for, so reindexing
+// with other chunk settings still finds the unchanged ones.
+func (s *Store) CacheEmbedding(textHash, model string, embedding []float32) error {
+	data, err := json.Marshal(embedding)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`INSERT OR REPLACE INTO chunk_embedding_cache (text_hash, model, embedding) VALUES (?, ?, ?)`, textHash, model, string(data)); err != nil {
+		return fmt.Errorf("cache embedding: %w", err)
+	}
+	return nil
+}
+
+// SaveRawEmbedding keeps a copy of a chunk's embedding as little-endian
+// float32 bytes in raw_embeddings, a plain table that doesn't depend on
+// how the search index stores vectors
+func (s *Store) SaveRawEmbedding(chunkID, convID string, embedding []float32) error {
+	return saveRawEmbedding(s.db, chunkID, convID, embedding)
+}
+
+func saveRawEmbedding(e execer, chunkID, convID string, embedding []float32) error {
+	_, err := e.Exec(`INSERT OR REPLACE INTO raw_embeddings (chunk_id, conv_id, embedding) VALUES (?, ?, ?)`,
+		chunkID, convID, encodeRawEmbedding(embedding))
+	if err != nil {
+		return fmt.Errorf("save raw embedding %s: %w", chunkID, err)
+	}
+	return nil
+}
+
+// RawEmbedding returns a chunk's raw embedding, and false if none was kept
+func (s *Store) RawEmbedding(chunkID string) ([]float32, bool, error) {
+	var data []byte
+	err := s.rdb.QueryRow(`SELECT embedding FROM raw_embeddings WHERE chunk_id = ?`, chunkID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get raw embedding %s: %w", chunkID, err)
+	}
+	if len(data)%4 != 0 {
+		return nil, false, fmt.Errorf("raw embedding %s: %d bytes is not a float32 vector", chunkID, len(data))
+	}
+	return decodeRawEmbedding(data), true, nil
+}
+
+func encodeRawEmbedding(v []float32) []byte {
+	data := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(f))
+	}
+	return data
+}
+
+func decodeRawEmbedding(data []byte) []float32 {
+	v := make([]float32, len(data)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return v
+}
+
+// SetEmbedModel records which model embedded a conversation's chunks
+func (s *Store) SetEmbedModel(convID, model string) error {
+	return setEmbedModel(s.db, convID, model)
+}
+
+func setEmbedModel(e execer, convID, model string) error {
+	if _, err := e.Exec(`UPDATE conversations SET embed_model = ? WHERE id = ?`, model, convID); err != nil {
+		return fmt.Errorf("set embed model: %w", err)
+	}
+	return nil
+}
+
+// EmbedModels counts conversations per recorded embedding model.
+// Conversations stored before models were tracked are left out.
+func (s *Store) EmbedModels() (map[string]int, error) {
+	rows, err := s.rdb.Query(`SELECT embed_model, COUNT(*) FROM conversations WHERE embed_model IS NOT NULL GROUP BY embed_model`)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	models := make(map[string]int)
+	for rows.Next() {
+		var model string
+		var n int
+		if err := rows.Scan(&model, &n); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		models[model] = n
+	}
+	return models, rows.Err()
+}
+
+// IndexedConversation is a conversation with its chunks already embedded,
+// Embeddings[i] belonging to Chunks[i]
+type IndexedConversation struct {
+	Conversation Conversation
+	Chunks       []Chunk
+	Embeddings   [][]float32
+	EmbedModel   string
+	// StoreRaw also keeps each embedding in raw_embeddings, as
+	// SaveRawEmbedding does
+	StoreRaw bool
+}
+
+// SaveIndexed writes fully embedded conversations in a single transaction,
+// so either all of them are stored or none are
+func (s *Store) SaveIndexed(items []IndexedConversation) (err error) {
+	s.dimMu.Lock()
+	defer s.dimMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	claimed := false
+	defer func() {
+		if err != nil && claimed {
+			s.dim = 0
+		}
+	}()
+
+	for _, item := range items {
+		if err := saveConversation(tx, item.Conversation); err != nil {
+			return err
+		}
+		if err := setEmbedModel(tx, item.Conversation.ID, item.EmbedModel); err != nil {
+			return err
+		}
+		for i, c := range item.Chunks {
+			if err := saveChunk(tx, c); err != nil {
+				return fmt.Errorf("save chunk %s: %w", c.ID, err)
+			}
+			embedding := s.prepare(item.Embeddings[i])
+			ok, err := s.claimDimension(tx, embedding)
+			if err != nil {
+				return fmt.Errorf("save chunk embedding %s: %w", c.ID, err)
+			}
+			claimed = claimed || ok
+			if err := saveChunkEmbedding(tx, c.ID, embedding); err != nil {
+				return fmt.Errorf("save chunk embedding %s: %w", c.ID, err)
+			}
+			if item.StoreRaw {
+				if err := saveRawEmbedding(tx, c.ID, c.ConvID, item.Embeddings[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetChunk returns a single chunk by ID
+func (s *Store) GetChunk(id string) (Chunk, error) {
+	var c Chunk
+	var ts sql.NullString
+	err := s.rdb.QueryRow(
+		`SELECT id, conv_id, content, position, created_at FROM chunks WHERE id = ?`, id,
+	).Scan(&c.ID, &c.ConvID, &c.Content, &c.Position, &ts)
+	if err != nil {
+		return c, fmt.Errorf("get chunk %s: %w", id, err)
+	}
+	c.CreatedAt, _ = time.Parse(time.RFC3339, ts.String)
+	return c, nil
+}
+
+// ChunksForConversation returns a conversation's chunks in position order
+func (s *Store) ChunksForConversation(convID string) ([]Chunk, error) {
+	rows, err := s.rdb.Query(
+		`SELECT id, conv_id, content, position, created_at FROM chunks WHERE conv_id = ? ORDER BY position`, convID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []Chunk
+	for rows.Next() {
+		var c Chunk
+		var ts sql.NullString
+		if err := rows.Scan(&c.ID, &c.ConvID, &c.Content, &c.Position, &ts); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts.String)
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// ChunkEmbeddings returns a conversation's chunk embeddings by chunk ID.
+// Chunks without an embedding are missing from the map.
+func (s *Store) ChunkEmbeddings(convID string) (map[string][]float32, error) {
+	rows, err := s.rdb.Query(`SELECT id, embedding FROM chunks WHERE conv_id = ? AND embedding IS NOT NULL`, convID)
+	if err != nil {
+		return nil, fmt.Errorf("query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	embs := make(map[string][]float32)
+	for rows.Next() {
+		var id, embJSON string
+		if err := rows.Scan(&id, &embJSON); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		var emb []float32
+		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+			return nil, fmt.Errorf("decode embedding %s: %w", id, err)
+		}
+		embs[id] = emb
+	}
+	return embs, rows.Err()
+}
+
+// FailedChunk is a dead-letter entry for a chunk whose embedding
+// exhausted its retries
+type FailedChunk struct {
+	ChunkID  string
+	ConvID   string
+	Position int
+	TextHash string
+	Error    string
+	FailedAt time.Time
+}
+
+func (s *Store) SaveFailedChunk(f FailedChunk) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO failed_chunks (chunk_id, conv_id, position, text_hash, error, failed_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		f.ChunkID, f.ConvID, f.Position, f.TextHash, f.Error, f.FailedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("insert failed chunk: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ListFailedChunks() ([]FailedChunk, error) {
+	rows, err := s.rdb.Query(`SELECT chunk_id, conv_id, position, text_hash, error, failed_at FROM failed_chunks ORDER BY conv_id, position`)
+	if err != nil {
+		return nil, fmt.Errorf("query failed chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var failed []FailedChunk
+	for rows.Next() {
+		var f FailedChunk
+		var ts string
+		if err := rows.Scan(&f.ChunkID, &f.ConvID, &f.Position, &f.TextHash, &f.Error, &ts); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		f.FailedAt, _ = time.Parse(time.RFC3339, ts)
+		failed = append(failed, f)
+	}
+	return failed, rows.Err()
+}
+
+func (s *Store) ClearFailedChunk(chunkID string) error {
+	_, err := s.db.Exec(`DELETE FROM failed_chunks WHERE chunk_id = ?`, chunkID)
+	return err
+}
+
+type SearchResult struct {
+	ID       string
+	ConvID   string
+	Content  string
+	Distance float64
+	// CreatedAt is when a chunk result was written, zero for whole
+	// conversation results
+	CreatedAt time.Time
+	// KeywordScore ranks SearchText results, which have no Distance
+	KeywordScore float64
+	// Hybrid explains the rank of SearchHybrid results, nil for others
+	Hybrid *HybridScore
+}
+
+// Search searches whole-conversation embeddings. A non-empty tag limits it
+// to conversations with that tag.
+func (s *Store) Search(query []float32, limit int, threshold float64, tag string) ([]SearchResult, error) {
+	query = s.prepare(query)
+	rows, err := s.rdb.Query(`SELECT id, embedding FROM conversations WHERE embedding IS NOT NULL`+tagFilterSQL("id", tag), tagArgs(tag)...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var id, embJSON string
+		if err := rows.Scan(&id, &embJSON); err != nil {
+			continue
+		}
+
+		var emb []float32
+		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+			continue
+		}
+
+		dist := s.distance(query, emb)
+		// Only include results below threshold (lower distance = more similar)
+		if dist < threshold {
+			results = append(results, SearchResult{ID: id, ConvID: id, Distance: dist})
+		}
+	}
+
+	// Sort by distance (ascending)
+	for i := 0; i < len(results); i++ {
+		for j := i + 1; j < len(results); j++ {
+			if results[j].Distance < results[i].Distance {
+				results[i], results[j] = results[j], results[i]
+			}
+		}
+	}
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// SearchChunks searches across all chunks and returns best matches. A
+// non-empty tag limits it to chunks of conversations with that tag.
+func (s *Store) SearchChunks(query []float32, limit int, threshold float64, tag string) ([]SearchResult, error) {
+	query = s.prepare(query)
+	rows, err := s.rdb.Query(`SELECT id, conv_id, content, embedding, created_at FROM chunks WHERE embedding IS NOT NULL`+tagFilterSQL("conv_id", tag), tagArgs(tag)...)
+	if err != nil {
+		return nil, fmt.Errorf("query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var id, convID, content, embJSON string
+		var ts sql.NullString
+		if err := rows.Scan(&id, &convID, &content, &embJSON, &ts); err != nil {
+			continue
+		}
+
+		var emb []float32
+		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+			continue
+		}
+
+		dist := s.distance(query, emb)
+		if dist < threshold {
+			createdAt, _ := time.Parse(time.RFC3339, ts.String)
+			results = append(results, SearchResult{ID: id, ConvID: convID, Content: content, Distance: dist, CreatedAt: createdAt})
+		}
+	}
+
+	// Sort by distance (ascending)
+	for i := 0; i < len(results); i++ {
+		for j := i + 1; j < len(results); j++ {
+			if results[j].Distance < results[i].Distance {
+				results[i], results[j] = results[j], results[i]
+			}
+		}
+	}
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// SearchText finds chunks containing every word of query, for exact
+// identifiers that embeddings blur, like error codes or function names.
+// Each word is matched as a phrase of its tokens, so punctuation in it
+// isn't query syntax. Results are ranked by a TF-IDF score in
+// KeywordScore and have no Distance. A non-empty tag limits it to chunks
+// of conversations with that tag.
+func (s *Store) SearchText(query string, limit int, tag string) ([]SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+	rows, err := s.rdb.Query(
+		`SELECT c.id, c.conv_id, c.content, c.created_at, matchinfo(chunks_fts, 'pcnx')
+		FROM chunks_fts JOIN chunks c ON c.rowid = chunks_fts.docid
+		WHERE chunks_fts MATCH ?`+tagFilterSQL("c.conv_id", tag),
+		append([]any{match}, tagArgs(tag)...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("keyword search: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		var ts sql.NullString
+		var info []byte
+		if err := rows.Scan(&r.ID, &r.ConvID, &r.Content, &ts, &info); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		r.CreatedAt, _ = time.Parse(time.RFC3339, ts.String)
+		r.KeywordScore = matchScore(info)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].KeywordScore > results[j].KeywordScore })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// HybridScore is how SearchHybrid ranked a result, see there for the
+// formula
+type HybridScore struct {
+	// Keyword is the result's SearchText score, 0 if it wasn't a keyword
+	// match
+	Keyword float64
+	// VectorNorm and KeywordNorm are the vector and keyword scores scaled
+	// to 0..1, 0 for a side that didn't find the result
+	VectorNorm  float64
+	KeywordNorm float64
+	// Fused is alpha*VectorNorm + (1-alpha)*KeywordNorm, which Rank (from
+	// 1) orders by
+	Fused float64
+	Rank  int
+}
+
+// SearchHybrid fuses SearchChunks and SearchText into one ranking, so a
+// chunk that shares the query's rare words ranks well even when its
+// embedding is far off, and the other way round. Each side's scores are
+// scaled to 0..1: a vector match scores (dmax-d)/(dmax-dmin) over the
+// vector matches' distances (1 if they are all equal), a keyword match
+// its score over the best keyword score. Results rank by
+// alpha*vector + (1-alpha)*keyword, ties going to the smaller distance,
+// and carry the breakdown in Hybrid. Alpha 1 or 0 leaves out the other
+// side entirely, reproducing pure vector or pure keyword search. Either
+// half may find nothing and the other's results still come through.
+// Keyword matches are given their distance to query, which may be beyond
+// threshold; chunks without an embedding are left out.
+func (s *Store) SearchHybrid(query []float32, text string, limit int, threshold, alpha float64, tag string) ([]SearchResult, error) {
+	query = s.prepare(query)
+	var semantic, keyword []SearchResult
+	var err error
+	if alpha > 0 {
+		if semantic, err = s.SearchChunks(query, limit, threshold, tag); err != nil {
+			return nil, err
+		}
+	}
+	if alpha < 1 {
+		if keyword, err = s.SearchText(text, limit, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	fused := make([]SearchResult, 0, len(semantic)+len(keyword))
+	index := make(map[string]int)
+	for i, r := range semantic {
+		r.Hybrid = &HybridScore{VectorNorm: 1}
+		if dmin, dmax := semantic[0].Distance, semantic[len(semantic)-1].Distance; dmax > dmin {
+			r.Hybrid.VectorNorm = (dmax - r.Distance) / (dmax - dmin)
+		}
+		index[r.ID] = i
+		fused = append(fused, r)
+	}
+	for _, r := range keyword {
+		norm := 1.0
+		if best := keyword[0].KeywordScore; best > 0 {
+			norm = r.KeywordScore / best
+		}
+		if i, ok := index[r.ID]; ok {
+			fused[i].Hybrid.Keyword, fused[i].Hybrid.KeywordNorm = r.KeywordScore, norm
+			continue
+		}
+
+		var embJSON sql.NullString
+		if err := s.rdb.QueryRow(`SELECT embedding FROM chunks WHERE id = ?`, r.ID).Scan(&embJSON); err != nil {
+			return nil, fmt.Errorf("get chunk %s: %w", r.ID, err)
+		}
+		var emb []float32
+		if !embJSON.Valid || json.Unmarshal([]byte(embJSON.String), &emb) != nil {
+			continue
+		}
+		r.Distance = s.distance(query, emb)
+		r.Hybrid = &HybridScore{Keyword: r.KeywordScore, KeywordNorm: norm}
+		r.KeywordScore = 0
+		fused = append(fused, r)
+	}
+
+	for _, r := range fused {
+		r.Hybrid.Fused = alpha*r.Hybrid.VectorNorm + (1-alpha)*r.Hybrid.KeywordNorm
+	}
+	// Ties go to the closer chunk, except with alpha 0 where they keep
+	// the keyword ranking's order
+	sort.SliceStable(fused, func(i, j int) bool {
+		if fi, fj := fused[i].Hybrid.Fused, fused[j].Hybrid.Fused; fi != fj {
+			return fi > fj
+		}
+		return alpha > 0 && fused[i].Distance < fused[j].Distance
+	})
+	if len(fused) > limit {
+		fused = fused[:limit]
+	}
+	for i := range fused {
+		fused[i].Hybrid.Rank = i + 1
+	}
+	return fused, nil
+}
+
+// ftsQuery quotes each word of a query as an FTS phrase; they must all
+// match
+func ftsQuery(query string) string {
+	var phrases []string
+	for _, w := range strings.Fields(query) {
+		phrases = append(phrases, `"`+strings.ReplaceAll(w, `"`, `""`)+`"`)
+	}
+	return strings.Join(phrases, " ")
+}
+
+// matchScore scores a row from its matchinfo 'pcnx' blob: for each phrase,
+// its hits in the row weighted by how rare it is across rows
+func matchScore(info []byte) float64 {
+	ints := make([]uint32, len(info)/4)
+	for i := range ints {
+		ints[i] = binary.NativeEndian.Uint32(info[4*i:])
+	}
+	if len(ints) < 3 {
+		return 0
+	}
+	phrases, cols, rows := int(ints[0]), int(ints[1]), float64(ints[2])
+	var score float64
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < cols; c++ {
+			i := 3 + 3*(p*cols+c)
+			if i+2 >= len(ints) {
+				return score
+			}
+			hits, docs := float64(ints[i]), float64(ints[i+2])
+			score += hits * math.Log(1+rows/max(docs, 1))
+		}
+	}
+	return score
+}
+
+// ChunkVector is a chunk's identity plus its decoded embedding
+type ChunkVector struct {
+	ID        string
+	ConvID    string
+	Position  int
+	Embedding []float32
+}
+
+func (s *Store) CountConversations() (int, error) {
+	return s.count(`SELECT COUNT(*) FROM conversations`)
+}
+
+// CountTagged counts the conversations with a tag, or all of them if tag
+// is empty
+func (s *Store) CountTagged(tag string) (int, error) {
+	return s.count(`SELECT COUNT(*) FROM conversations WHERE 1`+tagFilterSQL("id", tag), tagArgs(tag)...)
+}
+
+func (s *Store) CountChunks() (int, error) {
+	return s.count(`SELECT COUNT(*) FROM chunks`)
+}
+
+// CountConversationEmbeddings counts whole-conversation embeddings, which
+// only databases from before chunking have
+func (s *Store) CountConversationEmbeddings() (int, error) {
+	return s.count(`SELECT COUNT(*) FROM conversations WHERE embedding IS NOT NULL`)
+}
+
+func (s *Store) count(query string, args ...any) (int, error) {
+	var n int
+	if err := s.rdb.QueryRow(query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count: %w", err)
+	}
+	return n, nil
+}
+
+func (s *Store) CountChunkEmbeddings() (int, error) {
+	var count int
+	err := s.rdb.QueryRow(`SELECT COUNT(*) FROM chunks WHERE embedding IS NOT NULL`).Scan(&count)
+	return count, err
+}
+
+// EachChunkEmbedding calls fn for every embedded chunk, ordered by
+// conversation and position
+func (s *Store) EachChunkEmbedding(fn func(ChunkVector) error) error {
+	rows, err := s.rdb.Query(`SELECT id, conv_id, position, embedding FROM chunks WHERE embedding IS NOT NULL ORDER BY conv_id, position`)
+	if err != nil {
+		return fmt.Errorf("query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v ChunkVector
+		var embJSON string
+		if err := rows.Scan(&v.ID, &v.ConvID, &v.Position, &embJSON); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		if err := json.Unmarshal([]byte(embJSON), &v.Embedding); err != nil {
+			return fmt.Errorf("decode embedding %s: %w", v.ID, err)
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EmbeddingDim returns the length of a stored embedding, sampling one chunk
+// (or conversation, for pre-chunking databases). It is 0 for an empty index.
+func (s *Store) EmbeddingDim() (int, error) {
+	var embJSON string
+	err := s.rdb.QueryRow(`
+		SELECT embedding FROM chunks WHERE embedding IS NOT NULL
+		UNION ALL
+		SELECT embedding FROM conversations WHERE embedding IS NOT NULL
+		LIMIT 1
+	`).Scan(&embJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sample embedding: %w", err)
+	}
+
+	var emb []float32
+	if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+		return 0, fmt.Errorf("decode embedding: %w", err)
+	}
+	return len(emb), nil
+}
+
+// ValidateQueryDim checks a query embedding against the length of one
+// stored embedding, sampled on first use. A mismatch means the index was
+// built with another model or the database is damaged.
+func (s *Store) ValidateQueryDim(query []float32) error {
+	s.sampleMu.Lock()
+	if !s.sampled {
+		s.storedDim, s.dimErr = s.EmbeddingDim()
+		s.sampled = true
+	}
+	storedDim, err := s.storedDim, s.dimErr
+	s.sampleMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if storedDim != 0 && storedDim != len(query) {
+		return fmt.Errorf("index appears corrupt or built with a different model: stored embeddings have %d dims, query has %d", storedDim, len(query))
+	}
+	return nil
+}
+
+// DataVersion changes whenever another connection commits to the
+// database (PRAGMA data_version); writes through this Store leave it
+// alone
+func (s *Store) DataVersion() (int64, error) {
+	var v int64
+	if err := s.db.QueryRow(`PRAGMA data_version`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("data version: %w", err)
+	}
+	return v, nil
+}
+
+// Refresh rereads what Store caches from the database, for a process that
+// stays open while others write to it: the recorded dimension, which a
+// reindex with another model changes, and ValidateQueryDim's sample. The
+// metric and normalization are fixed when a database is created.
+func (s *Store) Refresh() error {
+	s.dimMu.Lock()
+	err := s.loadDimension(false)
+	s.dimMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.sampleMu.Lock()
+	s.sampled = false
+	s.sampleMu.Unlock()
+	return nil
+}
+
+func (s *Store) HasChunks() bool {
+	var count int
+	s.rdb.QueryRow(`SELECT COUNT(*) FROM chunks WHERE embedding IS NOT NULL`).Scan(&count)
+	return count > 0
+}
+
+func (s *Store) List() ([]Conversation, error) {
+	rows, err := s.rdb.Query(`SELECT id, content, created_at, COALESCE(title, ''), COALESCE(note, '') FROM conversations ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var convs []Conversation
+	for rows.Next() {
+		var c Conversation
+		var ts string
+		if err := rows.Scan(&c.ID, &c.Content, &ts, &c.Title, &c.Note); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
+}
+
+// GetChunkEmbeddings returns the embeddings of the given chunks by ID.
+// Chunks without an embedding are missing from the map.
+func (s *Store) GetChunkEmbeddings(ids []string) (map[string][]float32, error) {
+	embs := make(map[string][]float32)
+	if len(ids) == 0 {
+		return embs, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.rdb.Query(`SELECT id, embedding FROM chunks WHERE embedding IS NOT NULL AND id IN (`+strings.Repeat("?, ", len(ids)-1)+`?)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, embJSON string
+		if err := rows.Scan(&id, &embJSON); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		var emb []float32
+		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
+			return nil, fmt.Errorf("decode embedding %s: %w", id, err)
+		}
+		embs[id] = emb
+	}
+	return embs, rows.Err()
+}
+
+// GetEmbedding returns a conversation's whole-conversation embedding, and
+// false if it has none. Only databases from before chunking have them;
+// see ChunkEmbeddings for the rest.
+func (s *Store) GetEmbedding(id string) ([]float32, bool, error) {
+	var embJSON sql.NullString
+	err := s.rdb.QueryRow(`SELECT embedding FROM conversations WHERE id = ?`, id).Scan(&embJSON)
+	if err != nil {
+		return nil, false, fmt.Errorf("get embedding %s: %w", id, err)
+	}
+	if !embJSON.Valid {
+		return nil, false, nil
+	}
+	var emb []float32
+	if err := json.Unmarshal([]byte(embJSON.String), &emb); err != nil {
+		return nil, false, fmt.Errorf("decode embedding %s: %w", id, err)
+	}
+	return emb, true, nil
+}
+
+// ListPage is like List but each Content holds only the first n
+// characters, so listing a large store doesn't read every full body. It
+// returns up to limit conversations (all if limit is 0) after skipping
+// offset; ties on created_at are ordered by ID so pages don't overlap. A
+// non-empty tag lists only conversations with that tag.
+func (s *Store) ListPage(n int, tag string, limit, offset int) ([]Conversation, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	args := append([]any{n}, tagArgs(tag)...)
+	rows, err := s.rdb.Query(`SELECT id, substr(content, 1, ?), created_at, COALESCE(title, ''), COALESCE(note, '') FROM conversations WHERE 1`+tagFilterSQL("id", tag)+`
+		ORDER BY created_at DESC, id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var convs []Conversation
+	for rows.Next() {
+		var c Conversation
+		var ts string
+		if err := rows.Scan(&c.ID, &c.Content, &ts, &c.Title, &c.Note); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
 }
 
-type Conversation struct {
-	ID        string
-	Content   string
-	CreatedAt time.Time
+func (s *Store) Get(id string) (Conversation, error) {
+	var c Conversation
+	var ts string
+	var parentID sql.NullString
+	var version sql.NullInt64
+	err := s.rdb.QueryRow(
+		`SELECT id, content, created_at, parent_id, version, COALESCE(title, ''), COALESCE(note, '') FROM conversations WHERE id = ?`, id,
+	).Scan(&c.ID, &c.Content, &ts, &parentID, &version, &c.Title, &c.Note)
+	if err != nil {
+		return c, fmt.Errorf("get conversation %s: %w", id, err)
+	}
+	fetchedContent.Add(int64(len(c.Content)))
+	c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+	c.ParentID = parentID.String
+	c.Version = int(version.Int64)
+	return c, nil
 }
 
-type Chunk struct {
-	ID       string
-	ConvID   string
-	Content  string
-	Position int
+// Exists reports whether a conversation with this ID is stored
+func (s *Store) Exists(id string) (bool, error) {
+	var n int
+	if err := s.rdb.QueryRow(`SELECT COUNT(*) FROM conversations WHERE id = ?`, id).Scan(&n); err != nil {
+		return false, fmt.Errorf("check conversation %s: %w", id, err)
+	}
+	return n > 0, nil
 }
 
-func NewStore(path string) (*Store, error) {
-	db, err := sql.Open("sqlite3", path)
+// Versions returns every version of the conversation rootID, the original
+// first
+func (s *Store) Versions(rootID string) ([]Conversation, error) {
+	rows, err := s.rdb.Query(
+		`SELECT id, content, created_at, COALESCE(parent_id, ''), COALESCE(version, 1) FROM conversations
+		WHERE id = ? OR parent_id = ?
+		ORDER BY COALESCE(version, 1)`,
+		rootID, rootID,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("open db: %w", err)
+		return nil, fmt.Errorf("query: %w", err)
 	}
+	defer rows.Close()
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("ping db: %w", err)
+	var convs []Conversation
+	for rows.Next() {
+		var c Conversation
+		var ts string
+		if err := rows.Scan(&c.ID, &c.Content, &ts, &c.ParentID, &c.Version); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+		convs = append(convs, c)
 	}
+	return convs, rows.Err()
+}
 
-	s := &Store{db: db}
-	if err := s.migrate(); err != nil {
-		return nil, fmt.Errorf("migrate: %w", err)
+// NextVersion returns the version number a new version of the conversation
+// parentID should get. The original counts as version 1.
+func (s *Store) NextVersion(parentID string) (int, error) {
+	var latest int
+	err := s.rdb.QueryRow(
+		`SELECT COALESCE(MAX(COALESCE(version, 1)), 0) FROM conversations WHERE id = ? OR parent_id = ?`,
+		parentID, parentID,
+	).Scan(&latest)
+	if err != nil {
+		return 0, fmt.Errorf("latest version of %s: %w", parentID, err)
 	}
-
-	return s, nil
+	return latest + 1, nil
 }
 
-func (s *Store) migrate() error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS conversations (
-			id TEXT PRIMARY KEY,
-			content TEXT NOT NULL,
-			embedding TEXT,
-			created_at DATETIME NOT NULL
-		)
-	`)
+// GetMeta returns a value from the meta table, with ok false if unset
+func (s *Store) GetMeta(key string) (value string, ok bool, err error) {
+	err = s.rdb.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
 	if err != nil {
-		return err
+		return "", false, fmt.Errorf("get meta %s: %w", key, err)
 	}
+	return value, true, nil
+}
 
-	_, err = s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS chunks (
-			id TEXT PRIMARY KEY,
-			conv_id TEXT NOT NULL,
-			content TEXT NOT NULL,
-			position INTEGER NOT NULL,
-			embedding TEXT,
-			FOREIGN KEY (conv_id) REFERENCES conversations(id)
-		)
-	`)
+func (s *Store) SetMeta(key, value string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, key, value)
 	if err != nil {
-		return err
+		return fmt.Errorf("set meta %s: %w", key, err)
 	}
+	return nil
+}
 
-	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_chunks_conv_id ON chunks(conv_id)`)
-	return err
+// Feedback is a user's verdict on the results of one prime
+type Feedback struct {
+	Query     string
+	Threshold float64
+	Results   int
+	Signal    string
+	CreatedAt time.Time
 }
 
-func (s *Store) Save(c Conversation) error {
+func (s *Store) SaveFeedback(f Feedback) error {
 	_, err := s.db.Exec(
-		`INSERT OR REPLACE INTO conversations (id, content, created_at) VALUES (?, ?, ?)`,
-		c.ID, c.Content, c.CreatedAt.Format(time.RFC3339),
+		`INSERT INTO feedback (query, threshold, results, signal, created_at) VALUES (?, ?, ?, ?, ?)`,
+		f.Query, f.Threshold, f.Results, f.Signal, f.CreatedAt.Format(time.RFC3339),
 	)
 	if err != nil {
-		return fmt.Errorf("insert conversation: %w", err)
+		return fmt.Errorf("insert feedback: %w", err)
 	}
 	return nil
 }
 
-func (s *Store) SaveEmbedding(id string, embedding []float32) error {
-	data, err := json.Marshal(embedding)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(`UPDATE conversations SET embedding = ? WHERE id = ?`, string(data), id)
-	if err != nil {
-		return fmt.Errorf("save embedding: %w", err)
+// MarkAccessed records that these conversations were just returned by a search
+func (s *Store) MarkAccessed(ids []string) error {
+	now := time.Now().Format(time.RFC3339)
+	for _, id := range ids {
+		if _, err := s.db.Exec(`UPDATE conversations SET last_accessed_at = ? WHERE id = ?`, now, id); err != nil {
+			return fmt.Errorf("mark accessed: %w", err)
+		}
 	}
 	return nil
 }
 
-func (s *Store) SaveChunk(c Chunk) error {
-	_, err := s.db.Exec(
-		`INSERT OR REPLACE INTO chunks (id, conv_id, content, position) VALUES (?, ?, ?, ?)`,
-		c.ID, c.ConvID, c.Content, c.Position,
+// ListUnusedSince returns conversations not returned by a search since
+// cutoff. Never-accessed conversations count from their creation time.
+// Timestamps are compared in UTC, so ones written with another offset, say
+// by an import, still sort by the instant they name.
+func (s *Store) ListUnusedSince(cutoff time.Time) ([]Conversation, error) {
+	rows, err := s.rdb.Query(
+		`SELECT id, content, created_at FROM conversations
+		WHERE datetime(COALESCE(last_accessed_at, created_at)) < datetime(?)
+		ORDER BY datetime(created_at)`,
+		cutoff.Format(time.RFC3339),
 	)
-	return err
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var convs []Conversation
+	for rows.Next() {
+		var c Conversation
+		var ts string
+		if err := rows.Scan(&c.ID, &c.Content, &ts); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
 }
 
-func (s *Store) SaveChunkEmbedding(id string, embedding []float32) error {
-	data, err := json.Marshal(embedding)
+// DeleteConversations removes conversations along with their chunks and
+// any dead-letter entries, all in one transaction
+func (s *Store) DeleteConversations(ids []string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("begin: %w", err)
 	}
-	_, err = s.db.Exec(`UPDATE chunks SET embedding = ? WHERE id = ?`, string(data), id)
-	return err
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		for _, q := range []string{
+			`DELETE FROM chunks WHERE conv_id = ?`,
+			`DELETE FROM failed_chunks WHERE conv_id = ?`,
+			`DELETE FROM raw_embeddings WHERE conv_id = ?`,
+			`DELETE FROM tags WHERE conv_id = ?`,
+			`DELETE FROM conversations WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(q, id); err != nil {
+				return fmt.Errorf("delete %s: %w", id, err)
+			}
+		}
+	}
+	return tx.Commit()
 }
 
-type SearchResult struct {
-	ID       string
-	ConvID   string
-	Content  string
-	Distance float64
+// createdBefore matches conversations created before a cutoff. datetime
+// compares the instants, where comparing the RFC 3339 text would misorder
+// timestamps with different UTC offsets.
+const createdBefore = `datetime(created_at) < datetime(?)`
+
+// olderThan selects the IDs of conversations created before a cutoff
+const olderThan = `SELECT id FROM conversations WHERE ` + createdBefore
+
+// CountOlderThan returns how many conversations DeleteOlderThan(cutoff)
+// would remove, and how many chunks they have
+func (s *Store) CountOlderThan(cutoff time.Time) (convs, chunks int, err error) {
+	ts := cutoff.Format(time.RFC3339)
+	if convs, err = s.count(`SELECT COUNT(*) FROM conversations WHERE `+createdBefore, ts); err != nil {
+		return 0, 0, err
+	}
+	if chunks, err = s.count(`SELECT COUNT(*) FROM chunks WHERE conv_id IN (`+olderThan+`)`, ts); err != nil {
+		return 0, 0, err
+	}
+	return convs, chunks, nil
+}
+
+// DeleteOlderThan removes every conversation created before cutoff with
+// its chunks, embeddings, tags and dead-letter entries, in one
+// transaction. It returns how many conversations and chunks went.
+func (s *Store) DeleteOlderThan(cutoff time.Time) (convs, chunks int, err error) {
+	ts := cutoff.Format(time.RFC3339)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"chunks", "failed_chunks", "raw_embeddings", "tags"} {
+		res, err := tx.Exec(`DELETE FROM `+table+` WHERE conv_id IN (`+olderThan+`)`, ts)
+		if err != nil {
+			return 0, 0, fmt.Errorf("delete old %s: %w", table, err)
+		}
+		if table == "chunks" {
+			n, _ := res.RowsAffected()
+			chunks = int(n)
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM conversations WHERE `+createdBefore, ts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("delete old conversations: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return int(n), chunks, nil
 }
 
-func (s *Store) Search(query []float32, limit int, threshold float64) ([]SearchResult, error) {
-	rows, err := s.db.Query(`SELECT id, embedding FROM conversations WHERE embedding IS NOT NULL`)
+// ListEmpty returns conversations that have no chunks, e.g. because every
+// chunk was under --min-words. A non-zero since leaves out the ones
+// created before it, which DeleteOlderThan(since) covers.
+func (s *Store) ListEmpty(since time.Time) ([]Conversation, error) {
+	query := `SELECT id, content, created_at FROM conversations c
+		WHERE NOT EXISTS (SELECT 1 FROM chunks WHERE conv_id = c.id)`
+	var args []any
+	if !since.IsZero() {
+		query += ` AND NOT ` + createdBefore
+		args = append(args, since.Format(time.RFC3339))
+	}
+	rows, err := s.rdb.Query(query+` ORDER BY datetime(created_at)`, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
 	defer rows.Close()
 
-	var results []SearchResult
+	var convs []Conversation
 	for rows.Next() {
-		var id, embJSON string
-		if err := rows.Scan(&id, &embJSON); err != nil {
-			continue
+		var c Conversation
+		var ts string
+		if err := rows.Scan(&c.ID, &c.Content, &ts); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
 		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
+		convs = append(convs, c)
+	}
+	return convs, rows.Err()
+}
 
-		var emb []float32
-		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
-			continue
-		}
+// DeleteChunks removes a conversation's chunks, raw embeddings and
+// dead-letter entries, so re-chunking it doesn't leave rows from the old
+// chunking behind
+func (s *Store) DeleteChunks(convID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
 
-		dist := cosineDistance(query, emb)
-		// Only include results below threshold (lower distance = more similar)
-		if dist < threshold {
-			results = append(results, SearchResult{ID: id, ConvID: id, Distance: dist})
+	for _, q := range []string{
+		`DELETE FROM chunks WHERE conv_id = ?`,
+		`DELETE FROM failed_chunks WHERE conv_id = ?`,
+		`DELETE FROM raw_embeddings WHERE conv_id = ?`,
+	} {
+		if _, err := tx.Exec(q, convID); err != nil {
+			return fmt.Errorf("delete chunks of %s: %w", convID, err)
 		}
 	}
+	return tx.Commit()
+}
 
-	// Sort by distance (ascending)
-	for i := 0; i < len(results); i++ {
-		for j := i + 1; j < len(results); j++ {
-			if results[j].Distance < results[i].Distance {
-				results[i], results[j] = results[j], results[i]
-			}
-		}
+// SetNote annotates a conversation without touching its content. An empty
+// note removes it.
+func (s *Store) SetNote(id, note string) error {
+	res, err := s.db.Exec(`UPDATE conversations SET note = NULLIF(?, '') WHERE id = ?`, note, id)
+	if err != nil {
+		return fmt.Errorf("set note: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("set note: no conversation %s", id)
 	}
+	return nil
+}
 
-	if len(results) > limit {
-		results = results[:limit]
+// normalizeTag is how tags are stored and matched: exact apart from case
+// and surrounding space
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// AddTags tags a conversation, keeping any tags it already has
+func (s *Store) AddTags(convID string, tags []string) error {
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			continue
+		}
+		if _, err := s.db.Exec(`INSERT OR IGNORE INTO tags (conv_id, tag) VALUES (?, ?)`, convID, tag); err != nil {
+			return fmt.Errorf("tag %s: %w", convID, err)
+		}
 	}
-	return results, nil
+	return nil
 }
 
-// SearchChunks searches across all chunks and returns best matches
-func (s *Store) SearchChunks(query []float32, limit int, threshold float64) ([]SearchResult, error) {
-	rows, err := s.db.Query(`SELECT id, conv_id, content, embedding FROM chunks WHERE embedding IS NOT NULL`)
+// Tags returns a conversation's tags in alphabetical order
+func (s *Store) Tags(convID string) ([]string, error) {
+	rows, err := s.rdb.Query(`SELECT tag FROM tags WHERE conv_id = ? ORDER BY tag`, convID)
 	if err != nil {
-		return nil, fmt.Errorf("query chunks: %w", err)
+		return nil, fmt.Errorf("query: %w", err)
 	}
 	defer rows.Close()
 
-	var results []SearchResult
+	var tags []string
 	for rows.Next() {
-		var id, convID, content, embJSON string
-		if err := rows.Scan(&id, &convID, &content, &embJSON); err != nil {
-			continue
-		}
-
-		var emb []float32
-		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
-			continue
-		}
-
-		dist := cosineDistance(query, emb)
-		if dist < threshold {
-			results = append(results, SearchResult{ID: id, ConvID: convID, Content: content, Distance: dist})
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
 		}
+		tags = append(tags, tag)
 	}
+	return tags, rows.Err()
+}
 
-	// Sort by distance (ascending)
-	for i := 0; i < len(results); i++ {
-		for j := i + 1; j < len(results); j++ {
-			if results[j].Distance < results[i].Distance {
-				results[i], results[j] = results[j], results[i]
-			}
-		}
+// tagFilterSQL is a WHERE clause suffix keeping rows whose column holds the
+// ID of a conversation tagged with tag, or nothing if tag is empty. Its
+// arguments come from tagArgs.
+func tagFilterSQL(column, tag string) string {
+	if normalizeTag(tag) == "" {
+		return ""
 	}
+	return ` AND ` + column + ` IN (SELECT conv_id FROM tags WHERE tag = ?)`
+}
 
-	if len(results) > limit {
-		results = results[:limit]
+func tagArgs(tag string) []any {
+	if tag = normalizeTag(tag); tag == "" {
+		return nil
 	}
-	return results, nil
+	return []any{tag}
 }
 
-func (s *Store) HasChunks() bool {
-	var count int
-	s.db.QueryRow(`SELECT COUNT(*) FROM chunks WHERE embedding IS NOT NULL`).Scan(&count)
-	return count > 0
+// Delete removes one conversation with its chunks and their embeddings
+func (s *Store) Delete(id string) error {
+	return s.DeleteConversations([]string{id})
 }
 
-func (s *Store) List() ([]Conversation, error) {
-	rows, err := s.db.Query(`SELECT id, content, created_at FROM conversations ORDER BY created_at DESC`)
+// ResolvePrefix returns the IDs of every conversation starting with prefix
+func (s *Store) ResolvePrefix(prefix string) ([]string, error) {
+	rows, err := s.rdb.Query(`SELECT id FROM conversations WHERE substr(id, 1, ?) = ? ORDER BY id`, len(prefix), prefix)
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
 	defer rows.Close()
 
-	var convs []Conversation
+	var ids []string
 	for rows.Next() {
-		var c Conversation
-		var ts string
-		if err := rows.Scan(&c.ID, &c.Content, &ts); err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, fmt.Errorf("scan: %w", err)
 		}
-		c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
-		convs = append(convs, c)
+		ids = append(ids, id)
 	}
-	return convs, rows.Err()
+	return ids, rows.Err()
 }
 
-func (s *Store) Get(id string) (Conversation, error) {
+// GetPreview is like Get but only fetches the first n characters of the
+// content, for listings that would otherwise load every full conversation
+func (s *Store) GetPreview(id string, n int) (Conversation, error) {
 	var c Conversation
 	var ts string
-	err := s.db.QueryRow(
-		`SELECT id, content, created_at FROM conversations WHERE id = ?`, id,
-	).Scan(&c.ID, &c.Content, &ts)
+	err := s.rdb.QueryRow(
+		`SELECT id, substr(content, 1, ?), created_at, COALESCE(title, ''), COALESCE(note, '') FROM conversations WHERE id = ?`, n, id,
+	).Scan(&c.ID, &c.Content, &ts, &c.Title, &c.Note)
 	if err != nil {
 		return c, fmt.Errorf("get conversation %s: %w", id, err)
 	}
+	fetchedContent.Add(int64(len(c.Content)))
 	c.CreatedAt, _ = time.Parse(time.RFC3339, ts)
 	return c, nil
 }
 
+// DBInfo describes the database file for diagnostics
+type DBInfo struct {
+	SQLiteVersion string
+	JournalMode   string
+	PageSize      int
+	PageCount     int
+	Tables        []TableInfo
+	Meta          map[string]string
+}
+
+// TableInfo is one table's or index's DDL, with its row count for tables
+type TableInfo struct {
+	Name string
+	Type string
+	SQL  string
+	Rows int
+}
+
+// Info gathers the SQLite version, pragmas, schema, row counts and meta
+func (s *Store) Info() (DBInfo, error) {
+	var info DBInfo
+	if err := s.rdb.QueryRow(`SELECT sqlite_version()`).Scan(&info.SQLiteVersion); err != nil {
+		return info, fmt.Errorf("sqlite version: %w", err)
+	}
+	for _, p := range []struct {
+		pragma string
+		dest   any
+	}{
+		{"journal_mode", &info.JournalMode},
+		{"page_size", &info.PageSize},
+		{"page_count", &info.PageCount},
+	} {
+		if err := s.rdb.QueryRow(`PRAGMA ` + p.pragma).Scan(p.dest); err != nil {
+			return info, fmt.Errorf("pragma %s: %w", p.pragma, err)
+		}
+	}
+
+	rows, err := s.rdb.Query(`SELECT name, type, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type DESC, name`)
+	if err != nil {
+		return info, fmt.Errorf("query schema: %w", err)
+	}
+	for rows.Next() {
+		var t TableInfo
+		if err := rows.Scan(&t.Name, &t.Type, &t.SQL); err != nil {
+			rows.Close()
+			return info, fmt.Errorf("scan: %w", err)
+		}
+		info.Tables = append(info.Tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return info, err
+	}
+
+	for i, t := range info.Tables {
+		if t.Type != "table" {
+			continue
+		}
+		if err := s.rdb.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %q`, t.Name)).Scan(&info.Tables[i].Rows); err != nil {
+			return info, fmt.Errorf("count %s: %w", t.Name, err)
+		}
+	}
+
+	info.Meta = make(map[string]string)
+	metaRows, err := s.rdb.Query(`SELECT key, value FROM meta`)
+	if err != nil {
+		return info, fmt.Errorf("query meta: %w", err)
+	}
+	defer metaRows.Close()
+	for metaRows.Next() {
+		var k, v string
+		if err := metaRows.Scan(&k, &v); err != nil {
+			return info, fmt.Errorf("scan: %w", err)
+		}
+		info.Meta[k] = v
+	}
+	return info, metaRows.Err()
+}
+
 func (s *Store) Close() error {
-	return s.db.Close()
+	if s.rdb == s.db {
+		return s.db.Close()
+	}
+	rerr := s.rdb.Close()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return rerr
+}
+
+// distanceFunc returns the distance function for a metric, nil if there
+// is no such metric
+func distanceFunc(metric string) func(a, b []float32) float64 {
+	switch metric {
+	case metricCosine:
+		return cosineDistance
+	case metricL2:
+		return l2Distance
+	}
+	return nil
 }
 
 func cosineDistance(a, b []float32) float64 {
@@ -267,3 +2056,34 @@ func cosineDistance(a, b []float32) float64 {
 	similarity := dot / (math.Sqrt(normA) * math.Sqrt(normB))
 	return 1.0 - similarity
 }
+
+func l2Distance(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// normalizeVector returns v scaled to unit L2 length. A zero vector has
+// no direction and is returned as-is.
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := math.Sqrt(sum)
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = float32(float64(x) / norm)
+	}
+	return out
+}
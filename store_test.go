@@ -0,0 +1,402 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a fresh database in a temporary directory
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// seed stores a conversation made of chunks, each embedded with
+// fakeEmbedding
+func seed(t *testing.T, store *Store, convID string, chunks ...string) {
+	t.Helper()
+	if err := store.Save(Conversation{ID: convID, Content: strings.Join(chunks, "\n\n"), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range chunks {
+		id := chunkID(convID, i)
+		if err := store.SaveChunk(Chunk{ID: id, ConvID: convID, Content: text, Position: i}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveChunkEmbedding(id, fakeEmbedding(text, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchHybridBreakdown(t *testing.T) {
+	store := newTestStore(t)
+	seed(t, store, "conv1", "goroutine worker pools in go", "worker pools drain the queue")
+	seed(t, store, "conv2", "ERR_CONN_RESET from dialContext", "unrelated cooking notes")
+
+	query := "worker pools ERR_CONN_RESET"
+	results, err := store.SearchHybrid(fakeEmbedding(query, 16), "ERR_CONN_RESET", 10, 0.8, 0.5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("no results")
+	}
+
+	var dmin, dmax float64 = math.Inf(1), math.Inf(-1)
+	for _, r := range results {
+		if r.Distance < 0.8 {
+			dmin, dmax = min(dmin, r.Distance), max(dmax, r.Distance)
+		}
+	}
+	keyword := false
+	for i, r := range results {
+		h := r.Hybrid
+		if h == nil {
+			t.Fatalf("result %s has no breakdown", r.ID)
+		}
+		if h.Rank != i+1 {
+			t.Errorf("%s: rank %d at position %d", r.ID, h.Rank, i+1)
+		}
+		if want := 0.5*h.VectorNorm + 0.5*h.KeywordNorm; math.Abs(h.Fused-want) > 1e-9 {
+			t.Errorf("%s: fused %v, want 0.5*%v + 0.5*%v = %v", r.ID, h.Fused, h.VectorNorm, h.KeywordNorm, want)
+		}
+		if r.Distance < 0.8 && dmax > dmin {
+			if want := (dmax - r.Distance) / (dmax - dmin); math.Abs(h.VectorNorm-want) > 1e-9 {
+				t.Errorf("%s: vector norm %v, want %v", r.ID, h.VectorNorm, want)
+			}
+		}
+		if i > 0 && results[i-1].Hybrid.Fused < h.Fused {
+			t.Errorf("%s ranks below a lower fused score", r.ID)
+		}
+		if h.Keyword > 0 {
+			keyword = true
+			if h.KeywordNorm != 1 {
+				t.Errorf("%s: the only keyword match has norm %v, want 1", r.ID, h.KeywordNorm)
+			}
+		}
+	}
+	if !keyword {
+		t.Error("no result has a keyword score")
+	}
+}
+
+func TestSearchHybridAlphaExtremes(t *testing.T) {
+	store := newTestStore(t)
+	seed(t, store, "conv1", "retry the worker", "worker worker pool", "pool of connections")
+	seed(t, store, "conv2", "worker pool worker pool worker", "a worker once", "nothing related")
+
+	query := fakeEmbedding("worker pool", 16)
+	ids := func(results []SearchResult) []string {
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+
+	keyword, err := store.SearchText("worker", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, err := store.SearchHybrid(query, "worker", 10, 0.9, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(hybrid), ids(keyword); !slices.Equal(got, want) {
+		t.Errorf("alpha 0 ranks %v, SearchText ranks %v", got, want)
+	}
+
+	vector, err := store.SearchChunks(query, 10, 0.9, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid, err = store.SearchHybrid(query, "worker", 10, 0.9, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(hybrid), ids(vector); !slices.Equal(got, want) {
+		t.Errorf("alpha 1 ranks %v, SearchChunks ranks %v", got, want)
+	}
+	if len(keyword) < 2 || len(vector) < 2 {
+		t.Fatalf("want several matches on each side, got %d keyword and %d vector", len(keyword), len(vector))
+	}
+}
+
+func TestListUnusedSince(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	long := now.Add(-400 * 24 * time.Hour)
+	hawaii := time.FixedZone("HST", -10*3600)
+	for id, accessed := range map[string]string{
+		"never":    "",
+		"stale":    now.Add(-200 * 24 * time.Hour).Format(time.RFC3339),
+		"recent":   now.Add(-time.Hour).Format(time.RFC3339),
+		"offset":   now.Add(-time.Hour).In(hawaii).Format(time.RFC3339),
+		"stale-tz": now.Add(-200 * 24 * time.Hour).In(hawaii).Format(time.RFC3339),
+	} {
+		if err := store.Save(Conversation{ID: id, Content: id, CreatedAt: long}); err != nil {
+			t.Fatal(err)
+		}
+		if accessed != "" {
+			if _, err := store.db.Exec(`UPDATE conversations SET last_accessed_at = ? WHERE id = ?`, accessed, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := store.Save(Conversation{ID: "new", Content: "new", CreatedAt: now.In(hawaii)}); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := store.ListUnusedSince(now.Add(-180 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range stale {
+		ids = append(ids, c.ID)
+	}
+	slices.Sort(ids)
+	if want := []string{"never", "stale", "stale-tz"}; !slices.Equal(ids, want) {
+		t.Errorf("ListUnusedSince = %v, want %v", ids, want)
+	}
+
+	stale, err = store.ListUnusedSince(now.Add(-2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range stale {
+		if c.ID == "offset" || c.ID == "recent" || c.ID == "new" {
+			t.Errorf("%s was used an hour ago but is listed as unused for 2h", c.ID)
+		}
+	}
+}
+
+func TestChunkIDRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		conv string
+		pos  int
+	}{
+		{"3f2a1b4c9d", 0},
+		{"3f2a1b4c9d", 12},
+		{"title_with_underscores", 3},
+		{"abc-v2", 1},
+		{"a" + chunkIDSep + "7", 2},
+		{"3f2a1b4c9d", titlePosition},
+	} {
+		id := chunkID(tc.conv, tc.pos)
+		conv, pos, err := ParseChunkID(id)
+		if err != nil || conv != tc.conv || pos != tc.pos {
+			t.Errorf("ParseChunkID(%q) = %q, %d, %v; want %q, %d", id, conv, pos, err, tc.conv, tc.pos)
+		}
+	}
+
+	for _, id := range []string{"", "noseparator", chunkIDSep + "1", "abc" + chunkIDSep, "abc" + chunkIDSep + "x", "abc" + chunkIDSep + "-2", "abc" + chunkIDSep + "01"} {
+		if _, _, err := ParseChunkID(id); err == nil {
+			t.Errorf("ParseChunkID(%q) succeeded", id)
+		}
+	}
+}
+
+func TestChunksForConversationInPositionOrder(t *testing.T) {
+	store := newTestStore(t)
+	for _, id := range []string{"conv1", "conv2"} {
+		if err := store.Save(Conversation{ID: id, Content: id, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Saved out of order, with positions past 9 so text order would differ
+	for _, pos := range []int{10, 2, 0, 9, 1} {
+		if err := store.SaveChunk(Chunk{ID: chunkID("conv1", pos), ConvID: "conv1", Content: strconv.Itoa(pos), Position: pos}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SaveChunk(Chunk{ID: chunkID("conv2", 0), ConvID: "conv2", Content: "other", Position: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := store.ChunksForConversation("conv1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, c := range chunks {
+		if c.ConvID != "conv1" {
+			t.Errorf("chunk %s of %s returned for conv1", c.ID, c.ConvID)
+		}
+		got = append(got, c.Position)
+	}
+	if want := []int{0, 1, 2, 9, 10}; !slices.Equal(got, want) {
+		t.Errorf("positions = %v, want %v", got, want)
+	}
+
+	var plan string
+	var id, parent, notused int
+	if err := store.db.QueryRow(`EXPLAIN QUERY PLAN SELECT id FROM chunks WHERE conv_id = ? ORDER BY position`, "conv1").Scan(&id, &parent, &notused, &plan); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "idx_chunks_conv_position") {
+		t.Errorf("lookup by conv_id doesn't use the (conv_id, position) index: %s", plan)
+	}
+}
+
+func TestValidateQueryDimCatchesMismatchedStoredVector(t *testing.T) {
+	store := newTestStore(t)
+	seed(t, store, "conv1", "worker pools")
+	if err := store.ValidateQueryDim(make([]float32, 16)); err != nil {
+		t.Fatalf("matching query rejected: %v", err)
+	}
+
+	// A vector of the wrong length, as in a copied or corrupted file
+	other := newTestStore(t)
+	seed(t, other, "conv1", "worker pools")
+	if _, err := other.db.Exec(`UPDATE chunks SET embedding = ?`, "[0.1,0.2,0.3]"); err != nil {
+		t.Fatal(err)
+	}
+	err := other.ValidateQueryDim(make([]float32, 16))
+	if err == nil || !strings.Contains(err.Error(), "index appears corrupt or built with a different model") {
+		t.Errorf("ValidateQueryDim = %v, want the corrupt index error", err)
+	}
+}
+
+func TestOlderThanComparesInstants(t *testing.T) {
+	store := newTestStore(t)
+	cutoff := time.Now().UTC().Truncate(time.Second).Add(-24 * time.Hour)
+	// As text, the old one in UTC+14 sorts after the cutoff and the new
+	// one in UTC-10 before it
+	kiribati, hawaii := time.FixedZone("LINT", 14*3600), time.FixedZone("HST", -10*3600)
+	seed(t, store, "old", "worker pools")
+	seed(t, store, "new", "night trains")
+	for id, created := range map[string]time.Time{
+		"old":   cutoff.Add(-time.Hour).In(kiribati),
+		"new":   cutoff.Add(time.Hour).In(hawaii),
+		"empty": cutoff.Add(-time.Hour).In(kiribati),
+	} {
+		if err := store.Save(Conversation{ID: id, Content: id, CreatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	convs, chunks, err := store.CountOlderThan(cutoff)
+	if err != nil || convs != 2 || chunks != 1 {
+		t.Errorf("CountOlderThan = %d conversations, %d chunks, %v; want 2 and 1", convs, chunks, err)
+	}
+	empty, err := store.ListEmpty(cutoff)
+	if err != nil || len(empty) != 0 {
+		t.Errorf("ListEmpty(cutoff) = %+v, %v; want the old empty one left to DeleteOlderThan", empty, err)
+	}
+	if empty, err := store.ListEmpty(time.Time{}); err != nil || len(empty) != 1 || empty[0].ID != "empty" {
+		t.Errorf("ListEmpty() = %+v, %v; want the empty conversation", empty, err)
+	}
+
+	convs, chunks, err = store.DeleteOlderThan(cutoff)
+	if err != nil || convs != 2 || chunks != 1 {
+		t.Errorf("DeleteOlderThan = %d conversations, %d chunks, %v; want 2 and 1", convs, chunks, err)
+	}
+	left, err := store.List()
+	if err != nil || len(left) != 1 || left[0].ID != "new" {
+		t.Errorf("left after DeleteOlderThan = %+v, %v; want only new", left, err)
+	}
+}
+
+func TestMigrationsRunInOrderOnce(t *testing.T) {
+	var ran []int
+	wrapped := make([]func(s *Store) error, len(migrations))
+	for i, m := range migrations {
+		wrapped[i] = func(s *Store) error {
+			ran = append(ran, i)
+			return m(s)
+		}
+	}
+	setVar(t, &migrations, wrapped)
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	open := func() *Store {
+		t.Helper()
+		ran = nil
+		store, err := NewStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	schema := func(store *Store) string {
+		t.Helper()
+		rows, err := store.db.Query(`SELECT type, name, COALESCE(sql, '') FROM sqlite_master ORDER BY type, name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var b strings.Builder
+		for rows.Next() {
+			var typ, name, sql string
+			if err := rows.Scan(&typ, &name, &sql); err != nil {
+				t.Fatal(err)
+			}
+			b.WriteString(typ + " " + name + ": " + sql + "\n")
+		}
+		return b.String()
+	}
+	all := make([]int, schemaVersion)
+	for i := range all {
+		all[i] = i
+	}
+
+	store := open()
+	if !slices.Equal(ran, all) {
+		t.Errorf("a new database ran migrations %v, want %v", ran, all)
+	}
+	if v, err := store.storedSchemaVersion(); err != nil || v != schemaVersion {
+		t.Errorf("schema version = %d, %v; want %d", v, err, schemaVersion)
+	}
+	seed(t, store, "conv1", "worker pools")
+	want := schema(store)
+	store.Close()
+
+	store = open()
+	if len(ran) != 0 {
+		t.Errorf("reopening ran migrations %v, want none", ran)
+	}
+	store.Close()
+
+	// A database from before versions were recorded reruns every step
+	// over the schema it has, and one interrupted part way resumes
+	for _, from := range []int{0, schemaVersion - 2} {
+		store = open()
+		if err := store.SetMeta(metaSchemaVersion, strconv.Itoa(from)); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		store = open()
+		if !slices.Equal(ran, all[from:]) {
+			t.Errorf("from version %d ran migrations %v, want %v", from, ran, all[from:])
+		}
+		if got := schema(store); got != want {
+			t.Errorf("rerunning from version %d changed the schema:\n%s\nwant:\n%s", from, got, want)
+		}
+		if c, err := store.Get("conv1"); err != nil || c.Content != "worker pools" {
+			t.Errorf("conversation after rerunning from version %d = %+v, %v", from, c, err)
+		}
+		store.Close()
+	}
+
+	store = open()
+	if err := store.SetMeta(metaSchemaVersion, strconv.Itoa(schemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if _, err := NewStore(path); err == nil || !strings.Contains(err.Error(), "newer than this memctx supports") {
+		t.Errorf("opening a newer schema = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// timing collects per-chunk latencies when --time or --verbose is set, nil
+// otherwise
+var timing *ingestTiming
+
+type ingestTiming struct {
+	embed latencies
+	write latencies
+}
+
+// Print writes the stats to stdout for --time, or to stderr with the rest
+// of the --verbose output
+func (t *ingestTiming) Print() {
+	printf := verbosef
+	if timeOps {
+		printf = func(format string, args ...any) { fmt.Printf(format, args...) }
+	}
+	printf("Embed:    %s\n", t.embed.Summary())
+	printf("DB write: %s\n", t.write.Summary())
+}
+
+type latencies []time.Duration
+
+func (l *latencies) Add(d time.Duration) {
+	*l = append(*l, d)
+}
+
+// Summary formats the sample count with min/mean/max/p95
+func (l latencies) Summary() string {
+	if len(l) == 0 {
+		return "no samples"
+	}
+
+	sorted := append(latencies(nil), l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	// Nearest-rank percentile
+	p95 := sorted[(len(sorted)*95+99)/100-1]
+
+	return fmt.Sprintf("%d samples, min %s, mean %s, max %s, p95 %s",
+		len(sorted), round(sorted[0]), round(total/time.Duration(len(sorted))), round(sorted[len(sorted)-1]), round(p95))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
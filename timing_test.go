@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatenciesSummary(t *testing.T) {
+	var l latencies
+	for i := 20; i >= 1; i-- {
+		l.Add(time.Duration(i) * time.Millisecond)
+	}
+	want := "20 samples, min 1ms, mean 10.5ms, max 20ms, p95 19ms"
+	if got := l.Summary(); got != want {
+		t.Errorf("Summary = %q, want %q", got, want)
+	}
+	if got := (latencies{}).Summary(); got != "no samples" {
+		t.Errorf("empty Summary = %q", got)
+	}
+}
+
+func TestUploadTimeCountsSamples(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	paras := make([]string, embedBatchSize+3)
+	for i := range paras {
+		paras[i] = strings.Repeat("paragraph words here ", 30)
+	}
+	file := writeFile(t, "conv.txt", strings.Join(paras, "\n\n"))
+
+	out, _, err := runCmd(t, append(f.args(db), "upload", file, "--time", "--no-cache")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One embed sample and one write per chunk, though the 35 chunks went
+	// to Ollama in two batches
+	want := []string{"Embed:    35 samples", "DB write: 35 samples"}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("upload timing summary is missing %q:\n%s", w, out)
+		}
+	}
+
+	out, _, err = runCmd(t, append(f.args(db), "reindex", "--time", "--no-cache")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("reindex timing summary is missing %q:\n%s", w, out)
+		}
+	}
+
+	// --verbose turns timing on too, on stderr
+	out, stderr, err := runCmd(t, append(f.args(db), "reindex", "--verbose", "--no-cache")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "Embed:") || !strings.Contains(stderr, want[0]) {
+		t.Errorf("reindex --verbose timing summary isn't on stderr:\nstdout:\n%s\nstderr:\n%s", out, stderr)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	warmFile      string
+	warmServer    string
+	warmK         int
+	warmThreshold float64
+)
+
+func init() {
+	rootCmd.AddCommand(warmQueriesCmd)
+	warmQueriesCmd.Flags().StringVar(&warmFile, "file", "", "queries to warm, one per line (blank lines and # comments are skipped)")
+	warmQueriesCmd.Flags().StringVar(&warmServer, "server", "http://localhost:8080", "URL of the running `memctx serve`")
+	warmQueriesCmd.Flags().IntVar(&warmK, "k", 10, "k the queries will be searched with")
+	warmQueriesCmd.Flags().Float64Var(&warmThreshold, "threshold", defaultThreshold, "threshold the queries will be searched with")
+	warmQueriesCmd.MarkFlagRequired("file")
+}
+
+var warmQueriesCmd = &cobra.Command{
+	Use:   "warm-queries --file <queries.txt>",
+	Short: "Pre-run common queries against a running server so they start warm",
+	Long: `Send a list of common queries to a running memctx serve, which
+searches each one to fill its caches before real traffic arrives: query
+embeddings go to the embedding cache in the database, and results to the
+server's in-memory result cache. A later /search or /prime for the same
+query, k and threshold is answered without calling Ollama until the
+database changes.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		queries, err := readQueries(warmFile)
+		if err != nil {
+			return err
+		}
+		if len(queries) == 0 {
+			return fmt.Errorf("%s has no queries", warmFile)
+		}
+
+		resp, err := postWarm(cmd.Context(), warmServer, warmRequest{Queries: queries, K: warmK, Threshold: warmThreshold})
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return writeJSON(resp)
+		}
+		fmt.Printf("Warmed %d queries; the server caches %d result sets.\n", resp.Warmed, resp.Cached)
+		return nil
+	},
+}
+
+// readQueries reads one query per line, skipping blank lines and lines
+// starting with #
+func readQueries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		q := strings.TrimSpace(sc.Text())
+		if q == "" || strings.HasPrefix(q, "#") {
+			continue
+		}
+		queries = append(queries, q)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return queries, nil
+}
+
+type warmRequest struct {
+	Queries   []string `json:"queries"`
+	K         int      `json:"k"`
+	Threshold float64  `json:"threshold"`
+}
+
+type warmResponse struct {
+	Warmed int `json:"warmed"`
+	// Cached is how many result sets the server holds afterwards
+	Cached int `json:"cached"`
+}
+
+// postWarm sends the queries to a server's /warm endpoint
+func postWarm(ctx context.Context, server string, req warmRequest) (warmResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return warmResponse{}, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(server, "/")+"/warm", bytes.NewReader(body))
+	if err != nil {
+		return warmResponse{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return warmResponse{}, fmt.Errorf("warm %s: %w (is `memctx serve` running?)", server, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return warmResponse{}, fmt.Errorf("warm %s: %s", server, e.Error)
+	}
+	var out warmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return warmResponse{}, fmt.Errorf("decode warm response: %w", err)
+	}
+	return out, nil
+}
+
+// maxCachedResults bounds the result cache; past it an arbitrary entry
+// makes room
+const maxCachedResults = 1000
+
+// resultCache keeps serve's recent search results. They depend on what is
+// stored, so all are dropped once the database has changed. The zero
+// value is empty and ready to use.
+type resultCache struct {
+	mu      sync.Mutex
+	version int64
+	// epoch counts the drops, so results computed before one aren't
+	// cached after it
+	epoch   int64
+	results map[resultKey][]SearchResult
+}
+
+type resultKey struct {
+	query     string
+	k         int
+	threshold float64
+}
+
+// get returns the results cached for key, after dropping everything if
+// the database is no longer at version, and the epoch to put fresh
+// results back with
+func (c *resultCache) get(key resultKey, version int64) ([]SearchResult, bool, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		c.drop()
+		c.version = version
+	}
+	res, ok := c.results[key]
+	return res, ok, c.epoch
+}
+
+// put caches results for key, unless they were dropped since get
+// returned epoch
+func (c *resultCache) put(key resultKey, epoch int64, results []SearchResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if c.results == nil {
+		c.results = make(map[resultKey][]SearchResult)
+	}
+	if _, ok := c.results[key]; !ok && len(c.results) >= maxCachedResults {
+		for k := range c.results {
+			delete(c.results, k)
+			break
+		}
+	}
+	c.results[key] = results
+}
+
+// clear drops every cached result, for the server's own writes, which
+// don't move the data version of the connection that made them
+func (c *resultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop()
+}
+
+func (c *resultCache) drop() {
+	c.results = nil
+	c.epoch++
+}
+
+func (c *resultCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.results)
+}
+
+// cachedSearch is searchStore through the server's caches: results come
+// from the result cache and query embeddings from the database's
+// embedding cache when they can, and both are filled when they can't
+func (s *server) cachedSearch(ctx context.Context, query string, k int, threshold float64) ([]SearchResult, error) {
+	version, err := s.store.DataVersion()
+	if err != nil {
+		return nil, err
+	}
+	key := resultKey{query, k, threshold}
+	results, ok, epoch := s.results.get(key, version)
+	if ok {
+		return results, nil
+	}
+
+	hash := hashContent([]byte(query))
+	queryEmb, ok, err := s.store.CachedEmbedding(hash, s.embed.model)
+	if err != nil {
+		return nil, err
+	}
+	// An entry from before a reindex that changed the dimension
+	if dim := s.store.Dimension(); ok && dim > 0 && len(queryEmb) != dim {
+		ok = false
+	}
+	if !ok {
+		if queryEmb, err = s.embed.Embed(ctx, query); err != nil {
+			return nil, fmt.Errorf("embed query: %w", err)
+		}
+		if !dbReadOnly {
+			if err := s.store.CacheEmbedding(hash, s.embed.model, queryEmb); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results, err = searchEmbedded(s.store, queryEmb, query, k, threshold)
+	if err != nil {
+		return nil, err
+	}
+	s.results.put(key, epoch, results)
+	return results, nil
+}
+
+func (s *server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.warm(r)
+	writeResponse(w, http.StatusOK, resp, err)
+}
+
+func (s *server) warm(r *http.Request) (warmResponse, error) {
+	if err := s.refresh(); err != nil {
+		return warmResponse{}, err
+	}
+	req := warmRequest{K: 10, Threshold: defaultThreshold}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return warmResponse{}, badRequest("body must be {\"queries\": [...]}: %v", err)
+	}
+	if len(req.Queries) == 0 {
+		return warmResponse{}, badRequest("queries is empty")
+	}
+	if err := checkSearchParams(req.K, req.Threshold); err != nil {
+		return warmResponse{}, err
+	}
+
+	resp := warmResponse{}
+	for i, q := range req.Queries {
+		query, err := requireQuery(q)
+		if err != nil {
+			return resp, badRequest("query %d: %v", i+1, err)
+		}
+		if _, err := s.cachedSearch(r.Context(), query, req.K, req.Threshold); err != nil {
+			return resp, fmt.Errorf("query %d: %w", i+1, err)
+		}
+		resp.Warmed++
+	}
+	resp.Cached = s.results.len()
+	return resp, nil
+}
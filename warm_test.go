@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWarmQueriesServeRepeatsWithoutEmbedding(t *testing.T) {
+	f := newFakeOllama(t)
+	db := filepath.Join(t.TempDir(), "test.db")
+	uploadTexts(t, f, db, strings.Repeat("worker pools drain the queue ", 20))
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	s := &server{store: store, embed: f.client(testEmbedModel), gen: f.client(testGenModel)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/warm", allow(http.MethodPost, s.handleWarm))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	queries := writeFile(t, "queries.txt", "# common questions\nworker pools\n\n  night trains  \n")
+	out, _, err := runCmd(t, append(f.args(db), "warm-queries", "--file", queries, "--server", srv.URL, "--threshold", "0.5")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Warmed 2 queries; the server caches 2 result sets.") {
+		t.Errorf("warm-queries output:\n%s", out)
+	}
+
+	search := func(q string) []jsonMatch {
+		t.Helper()
+		var matches []jsonMatch
+		if code := get(t, s.handleSearch, q, &matches); code != http.StatusOK {
+			t.Fatalf("search %s = %d", q, code)
+		}
+		return matches
+	}
+	before, _ := f.embedCalls()
+	if matches := search("/search?threshold=0.5&q=" + url.QueryEscape("worker pools")); len(matches) != 1 {
+		t.Errorf("warmed search = %+v, want the stored conversation", matches)
+	}
+	// Another k misses the result cache but not the embedding cache
+	search("/search?k=3&threshold=0.5&q=" + url.QueryEscape("worker pools"))
+	if after, _ := f.embedCalls(); after != before {
+		t.Errorf("%d embed calls for warmed queries, want none", after-before)
+	}
+
+	// A write from another process drops the cached results
+	seed(t, newStoreAt(t, db), "pools2", "worker pools")
+	if matches := search("/search?threshold=0.5&q=" + url.QueryEscape("worker pools")); len(matches) != 2 {
+		t.Errorf("search after another process wrote = %d matches, want the new conversation too", len(matches))
+	}
+	// and so does one through the server
+	rec := httptest.NewRecorder()
+	s.handleUpload(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("worker pools again")))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	if matches := search("/search?threshold=0.5&q=" + url.QueryEscape("worker pools")); len(matches) != 3 {
+		t.Errorf("search after an upload = %d matches, want the upload too", len(matches))
+	}
+}
+
+// newStoreAt opens a second store on the database at path
+func newStoreAt(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}